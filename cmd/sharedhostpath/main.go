@@ -17,12 +17,16 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/kazimsarikaya/csi-sharedhostpath/internal/sharedhostpath"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
 	"os"
 	"path"
+	"time"
 )
 
 func init() {
@@ -35,13 +39,35 @@ var (
 	driverName        = flag.String("drivername", "sharedhostpath.csi.k8s.io", "name of the driver")
 	nodeID            = flag.String("nodeid", "", "node id")
 	dataRoot          = flag.String("dataroot", "/csi-data-dir", "node id")
-	dsn               = flag.String("dsn", "", "postgres data dsn")
+	pools             = flag.String("pools", "", "additional storage pools as name=path pairs separated by comma, dataroot is the default pool")
+	dsn               = flag.String("dsn", "", "postgres data dsn, bolt:// for the embedded metadata store of small single controller setups or kubernetes:// for custom resources")
 	maxVolumesPerNode = flag.Int64("maxvolumespernode", 0, "limit of volumes per node")
 	showVersion       = flag.Bool("version", false, "Show version.")
 	controller        = flag.Bool("controller", false, "Run as controller.")
 	node              = flag.Bool("node", false, "Run as node.")
 	rebuildsymlinks   = flag.Bool("job-rebuildsymlinks", false, "Rebuild sym links.")
 	cleanupdangling   = flag.Bool("job-cleanupdangling", false, "Cleanup dangling volumes.")
+	cleanupDryRun     = flag.Bool("cleanup-dryrun", false, "List dangling volumes without deleting them.")
+	cleanupReport     = flag.String("cleanup-report", "", "write dangling volumes as json to the path")
+	cleanupMaxVolumes = flag.Int("cleanup-maxvolumes", 10, "refuse cleanup when more volumes have no records, 0 disables")
+	cleanupMaxPercent = flag.Float64("cleanup-maxpercent", 50, "refuse cleanup when more percent of volumes have no records, 0 disables")
+	cleanupForce      = flag.Bool("cleanup-force", false, "Cleanup even if thresholds are exceeded.")
+	cleanupQuarantine = flag.String("cleanup-quarantine", "", "move dangling volumes into the folder inside each pool instead of deleting")
+	trashRetention    = flag.Duration("trash-retention", 0, "keep deleted volumes at the trash folder of each pool for the duration, 0 deletes at once")
+	restorevolume     = flag.Bool("job-restorevolume", false, "Restore a trashed volume.")
+	restoreVolumeID   = flag.String("restore-volumeid", "", "id of the trashed volume to restore")
+	restorePVName     = flag.String("restore-pvname", "", "name of the new pv of the restored volume")
+	fsck              = flag.Bool("job-fsck", false, "Check volume records against shared storage.")
+	fsckRepair        = flag.Bool("fsck-repair", false, "Repair safe issues found by fsck.")
+	fsckReport        = flag.String("fsck-report", "", "write fsck report as json to the path, stdout when empty")
+	fsckNodeAge       = flag.Duration("fsck-nodeage", 5*time.Minute, "publish infos of nodes not seen for the duration are reported")
+	metricsAddress    = flag.String("metrics-address", "", "serve prometheus metrics at the address such as :9090, empty disables")
+	monitorInterval   = flag.Duration("monitor-interval", 5*time.Minute, "check volume conditions at the controller at the interval, 0 disables")
+	monitorMinFree    = flag.Float64("monitor-minfreepercent", 10, "volumes of pools with less free space percent are abnormal, 0 disables")
+	monitorEvents     = flag.Bool("monitor-events", false, "Report volume condition changes as events of pvcs.")
+	nodeTimeout       = flag.Duration("node-timeout", 0, "mark nodes not seen for the duration dead at the controller, e.g. 5m, 0 disables")
+	nodeUnpublish     = flag.Bool("node-forceunpublish", false, "Unpublish volumes from dead nodes.")
+	kubeconfig        = flag.String("kubeconfig", "", "kubeconfig for the events, in cluster config is used when empty")
 	// Set by the build process
 	version   = ""
 	buildTime = ""
@@ -73,30 +99,81 @@ func handle() {
 	if *cleanupdangling {
 		f_cnt++
 	}
+	if *restorevolume {
+		f_cnt++
+	}
+	if *fsck {
+		f_cnt++
+	}
 	if f_cnt != 1 {
-		fmt.Printf("only one of controller,node,job-rebuildsymlinks,job-cleanupdangling flags should be set.\n")
+		fmt.Printf("only one of controller,node,job-rebuildsymlinks,job-cleanupdangling,job-restorevolume,job-fsck flags should be set.\n")
+		os.Exit(1)
+	}
+
+	poolRoots, err := sharedhostpath.ParsePools(*dataRoot, *pools)
+	if err != nil {
+		fmt.Printf("cannot parse pools: %v\n", err)
 		os.Exit(1)
 	}
 
-	if *rebuildsymlinks || *cleanupdangling {
-		vh, err := sharedhostpath.NewVolumeHelper(*dataRoot, *dsn)
+	if *rebuildsymlinks || *cleanupdangling || *restorevolume || *fsck {
+		vh, err := sharedhostpath.NewVolumeHelperWithPools(poolRoots, *dsn)
 		if err != nil {
 			fmt.Printf("cannot create volume helper: %v", err)
 			os.Exit(1)
 		}
+		vh.SetTrashRetention(*trashRetention)
 		if *rebuildsymlinks {
 			vh.ReBuildSymLinks()
+		} else if *fsck {
+			handleFsck(vh)
+		} else if *restorevolume {
+			if *restoreVolumeID == "" || *restorePVName == "" {
+				fmt.Printf("restore-volumeid and restore-pvname flags should be set.\n")
+				os.Exit(1)
+			}
+			vol, err := vh.RestoreTrashedVolume(*restoreVolumeID, *restorePVName)
+			if err != nil {
+				fmt.Printf("cannot restore volume: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("volume %s is restored as %s, create pv %s with volumeHandle %s and driver %s\n", *restoreVolumeID, vol.VolID, vol.PVName, vol.VolID, *driverName)
 		} else {
-			vh.CleanUpDanglingVolumes()
+			_, err = vh.CleanUpDanglingVolumes(sharedhostpath.CleanupOptions{
+				DryRun:        *cleanupDryRun,
+				ReportPath:    *cleanupReport,
+				MaxVolumes:    *cleanupMaxVolumes,
+				MaxPercent:    *cleanupMaxPercent,
+				Force:         *cleanupForce,
+				QuarantineDir: *cleanupQuarantine,
+			})
+			if err != nil {
+				fmt.Printf("cannot cleanup dangling volumes: %v\n", err)
+				os.Exit(1)
+			}
 		}
 
 	} else {
-		driver, err := sharedhostpath.NewSharedHostPathDriver(*driverName, *nodeID, *endpoint, *dataRoot, *dsn, *maxVolumesPerNode, version)
+		driver, err := sharedhostpath.NewSharedHostPathDriver(*driverName, *nodeID, *endpoint, poolRoots, *dsn, *maxVolumesPerNode, version)
 		if err != nil {
 			fmt.Printf("Failed to initialize driver: %s\n", err.Error())
 			os.Exit(1)
 		}
 
+		driver.SetTrashRetention(*trashRetention)
+		driver.SetMetricsAddress(*metricsAddress)
+
+		var events kubernetes.Interface
+		if *monitorEvents {
+			events, err = sharedhostpath.NewKubernetesClientset(*kubeconfig)
+			if err != nil {
+				fmt.Printf("cannot create kubernetes client for events: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		driver.SetVolumeMonitor(*monitorInterval, *monitorMinFree, events)
+		driver.SetNodeReaper(*nodeTimeout, *nodeUnpublish)
+
 		if *controller {
 			driver.RunController()
 		} else if *node {
@@ -105,3 +182,25 @@ func handle() {
 	}
 
 }
+
+func handleFsck(vh *sharedhostpath.VolumeHelper) {
+	report, err := vh.Fsck(sharedhostpath.FsckOptions{Repair: *fsckRepair, NodeMaxAge: *fsckNodeAge})
+	if err != nil {
+		fmt.Printf("cannot check volumes: %v\n", err)
+		os.Exit(1)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("cannot encode fsck report: %v\n", err)
+		os.Exit(1)
+	}
+	if *fsckReport == "" {
+		fmt.Println(string(data))
+	} else if err := ioutil.WriteFile(*fsckReport, data, 0640); err != nil {
+		fmt.Printf("cannot write fsck report: %v\n", err)
+		os.Exit(1)
+	}
+	if report.Unrepaired() > 0 {
+		os.Exit(2)
+	}
+}
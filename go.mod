@@ -9,12 +9,17 @@ require (
 	github.com/kubernetes-csi/csi-test/v4 v4.3.0
 	github.com/onsi/ginkgo v1.16.5
 	github.com/onsi/gomega v1.18.1
+	github.com/prometheus/client_golang v1.11.0
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 	golang.org/x/sys v0.0.0-20220319134239-a9b59b0215f8
 	google.golang.org/grpc v1.45.0
+	google.golang.org/protobuf v1.27.1
 	gorm.io/driver/postgres v1.3.1
 	gorm.io/gorm v1.23.3
+	k8s.io/api v0.23.5
 	k8s.io/apimachinery v0.23.5
+	k8s.io/client-go v0.23.5
 	k8s.io/klog/v2 v2.60.1
 	k8s.io/mount-utils v0.23.5
 	k8s.io/utils v0.0.0-20220210201930-3a6ce19ff2f9
@@ -0,0 +1,260 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	danglingReasonDeleted  = "deleted"
+	danglingReasonUnknown  = "unknown"
+	danglingReasonDeleting = "deleting"
+)
+
+var errCleanupThreshold = errors.New("cleanup threshold exceeded")
+
+// CleanupOptions controls CleanUpDanglingVolumes. The thresholds only count the volume folders
+// without any record, which are all volumes when the metadata store is wrong. Zero disables them.
+type CleanupOptions struct {
+	DryRun        bool
+	ReportPath    string
+	MaxVolumes    int
+	MaxPercent    float64
+	Force         bool
+	QuarantineDir string
+}
+
+type DanglingVolume struct {
+	Pool   string `json:"pool"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Size   int64  `json:"size"`
+}
+
+type CleanupReport struct {
+	DryRun       bool             `json:"dryRun"`
+	Refused      bool             `json:"refused"`
+	TotalVolumes int              `json:"totalVolumes"`
+	Unknown      int              `json:"unknownVolumes"`
+	Volumes      []DanglingVolume `json:"volumes"`
+}
+
+// CleanUpDanglingVolumes removes the folders of deleted volumes, the folders without any record and the
+// leftovers of deleted snapshots, then rebuilds the symlinks. The candidates are reported first, nothing
+// is removed with dry run or when a threshold is exceeded without force.
+func (vh *VolumeHelper) CleanUpDanglingVolumes(opts CleanupOptions) (*CleanupReport, error) {
+	klog.Infof("CleanUpDanglingVolumes started")
+
+	report := &CleanupReport{DryRun: opts.DryRun, Volumes: []DanglingVolume{}}
+	for _, name := range vh.sortedPoolNames() {
+		if err := vh.findPoolDanglingVolumes(vh.pools[name], report); err != nil {
+			return nil, err
+		}
+	}
+	for _, dv := range report.Volumes {
+		klog.Infof("CleanUpDanglingVolumes %s volume at %s of pool %s, %d bytes", dv.Reason, dv.Path, dv.Pool, dv.Size)
+	}
+
+	var err error
+	if !opts.Force {
+		err = checkCleanupThresholds(report, opts)
+		report.Refused = err != nil
+	}
+
+	if err == nil && !opts.DryRun {
+		quarantine := time.Now().Format("20060102-150405")
+		for _, dv := range report.Volumes {
+			if rerr := vh.removeDanglingVolume(dv, opts.QuarantineDir, quarantine); rerr != nil {
+				klog.V(5).Error(rerr, "CleanUpDanglingVolumes cannot delete %s", dv.Path)
+			}
+		}
+		klog.V(5).Infof("CleanUpDanglingVolumes all dangling volumes are deleted")
+	}
+
+	if opts.ReportPath != "" {
+		if werr := writeCleanupReport(opts.ReportPath, report); werr != nil {
+			klog.V(5).Error(werr, "CleanUpDanglingVolumes cannot write report to %s", opts.ReportPath)
+			if err == nil {
+				err = werr
+			}
+		}
+	}
+
+	if err != nil || opts.DryRun {
+		return report, err
+	}
+	return report, vh.ReBuildSymLinks()
+}
+
+func (vh *VolumeHelper) sortedPoolNames() []string {
+	names := make([]string, 0, len(vh.pools))
+	for name := range vh.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (vh *VolumeHelper) findPoolDanglingVolumes(sp *storagePool, report *CleanupReport) error {
+	add := func(path, reason string) {
+		size, err := getAllocatedSize(path)
+		if err != nil {
+			size = -1
+		}
+		report.Volumes = append(report.Volumes, DanglingVolume{Pool: sp.name, Path: path, Reason: reason, Size: size})
+	}
+
+	vols, err := vh.store.GetDeletedPoolVolumes(sp.name)
+	if err != nil {
+		klog.V(5).Error(err, "CleanUpDanglingVolumes cannot get deleted volumes of pool %s from db", sp.name)
+		return err
+	}
+	deleted := make(map[string]bool)
+	for _, vol := range vols {
+		if _, err := os.Stat(vol.VolPath); err == nil {
+			deleted[vol.VolPath] = true
+			add(vol.VolPath, danglingReasonDeleted)
+		}
+	}
+
+	fs, err := filepath.Glob(fmt.Sprintf("%s/*/*/*/*", sp.vols_path))
+	if err != nil {
+		klog.V(5).Error(err, "CleanUpDanglingVolumes cannot read volumes (volid) of pool %s from disk", sp.name)
+		return err
+	}
+	for _, f := range fs {
+		if strings.HasSuffix(f, deletingSuffix) {
+			// the trash reaper moves them to the trash
+			if vh.trashRetention == 0 {
+				add(f, danglingReasonDeleting)
+			}
+			continue
+		}
+		report.TotalVolumes++
+		if deleted[f] {
+			continue
+		}
+		found, err := vh.store.HasVolumeAtPath(f)
+		if err != nil {
+			klog.V(5).Error(err, "CleanUpDanglingVolumes cannot check volume %s at db", f)
+			return err
+		}
+		if !found {
+			report.Unknown++
+			add(f, danglingReasonUnknown)
+		}
+	}
+
+	fs, err = filepath.Glob(fmt.Sprintf("%s/*/*/*/*%s", sp.snaps_path, deletingSuffix))
+	if err != nil {
+		klog.V(5).Error(err, "CleanUpDanglingVolumes cannot read deleted snapshots of pool %s from disk", sp.name)
+		return err
+	}
+	for _, f := range fs {
+		add(f, danglingReasonDeleting)
+	}
+	return nil
+}
+
+func checkCleanupThresholds(report *CleanupReport, opts CleanupOptions) error {
+	if opts.MaxVolumes > 0 && report.Unknown > opts.MaxVolumes {
+		return fmt.Errorf("%w: %d volumes without records, limit is %d", errCleanupThreshold, report.Unknown, opts.MaxVolumes)
+	}
+	if opts.MaxPercent > 0 && report.TotalVolumes > 0 {
+		percent := float64(report.Unknown) * 100 / float64(report.TotalVolumes)
+		if percent > opts.MaxPercent {
+			return fmt.Errorf("%w: %.1f%% of volumes have no records, limit is %.1f%%", errCleanupThreshold, percent, opts.MaxPercent)
+		}
+	}
+	return nil
+}
+
+// removeDanglingVolume removes or quarantines a candidate. Every candidate, including the ones which
+// are moved aside while deleted, is checked again under the lock of its id, so a volume or snapshot
+// whose record is committed or restored meanwhile is kept.
+func (vh *VolumeHelper) removeDanglingVolume(dv DanglingVolume, quarantineDir, quarantine string) error {
+	remove := func() error {
+		if quarantineDir == "" {
+			return os.RemoveAll(dv.Path)
+		}
+		sp := vh.pools[dv.Pool]
+		rel, err := filepath.Rel(sp.root, dv.Path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(sp.root, quarantineDir, quarantine, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return err
+		}
+		klog.V(5).Infof("CleanUpDanglingVolumes %s is moved to %s", dv.Path, target)
+		return os.Rename(dv.Path, target)
+	}
+
+	path := strings.TrimSuffix(dv.Path, deletingSuffix)
+	id := filepath.Base(path)
+	return vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(id); err != nil {
+			return err
+		}
+		dangling, err := vh.isDangling(store, dv.Pool, dv.Path, path)
+		if err != nil {
+			return err
+		}
+		if !dangling {
+			klog.V(5).Infof("CleanUpDanglingVolumes %s is not dangling anymore", dv.Path)
+			return nil
+		}
+		return remove()
+	})
+}
+
+// isDangling checks a candidate at path, whose volume or snapshot would be at recordPath.
+func (vh *VolumeHelper) isDangling(store MetadataStore, pool, path, recordPath string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if sp, found := vh.pools[pool]; found && strings.HasPrefix(recordPath, sp.snaps_path+"/") {
+		_, err := store.GetSnapshot(filepath.Base(recordPath))
+		if errors.Is(err, ErrRecordNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	found, err := store.HasVolumeAtPath(recordPath)
+	return !found, err
+}
+
+func writeCleanupReport(path string, report *CleanupReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0640)
+}
@@ -17,23 +17,27 @@ limitations under the License.
 package sharedhostpath
 
 import (
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	klog "k8s.io/klog/v2"
 	"math"
+	"sort"
 	"strconv"
-	"sync"
+	"strings"
 )
 
 type controllerServer struct {
 	caps   []*csi.ControllerServiceCapability
 	nodeID string
 	vh     *VolumeHelper
-	mutex  sync.Mutex
+	locks  volumeLocks
 }
 
 const (
@@ -59,6 +63,10 @@ func NewControllerServer(nodeID string, vh *VolumeHelper) *controllerServer {
 				csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
 				csi.ControllerServiceCapability_RPC_GET_VOLUME,
 				csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 			}),
 		nodeID: nodeID,
 		vh:     vh,
@@ -108,8 +116,8 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		if cap.GetMount() == nil && cap.GetBlock() == nil {
 			return nil, status.Error(codes.InvalidArgument, "cannot have both mount and block access type be undefined")
 		}
-		if vol.IsBlock && cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			return nil, status.Error(codes.InvalidArgument, "block backend can be accessd only SINGLE_NODE_WRITER")
+		if vol.IsBlock && !isDiskAccessModeSupported(cap.GetAccessMode().GetMode()) {
+			return nil, status.Error(codes.InvalidArgument, "block backend can be accessd only SINGLE_NODE_WRITER or MULTI_NODE_READER_ONLY")
 		}
 	}
 
@@ -123,12 +131,14 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
 	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
+	if !cs.locks.TryAcquire(req.GetName()) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetName())
+	}
+	defer cs.locks.Release(req.GetName())
+
 	caps := req.GetVolumeCapabilities()
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
@@ -164,16 +174,82 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "cannot have both folder type and block access type")
 	}
 
+	pool := parameters[poolParameter]
+	if pool != "" && !cs.vh.HasPool(pool) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("storage pool not found: %s", pool))
+	}
+	pool, err := cs.selectPool(pool, req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := volumeOwnershipOf(parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var snap *Snapshot
+	var parent *Volume
+	var sourceSnapID, parentVolID string
+	if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+		if snapSource := contentSource.GetSnapshot(); snapSource != nil {
+			sourceSnapID = snapSource.GetSnapshotId()
+			if !cs.locks.TryAcquire(sourceSnapID) {
+				return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, sourceSnapID)
+			}
+			defer cs.locks.Release(sourceSnapID)
+			var err error
+			snap, err = cs.vh.GetSnapshot(sourceSnapID)
+			if err != nil {
+				return nil, status.Error(codes.NotFound, fmt.Sprintf("snapshot %s not found: %v", sourceSnapID, err))
+			}
+			if !snap.ReadyToUse {
+				return nil, status.Error(codes.Unavailable, fmt.Sprintf("snapshot %s is not ready", sourceSnapID))
+			}
+			if snap.IsBlock != isBlock {
+				return nil, status.Error(codes.InvalidArgument, "cannot restore a snapshot into a volume with different type")
+			}
+		} else if volSource := contentSource.GetVolume(); volSource != nil {
+			parentVolID = volSource.GetVolumeId()
+			if !cs.locks.TryAcquire(parentVolID) {
+				return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, parentVolID)
+			}
+			defer cs.locks.Release(parentVolID)
+			var err error
+			parent, err = cs.vh.GetVolume(parentVolID)
+			if err != nil {
+				return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %v", parentVolID, err))
+			}
+			if parent.IsBlock != isBlock {
+				return nil, status.Error(codes.InvalidArgument, "cannot clone a volume into a volume with different type")
+			}
+		} else {
+			return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+		}
+	}
+
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
+	if capacity == 0 && snap != nil {
+		capacity = snap.Size
+	}
+	if capacity == 0 && parent != nil {
+		capacity = parent.Capacity
+	}
 	capacity = fixCapacity(capacity)
 	if capacity >= maxStorageCapacity {
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, maxStorageCapacity)
 	}
+	if snap != nil && capacity < snap.Size {
+		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d is smaller than snapshot size %d", capacity, snap.Size)
+	}
+	if parent != nil && capacity < parent.Capacity {
+		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d is smaller than parent volume capacity %d", capacity, parent.Capacity)
+	}
 
 	if isBlock {
 		for _, cap := range caps {
-			if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-				return nil, status.Error(codes.InvalidArgument, "block backend can be accessd only SINGLE_NODE_WRITER")
+			if !isDiskAccessModeSupported(cap.GetAccessMode().GetMode()) {
+				return nil, status.Error(codes.InvalidArgument, "block backend can be accessd only SINGLE_NODE_WRITER or MULTI_NODE_READER_ONLY")
 			}
 		}
 	}
@@ -181,7 +257,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	volName := req.GetName()
 
 	topologies := []*csi.Topology{&csi.Topology{
-		Segments: map[string]string{},
+		Segments: map[string]string{poolTopologyKey(pool): "true"},
 	}}
 
 	if volid, err := cs.vh.GetVolumeIdByName(volName); err == nil {
@@ -191,7 +267,8 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 		preq, err := vol.PopulateVolumeIfRequired()
 		if err == nil {
-			if preq || (vol.Capacity == capacity && vol.IsBlock == isBlock) {
+			if preq || (vol.Capacity == capacity && vol.IsBlock == isBlock && vol.SourceSnapID == sourceSnapID && vol.ParentVolID == parentVolID && vol.Pool == pool &&
+				vol.OwnerUID == owner.UID && vol.OwnerGID == owner.GID && vol.Mode == owner.Mode) {
 				return &csi.CreateVolumeResponse{
 					Volume: &csi.Volume{
 						VolumeId:           vol.VolID,
@@ -233,7 +310,23 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	volumeID := r_uuid.String()
 
-	vol, err := cs.vh.CreateVolume(volumeID, volName, pvName, pvcName, nsName, capacity, isBlock)
+	var vol *Volume
+	if snap != nil {
+		vol, err = cs.vh.CreateVolumeFromSnapshot(volumeID, volName, pvName, pvcName, nsName, pool, capacity, isBlock, owner, snap)
+	} else if parent != nil {
+		vol, err = cs.vh.CreateVolumeFromVolume(volumeID, volName, pvName, pvcName, nsName, pool, capacity, isBlock, owner, parent)
+	} else {
+		vol, err = cs.vh.CreateVolume(volumeID, volName, pvName, pvcName, nsName, pool, capacity, isBlock, owner)
+	}
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, status.Errorf(codes.NotFound, "content source of volume %v not found: %v", volumeID, err)
+	}
+	if errors.Is(err, ErrVolumeLeaseHeld) {
+		return nil, status.Errorf(codes.FailedPrecondition, "parent volume %s is in use: %v", parentVolID, err)
+	}
+	if errors.Is(err, errSnapshotNotReady) {
+		return nil, status.Errorf(codes.Unavailable, "snapshot %s is not ready", sourceSnapID)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create volume %v: %v", volumeID, err)
 	}
@@ -251,15 +344,17 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
 	volId := req.GetVolumeId()
 
+	if !cs.locks.TryAcquire(volId) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volId)
+	}
+	defer cs.locks.Release(volId)
+
 	vol, err := cs.vh.GetVolume(volId)
 	if err != nil {
 		status.Errorf(codes.Internal, "failed to get volume %v: %v", volId, err)
@@ -279,9 +374,6 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 }
 
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
@@ -296,11 +388,22 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 
 	volumeID := req.GetVolumeId()
 
-	_, err := cs.vh.GetVolume(volumeID)
+	if !cs.locks.TryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.locks.Release(volumeID)
+
+	vol, err := cs.vh.GetVolume(volumeID)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %v", volumeID, err))
 	}
 
+	// readers of disk volumes get read only loop devices, so they are attached read only
+	readOnly := req.Readonly
+	if vol.IsBlock && !isWriterAccessMode(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		readOnly = true
+	}
+
 	nodeID := req.GetNodeId()
 	ni, err := cs.vh.GetNodeInfo(nodeID, 30*1000)
 	if err != nil {
@@ -314,7 +417,7 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	cpvi, err := cs.vh.GetControllerPublishVolumeInfo(volumeID, nodeID)
 	if err == nil {
 		if cpvi != nil {
-			if cpvi.ReadOnly != req.Readonly {
+			if cpvi.ReadOnly != readOnly {
 				return nil, status.Error(codes.AlreadyExists, "cannot publish readonly status dismatch")
 			} else {
 				return &csi.ControllerPublishVolumeResponse{
@@ -328,7 +431,15 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 		}
 	}
 
-	err = cs.vh.CreateControllerPublishVolumeInfo(volumeID, nodeID, req.Readonly)
+	if vol.IsBlock {
+		// readers and writers of disk volumes are checked under the volume lock
+		err = cs.vh.PublishDiskVolume(volumeID, nodeID, readOnly)
+		if errors.Is(err, ErrVolumeAccessConflict) || errors.Is(err, ErrVolumeLeaseHeld) {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot publish vol %s to node %s: %v", volumeID, nodeID, err))
+		}
+	} else {
+		err = cs.vh.CreateControllerPublishVolumeInfo(volumeID, nodeID, readOnly)
+	}
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("cannot create cpvi vol %s node %s: %v", volumeID, nodeID, err))
 	}
@@ -339,15 +450,17 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 }
 
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
 
 	volumeID := req.GetVolumeId()
 
+	if !cs.locks.TryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.locks.Release(volumeID)
+
 	_, err := cs.vh.GetVolume(volumeID)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %v", volumeID, err))
@@ -372,14 +485,16 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume volume ID missing in request")
 	}
 
+	if !cs.locks.TryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.locks.Release(volumeID)
+
 	capRange := req.GetCapacityRange()
 	if capRange == nil {
 		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume capacity range missing in request")
@@ -441,6 +556,7 @@ func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolume
 				VolumeId:      vol["volumeId"].(string),
 				CapacityBytes: vol["capacity"].(int64),
 				VolumeContext: vol["parameters"].(map[string]string),
+				ContentSource: volumeContentSource(vol),
 			},
 			Status: &csi.ListVolumesResponse_VolumeStatus{
 				PublishedNodeIds: vol["published_node_ids"].([]string),
@@ -500,6 +616,7 @@ func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.Co
 			VolumeId:      vol["volumeId"].(string),
 			CapacityBytes: vol["capacity"].(int64),
 			VolumeContext: vol["parameters"].(map[string]string),
+			ContentSource: volumeContentSource(vol),
 		},
 		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
 			PublishedNodeIds: vol["published_node_ids"].([]string),
@@ -511,26 +628,313 @@ func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.Co
 	}, nil
 }
 
-/* Unimplemented methods beyond */
-
 func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot name missing in request")
+	}
+
+	sourceVolumeID := req.GetSourceVolumeId()
+	if len(sourceVolumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot source volume ID missing in request")
+	}
+
+	snapName := req.GetName()
+
+	if !cs.locks.TryAcquire(snapName, sourceVolumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, snapName)
+	}
+	defer cs.locks.Release(snapName, sourceVolumeID)
+
+	if snapid, err := cs.vh.GetSnapshotIdByName(snapName); err == nil {
+		snap, err := cs.vh.GetSnapshot(snapid)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("cannot get snapshot status: %v", err.Error()))
+		}
+		if snap.SourceVolID != sourceVolumeID {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("snapshot %s already exists for another volume", snapName))
+		}
+		return &csi.CreateSnapshotResponse{
+			Snapshot: snapshotToCSISnapshot(snap),
+		}, nil
+	}
+
+	vol, err := cs.vh.GetVolume(sourceVolumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found: %v", sourceVolumeID, err))
+	}
+
+	r_uuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "cannot generate snapshot id")
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	snapshotID := r_uuid.String()
+
+	snap, err := cs.vh.CreateSnapshot(snapshotID, snapName, vol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create snapshot %v: %v", snapshotID, err)
+	}
+	klog.V(5).Infof("created snapshot %s from volume %s at path %s with %s copy", snap.SnapID, vol.VolID, snap.SnapPath, snap.CopyMethod)
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: snapshotToCSISnapshot(snap),
+	}, nil
 }
 
 func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot snapshot ID missing in request")
+	}
+
+	snapId := req.GetSnapshotId()
+
+	if !cs.locks.TryAcquire(snapId) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, snapId)
+	}
+	defer cs.locks.Release(snapId)
+
+	_, err := cs.vh.GetSnapshot(snapId)
+	if errors.Is(err, ErrRecordNotFound) {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get snapshot %v: %v", snapId, err)
+	}
+
+	if err := cs.vh.DeleteSnapshot(snapId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete snapshot %v: %v", snapId, err)
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(5).Infof("snapshot %v successfully deleted", snapId)
+
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	var startingToken int = 0
+	if req.StartingToken != "" {
+		parsedToken, err := strconv.ParseInt(req.StartingToken, 10, 32)
+		if err != nil {
+			return nil, status.Errorf(codes.Aborted, "ListSnapshots starting token %q is not valid: %s", req.StartingToken, err)
+		}
+		startingToken = int(parsedToken)
+	}
+
+	maxEntries := int(req.MaxEntries)
+	if maxEntries == 0 {
+		maxEntries = math.MaxInt32
+	}
+
+	snapshotID := req.GetSnapshotId()
+	sourceVolumeID := req.GetSourceVolumeId()
+
+	sc, err := cs.vh.GetSnapshotCount(snapshotID, sourceVolumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ListSnapshots cannot get snapshot count from db: %v", err.Error()))
+	}
+
+	if startingToken > sc {
+		return nil, status.Errorf(codes.Aborted, "ListSnapshots starting token %d is greater than total number of snapshots %d", startingToken, sc)
+	}
+
+	snaps, err := cs.vh.GetSnapshots(snapshotID, sourceVolumeID, startingToken, maxEntries)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ListSnapshots cannot get snapshot list from db: %v", err.Error()))
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+
+	for i := range snaps {
+		klog.V(5).Infof("ListSnapshots snapshot %s of volume %s copy method: %s allocated size: %d", snaps[i].SnapID, snaps[i].SourceVolID, snaps[i].CopyMethod, snaps[i].AllocatedSize)
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshotToCSISnapshot(&snaps[i]),
+		})
+	}
+
+	nextStartingToken := -1
+	if maxEntries != math.MaxInt32 {
+		nextStartingToken = startingToken + maxEntries
+		if nextStartingToken >= sc {
+			nextStartingToken = -1
+		}
+	}
+
+	if nextStartingToken != -1 {
+		return &csi.ListSnapshotsResponse{
+			Entries:   entries,
+			NextToken: strconv.FormatInt(int64(nextStartingToken), 10),
+		}, nil
+	}
+	return &csi.ListSnapshotsResponse{
+		Entries: entries,
+	}, nil
+}
+
+func volumeContentSource(vol map[string]interface{}) *csi.VolumeContentSource {
+	if snapid := vol["source_snapshot_id"].(string); snapid != "" {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: snapid,
+				},
+			},
+		}
+	}
+	if volid := vol["parent_volume_id"].(string); volid != "" {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: volid,
+				},
+			},
+		}
+	}
+	return nil
+}
+
+func volumeOwnershipOf(parameters map[string]string) (VolumeOwnership, error) {
+	owner := defaultVolumeOwnership
+	if uid, found := parameters[uidParameter]; found {
+		id, err := strconv.ParseUint(uid, 10, 31)
+		if err != nil {
+			return owner, fmt.Errorf("invalid storage class parameter %s: %s", uidParameter, uid)
+		}
+		owner.UID = int(id)
+	}
+	if gid, found := parameters[gidParameter]; found {
+		id, err := strconv.ParseUint(gid, 10, 31)
+		if err != nil {
+			return owner, fmt.Errorf("invalid storage class parameter %s: %s", gidParameter, gid)
+		}
+		owner.GID = int(id)
+	}
+	if mode, found := parameters[modeParameter]; found {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m == 0 || m > 0777 {
+			return owner, fmt.Errorf("invalid storage class parameter %s: %s", modeParameter, mode)
+		}
+		owner.Mode = uint32(m)
+	}
+	return owner, nil
+}
+
+func poolTopologyKey(pool string) string {
+	return topologyKeyPrefix + pool
+}
+
+func poolsOfTopologies(topologies []*csi.Topology) []string {
+	var pools []string
+	for _, topology := range topologies {
+		var keys []string
+		for key, value := range topology.GetSegments() {
+			if strings.HasPrefix(key, topologyKeyPrefix) && value == "true" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			pools = append(pools, strings.TrimPrefix(key, topologyKeyPrefix))
+		}
+	}
+	return pools
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isDiskAccessModeSupported reports whether disk volumes can be accessed with the mode, a disk
+// image has either a single writer or many readers.
+func isDiskAccessModeSupported(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+func (cs *controllerServer) selectPool(pool string, requirement *csi.TopologyRequirement) (string, error) {
+	requisite := poolsOfTopologies(requirement.GetRequisite())
+	if pool != "" {
+		if len(requirement.GetRequisite()) == 0 {
+			return pool, nil
+		}
+		if containsString(requisite, pool) {
+			return pool, nil
+		}
+		return "", status.Error(codes.ResourceExhausted, fmt.Sprintf("storage pool %s is not accessible from requisite topologies", pool))
+	}
+
+	// preferred topologies are tried in order before the requisite ones
+	candidates := append(poolsOfTopologies(requirement.GetPreferred()), requisite...)
+	for _, p := range candidates {
+		if cs.vh.HasPool(p) {
+			return p, nil
+		}
+	}
+	if len(requirement.GetRequisite()) != 0 {
+		return "", status.Error(codes.ResourceExhausted, "no storage pool is accessible from requisite topologies")
+	}
+	return defaultPool, nil
+}
+
+func snapshotToCSISnapshot(snap *Snapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snap.SnapID,
+		SourceVolumeId: snap.SourceVolID,
+		SizeBytes:      snap.Size,
+		CreationTime:   timestamppb.New(snap.CreatedAt),
+		ReadyToUse:     snap.ReadyToUse,
+	}
 }
 
 func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	overcommitRatio := 1.0
+	if ratio, found := req.GetParameters()[overcommitRatioParameter]; found {
+		var err error
+		overcommitRatio, err = strconv.ParseFloat(ratio, 64)
+		if err != nil || overcommitRatio <= 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetCapacity invalid storage class parameter %s: %s", overcommitRatioParameter, ratio))
+		}
+	}
+
+	pool := req.GetParameters()[poolParameter]
+	if topology := req.GetAccessibleTopology(); topology != nil {
+		pools := poolsOfTopologies([]*csi.Topology{topology})
+		if pool == "" && len(pools) != 0 {
+			pool = pools[0]
+		}
+		if !containsString(pools, pool) {
+			// the storage pool is not accessible from the topology segment
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+	if pool == "" {
+		pool = defaultPool
+	}
+	if !cs.vh.HasPool(pool) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetCapacity storage pool not found: %s", pool))
+	}
+
+	stats, err := cs.vh.GetStatistics(pool)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("GetCapacity cannot get statistics of storage pool %s: %v", pool, err.Error()))
+	}
+
+	availableCapacity := int64(float64(stats.availableBytes) * overcommitRatio)
+
+	// CreateVolume accepts capacities only below maxStorageCapacity
+	maximumVolumeSize := int64(maxStorageCapacity - MiB)
+	if availableCapacity < maximumVolumeSize {
+		maximumVolumeSize = availableCapacity
+	}
+
+	klog.V(5).Infof("GetCapacity available capacity %d maximum volume size %d of pool %s with overcommit ratio %v", availableCapacity, maximumVolumeSize, pool, overcommitRatio)
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: availableCapacity,
+		MaximumVolumeSize: wrapperspb.Int64(maximumVolumeSize),
+	}, nil
 }
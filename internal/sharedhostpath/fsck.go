@@ -0,0 +1,276 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"errors"
+	"fmt"
+	klog "k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	fsckMissingPath            = "missingPath"
+	fsckTypeMismatch           = "typeMismatch"
+	fsckSizeMismatch           = "sizeMismatch"
+	fsckMissingSymlink         = "missingSymlink"
+	fsckUnknownPool            = "unknownPool"
+	fsckStrayFile              = "strayFile"
+	fsckDeletedVolumeData      = "deletedVolumeData"
+	fsckStaleControllerPublish = "staleControllerPublish"
+	fsckStaleNodePublish       = "staleNodePublish"
+)
+
+// FsckOptions controls Fsck. Only safe cases are repaired: missing symlinks are created and disk
+// images smaller than their capacity are extended.
+type FsckOptions struct {
+	Repair     bool
+	NodeMaxAge time.Duration
+}
+
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	VolID    string `json:"volumeId,omitempty"`
+	NodeID   string `json:"nodeId,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	CheckedVolumes int         `json:"checkedVolumes"`
+	Issues         []FsckIssue `json:"issues"`
+}
+
+// Unrepaired returns the count of issues which are not repaired.
+func (fr *FsckReport) Unrepaired() int {
+	count := 0
+	for _, issue := range fr.Issues {
+		if !issue.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// Fsck cross checks the volume records with the shared storage and the publish records with the
+// last seen times of the nodes. Nothing is changed unless repair is requested.
+func (vh *VolumeHelper) Fsck(opts FsckOptions) (*FsckReport, error) {
+	klog.Infof("Fsck started")
+
+	vc, err := vh.store.GetVolumeCount()
+	if err != nil {
+		klog.V(5).Error(err, "Fsck cannot get volume count")
+		return nil, err
+	}
+	vols, err := vh.store.GetVolumes(0, vc)
+	if err != nil {
+		klog.V(5).Error(err, "Fsck cannot get volumes")
+		return nil, err
+	}
+
+	report := &FsckReport{Issues: []FsckIssue{}}
+	known := make(map[string]bool)
+	for i := range vols {
+		vol := &vols[i]
+		known[vol.VolPath] = true
+		report.CheckedVolumes++
+		vh.fsckVolume(vol, opts, report)
+		if err := vh.fsckPublishInfos(vol, opts, report); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range vh.sortedPoolNames() {
+		sp := vh.pools[name]
+		deleted, err := vh.store.GetDeletedPoolVolumes(sp.name)
+		if err != nil {
+			klog.V(5).Error(err, "Fsck cannot get deleted volumes of pool %s", sp.name)
+			return nil, err
+		}
+		deletedPaths := make(map[string]bool)
+		for _, vol := range deleted {
+			deletedPaths[vol.VolPath] = true
+		}
+		if err := fsckStrayFiles(sp, known, deletedPaths, report); err != nil {
+			return nil, err
+		}
+	}
+
+	klog.Infof("Fsck checked %d volumes, found %d issues, %d are not repaired", report.CheckedVolumes, len(report.Issues), report.Unrepaired())
+	return report, nil
+}
+
+func (vh *VolumeHelper) fsckVolume(vol *Volume, opts FsckOptions, report *FsckReport) {
+	add := func(kind, path, msg string, repair func() error) {
+		issue := FsckIssue{Kind: kind, VolID: vol.VolID, Path: path, Message: msg}
+		if opts.Repair && repair != nil {
+			if err := repair(); err != nil {
+				klog.V(5).Error(err, "Fsck cannot repair %s of volume %s", kind, vol.VolID)
+				issue.Message = fmt.Sprintf("%s, repair failed: %v", msg, err)
+			} else {
+				issue.Repaired = true
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	sp, err := vh.getPool(vol.Pool)
+	if err != nil {
+		add(fsckUnknownPool, vol.VolPath, fmt.Sprintf("pool %s is not configured", vol.Pool), nil)
+		return
+	}
+
+	fi, err := os.Stat(vol.VolPath)
+	if err != nil {
+		add(fsckMissingPath, vol.VolPath, err.Error(), nil)
+		return
+	}
+	if vol.IsBlock == fi.IsDir() {
+		expected := "directory"
+		if vol.IsBlock {
+			expected = "disk image"
+		}
+		add(fsckTypeMismatch, vol.VolPath, fmt.Sprintf("volume should be a %s", expected), nil)
+		return
+	}
+	if vol.IsBlock && fi.Size() != vol.Capacity {
+		var repair func() error
+		if fi.Size() < vol.Capacity {
+			repair = vh.fsckRepair(vol.VolID, func(locked *Volume) error {
+				fi, err := os.Stat(locked.VolPath)
+				if err != nil || !locked.IsBlock || fi.Size() >= locked.Capacity {
+					return err
+				}
+				return os.Truncate(locked.VolPath, locked.Capacity)
+			})
+		}
+		add(fsckSizeMismatch, vol.VolPath, fmt.Sprintf("disk image size %d, capacity %d", fi.Size(), vol.Capacity), repair)
+	}
+
+	symlink_dir := filepath.Join(sp.syms_path, vol.NSName)
+	symlink_file := filepath.Join(symlink_dir, vol.PVCName)
+	if _, err := os.Stat(symlink_file); err != nil {
+		add(fsckMissingSymlink, symlink_file, err.Error(), vh.fsckRepair(vol.VolID, func(locked *Volume) error {
+			if _, err := os.Stat(symlink_file); err == nil {
+				return nil
+			}
+			return createSymlink(locked.VolPath, symlink_dir, symlink_file)
+		}))
+	}
+}
+
+// fsckRepair runs the repair with the volume read again under its lock, the repair checks the issue
+// again with that record. A volume deleted meanwhile needs no repair.
+func (vh *VolumeHelper) fsckRepair(volid string, repair func(locked *Volume) error) func() error {
+	return func() error {
+		return vh.store.Transaction(func(store MetadataStore) error {
+			if err := store.LockVolume(volid); err != nil {
+				return err
+			}
+			locked, err := store.GetVolume(volid)
+			if errors.Is(err, ErrRecordNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return repair(locked)
+		})
+	}
+}
+
+func (vh *VolumeHelper) fsckPublishInfos(vol *Volume, opts FsckOptions, report *FsckReport) error {
+	seen := make(map[string]bool)
+	isSeen := func(nodeId string) (bool, error) {
+		if s, found := seen[nodeId]; found {
+			return s, nil
+		}
+		ni, err := vh.GetNodeInfo(nodeId, opts.NodeMaxAge.Milliseconds())
+		if err != nil {
+			return false, err
+		}
+		seen[nodeId] = ni != nil
+		return ni != nil, nil
+	}
+	msg := fmt.Sprintf("node is not seen for %v", opts.NodeMaxAge)
+
+	cpvis, err := vh.store.GetControllerPublishVolumeInfos(vol.VolID)
+	if err != nil {
+		klog.V(5).Error(err, "Fsck cannot get controller publish infos of volume %s", vol.VolID)
+		return err
+	}
+	for _, cpvi := range cpvis {
+		s, err := isSeen(cpvi.NodeID)
+		if err != nil {
+			return err
+		}
+		if !s {
+			report.Issues = append(report.Issues, FsckIssue{Kind: fsckStaleControllerPublish, VolID: vol.VolID, NodeID: cpvi.NodeID, Message: msg})
+		}
+	}
+
+	npvis, err := vh.store.GetNodePublishVolumeInfos(vol.VolID, "")
+	if err != nil {
+		klog.V(5).Error(err, "Fsck cannot get node publish infos of volume %s", vol.VolID)
+		return err
+	}
+	for _, npvi := range npvis {
+		s, err := isSeen(npvi.NodeID)
+		if err != nil {
+			return err
+		}
+		if !s {
+			report.Issues = append(report.Issues, FsckIssue{Kind: fsckStaleNodePublish, VolID: vol.VolID, NodeID: npvi.NodeID, Path: npvi.MountPath, Message: msg})
+		}
+	}
+	return nil
+}
+
+// fsckStrayFiles reports the files at the prefix levels of the vols tree and the volume folders
+// without any record.
+func fsckStrayFiles(sp *storagePool, known, deleted map[string]bool, report *FsckReport) error {
+	for _, pattern := range []string{"*", "*/*", "*/*/*"} {
+		fs, err := filepath.Glob(filepath.Join(sp.vols_path, pattern))
+		if err != nil {
+			return err
+		}
+		for _, f := range fs {
+			if fi, err := os.Lstat(f); err == nil && !fi.IsDir() {
+				report.Issues = append(report.Issues, FsckIssue{Kind: fsckStrayFile, Path: f, Message: "file outside of volumes"})
+			}
+		}
+	}
+
+	fs, err := filepath.Glob(filepath.Join(sp.vols_path, "*/*/*/*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if known[f] {
+			continue
+		}
+		if deleted[f] {
+			report.Issues = append(report.Issues, FsckIssue{Kind: fsckDeletedVolumeData, Path: f, Message: "data of deleted volume, removed by cleanup job"})
+		} else {
+			report.Issues = append(report.Issues, FsckIssue{Kind: fsckStrayFile, Path: f, Message: "no volume record, removed by cleanup job"})
+		}
+	}
+	return nil
+}
@@ -71,6 +71,13 @@ func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.G
 						},
 					},
 				},
+				{
+					Type: &csi.PluginCapability_Service_{
+						Service: &csi.PluginCapability_Service{
+							Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+						},
+					},
+				},
 				{
 					Type: &csi.PluginCapability_VolumeExpansion_{
 						VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"github.com/google/uuid"
+	klog "k8s.io/klog/v2"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// controllerLeaderLockKey names the leadership record of the controllers at the metadata store.
+	controllerLeaderLockKey = "controller-leader"
+	leaderCheckInterval     = 10 * time.Second
+	// leaderRetryInterval is the interval of the controllers which wait for the leadership.
+	leaderRetryInterval = 2 * time.Second
+	// leaderLeaseDuration is the time after the last renewal when the leadership can be taken over.
+	leaderLeaseDuration = 3 * leaderCheckInterval
+)
+
+func (vh *VolumeHelper) setLeader(leader bool) {
+	var value int32
+	if leader {
+		value = 1
+	}
+	atomic.StoreInt32(&vh.leader, value)
+}
+
+// IsLeader reports whether this controller runs the volume monitor, the node reaper and the trash
+// reaper.
+func (vh *VolumeHelper) IsLeader() bool {
+	return atomic.LoadInt32(&vh.leader) != 0
+}
+
+// lead takes the leadership and renews it until stop is closed, the leadership is given up when it
+// cannot be renewed. No transaction of the metadata store is kept open while the controller leads.
+func (vh *VolumeHelper) lead(stop <-chan struct{}) error {
+	holder := uuid.New().String()
+	defer vh.setLeader(false)
+	for {
+		leading, err := vh.store.TryLead(holder, leaderLeaseDuration)
+		if err != nil {
+			klog.V(5).Error(err, "lead cannot renew leadership")
+			leading = false
+		}
+		if leading && !vh.IsLeader() {
+			klog.Infof("lead controller is the leader")
+		}
+		if !leading && vh.IsLeader() {
+			klog.Infof("lead controller is not the leader anymore")
+		}
+		vh.setLeader(leading)
+
+		interval := leaderRetryInterval
+		if leading {
+			interval = leaderCheckInterval
+		}
+		select {
+		case <-stop:
+			vh.setLeader(false)
+			return vh.store.ResignLead(holder)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RunLeaderElection keeps one of the controllers sharing the metadata as the leader, it never returns.
+func (vh *VolumeHelper) RunLeaderElection() {
+	vh.lead(nil)
+}
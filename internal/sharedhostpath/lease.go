@@ -0,0 +1,374 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	klog "k8s.io/klog/v2"
+	"sync"
+	"time"
+)
+
+// volumeLeaseDuration is the lifetime of a disk volume lease, the owning node renews its leases
+// three times in a lease duration.
+const volumeLeaseDuration = 30 * time.Second
+
+// volumeLeaseFenceMargin is the time before the expiry of a lease which is not renewed when the node
+// stops writing to the volume, so its writes end before another node can take the lease over.
+const volumeLeaseFenceMargin = volumeLeaseDuration / 3
+
+// volumeLeaseTakeoverWait is how long another node sees a lease unchanged before it takes the lease
+// over. Both the owning node and the taking node measure the time with their own clocks from the
+// last renewal, so the owner has stopped writing by then even when the clocks of the nodes differ.
+const volumeLeaseTakeoverWait = volumeLeaseDuration + volumeLeaseFenceMargin
+
+// ErrVolumeLeaseHeld is returned when a live node other than the requester holds the volume lease.
+var ErrVolumeLeaseHeld = errors.New("volume lease is held by another node")
+
+// ErrVolumeAccessConflict is returned when a disk volume would be published to readers and a writer.
+var ErrVolumeAccessConflict = errors.New("volume is published with a conflicting access")
+
+// heldLease is a lease held by this node, it expires at the last successful renewal as the node
+// knows, so the node fences the volume even when the store cannot be reached.
+type heldLease struct {
+	nodeID    string
+	volPath   string
+	expiresAt time.Time
+	// fenced leases stay so until they are released at unstage.
+	fenced bool
+}
+
+// FencedLease is a volume which this node stopped writing to, since its lease is not renewed in time.
+type FencedLease struct {
+	VolID   string
+	VolPath string
+}
+
+// heldLeases tracks the leases held by this node.
+type heldLeases struct {
+	sync.Mutex
+	leases map[string]*heldLease
+}
+
+func (hl *heldLeases) acquired(volid, nodeId, volPath string, expiresAt time.Time) {
+	hl.Lock()
+	defer hl.Unlock()
+	if hl.leases == nil {
+		hl.leases = map[string]*heldLease{}
+	}
+	if lease, found := hl.leases[volid]; found {
+		lease.nodeID, lease.expiresAt = nodeId, expiresAt
+		return
+	}
+	hl.leases[volid] = &heldLease{nodeID: nodeId, volPath: volPath, expiresAt: expiresAt}
+}
+
+// renewed extends the lease only when it is still tracked, a lease released meanwhile stays so.
+func (hl *heldLeases) renewed(volid string, expiresAt time.Time) {
+	hl.Lock()
+	defer hl.Unlock()
+	if lease, found := hl.leases[volid]; found {
+		lease.expiresAt = expiresAt
+	}
+}
+
+func (hl *heldLeases) heldBy(volid, nodeId string) bool {
+	hl.Lock()
+	defer hl.Unlock()
+	lease, found := hl.leases[volid]
+	return found && lease.nodeID == nodeId
+}
+
+// lost expires the lease at once, which is taken over by another node.
+func (hl *heldLeases) lost(volid string) {
+	hl.Lock()
+	defer hl.Unlock()
+	if lease, found := hl.leases[volid]; found {
+		lease.expiresAt = time.Time{}
+	}
+}
+
+func (hl *heldLeases) released(volid string) {
+	hl.Lock()
+	defer hl.Unlock()
+	delete(hl.leases, volid)
+}
+
+// observedLease is a lease of another node with the time when this node saw it first.
+type observedLease struct {
+	lease VolumeLease
+	since time.Time
+}
+
+// observedLeases tracks the leases of other nodes which this node waits to take over.
+type observedLeases struct {
+	sync.Mutex
+	leases map[string]observedLease
+}
+
+// unchangedFor returns how long the lease is seen unchanged by this node, a renewed or another lease
+// starts the wait again.
+func (ol *observedLeases) unchangedFor(volid string, lease VolumeLease, now time.Time) time.Duration {
+	ol.Lock()
+	defer ol.Unlock()
+	if ol.leases == nil {
+		ol.leases = map[string]observedLease{}
+	}
+	if seen, found := ol.leases[volid]; found && seen.lease.NodeID == lease.NodeID && seen.lease.ExpiresAt.Equal(lease.ExpiresAt) {
+		return now.Sub(seen.since)
+	}
+	ol.leases[volid] = observedLease{lease: lease, since: now}
+	return 0
+}
+
+func (ol *observedLeases) forget(volid string) {
+	ol.Lock()
+	defer ol.Unlock()
+	delete(ol.leases, volid)
+}
+
+// isWriterAccessMode reports whether the access mode allows writing to the volume.
+func isWriterAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return false
+	}
+	return true
+}
+
+// leaseHolderAlive reports whether the lease is held by a node which is neither expired nor dead.
+func leaseHolderAlive(store MetadataStore, lease VolumeLease, now time.Time) (bool, error) {
+	if lease.NodeID == "" || !lease.ExpiresAt.After(now) {
+		return false, nil
+	}
+	ni, err := store.GetNodeInfo(lease.NodeID, time.Time{})
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	return !ni.Dead, nil
+}
+
+// checkVolumeLease returns ErrVolumeLeaseHeld when a live node other than the given node holds the
+// lease of the volume.
+func checkVolumeLease(store MetadataStore, vol *Volume, nodeId string, now time.Time) error {
+	lease := vol.VolumeLease
+	if lease.NodeID == nodeId {
+		return nil
+	}
+	alive, err := leaseHolderAlive(store, lease, now)
+	if err != nil {
+		return err
+	}
+	if alive {
+		return fmt.Errorf("%w: volume %s is owned by node %s until %v", ErrVolumeLeaseHeld, vol.VolID, lease.NodeID, lease.ExpiresAt)
+	}
+	return nil
+}
+
+// CheckVolumeLease returns ErrVolumeLeaseHeld when a live node other than the given node holds the
+// lease of the volume, readers check it since they do not take the lease.
+func (vh *VolumeHelper) CheckVolumeLease(volid, nodeId string) error {
+	vol, err := vh.store.GetVolume(volid)
+	if err != nil {
+		return err
+	}
+	return checkVolumeLease(vh.store, vol, nodeId, time.Now())
+}
+
+// PublishDiskVolume records the publication of the disk volume to the node under the volume lock. A
+// disk volume is published either to readers or to a writer, and readers are refused while a live
+// node other than the reader holds the lease.
+func (vh *VolumeHelper) PublishDiskVolume(volid, nodeId string, readOnly bool) error {
+	return vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(volid); err != nil {
+			return err
+		}
+		vol, err := store.GetVolume(volid)
+		if err != nil {
+			return err
+		}
+		cpvis, err := store.GetControllerPublishVolumeInfos(volid)
+		if err != nil {
+			return err
+		}
+		for _, other := range cpvis {
+			if other.NodeID != nodeId && other.ReadOnly != readOnly {
+				return fmt.Errorf("%w: volume %s is published with read only %v to node %s", ErrVolumeAccessConflict, volid, other.ReadOnly, other.NodeID)
+			}
+		}
+		if readOnly {
+			if err := checkVolumeLease(store, vol, nodeId, time.Now()); err != nil {
+				return err
+			}
+		}
+		return store.CreateControllerPublishVolumeInfo(&ControllerPublishVolumeInfo{VolID: volid, NodeID: nodeId, ReadOnly: readOnly})
+	})
+}
+
+// AcquireVolumeLease gives the exclusive ownership of the volume to the node or renews it. The lease
+// of another node is taken over only when this node sees it unchanged for volumeLeaseTakeoverWait,
+// since the owner fences the volume by then, so the first tries are refused. Neither the expiry time
+// in the store nor the dead mark of the owner is trusted, as they depend on the clocks of the nodes.
+func (vh *VolumeHelper) AcquireVolumeLease(volid, nodeId string) error {
+	var volPath string
+	var expiresAt time.Time
+	err := vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(volid); err != nil {
+			return err
+		}
+		vol, err := store.GetVolume(volid)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if lease := vol.VolumeLease; lease.NodeID != "" && lease.NodeID != nodeId {
+			if waited := vh.observed.unchangedFor(volid, lease, now); waited < volumeLeaseTakeoverWait {
+				return fmt.Errorf("%w: volume %s is owned by node %s, it is taken over after the lease is not renewed for %v, waited %v", ErrVolumeLeaseHeld, volid, lease.NodeID, volumeLeaseTakeoverWait, waited)
+			}
+			klog.V(5).Infof("AcquireVolumeLease node %s takes over lease of volume %s from node %s", nodeId, volid, lease.NodeID)
+		}
+		volPath, expiresAt = vol.VolPath, now.Add(volumeLeaseDuration)
+		return store.UpdateVolumeLease(volid, VolumeLease{NodeID: nodeId, ExpiresAt: expiresAt})
+	})
+	if err == nil {
+		vh.observed.forget(volid)
+		vh.leases.acquired(volid, nodeId, volPath, expiresAt)
+	}
+	return err
+}
+
+// ReleaseVolumeLease drops the lease of the volume when it is held by the node.
+func (vh *VolumeHelper) ReleaseVolumeLease(volid, nodeId string) error {
+	err := vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(volid); err != nil {
+			return err
+		}
+		vol, err := store.GetVolume(volid)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		if vol.VolumeLease.NodeID != nodeId {
+			return nil
+		}
+		return store.UpdateVolumeLease(volid, VolumeLease{})
+	})
+	if err == nil {
+		vh.leases.released(volid)
+	}
+	return err
+}
+
+// RenewVolumeLeases extends the leases held by the node for the volumes published writable to it.
+// Only the leases tracked by the node are renewed, so a lease which the node does not use, e.g. of a
+// read only publication, expires. Leases are renewed conditionally on the holder without the volume lock, so long
+// running operations holding it do not let the leases expire. Leases of volumes unpublished from the
+// node, e.g. by the node reaper, are left to expire. The leases taken over by other nodes are expired
+// at once at the node.
+func (vh *VolumeHelper) RenewVolumeLeases(nodeId string) error {
+	cpvis, err := vh.store.GetNodeControllerPublishVolumeInfos(nodeId)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, cpvi := range cpvis {
+		if cpvi.ReadOnly || !vh.leases.heldBy(cpvi.VolID, nodeId) {
+			continue
+		}
+		expiresAt := time.Now().Add(volumeLeaseDuration)
+		err := vh.store.RenewVolumeLease(cpvi.VolID, nodeId, expiresAt)
+		switch {
+		case err == nil:
+			vh.leases.renewed(cpvi.VolID, expiresAt)
+		case errors.Is(err, ErrRecordNotFound):
+			klog.V(5).Infof("RenewVolumeLeases node %s does not hold lease of volume %s", nodeId, cpvi.VolID)
+			vh.leases.lost(cpvi.VolID)
+		default:
+			klog.V(5).Error(err, "RenewVolumeLeases cannot renew lease of volume %s", cpvi.VolID)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("cannot renew %d volume leases, first error: %v", len(errs), errs[0])
+	}
+	return nil
+}
+
+// AdoptVolumeLeases tracks the leases which the node holds for the disk volumes published writable
+// to it but which are not tracked, e.g. after a restart of the node, so they are renewed and fenced.
+func (vh *VolumeHelper) AdoptVolumeLeases(nodeId string) error {
+	cpvis, err := vh.store.GetNodeControllerPublishVolumeInfos(nodeId)
+	if err != nil {
+		return err
+	}
+	for _, cpvi := range cpvis {
+		if cpvi.ReadOnly || vh.leases.heldBy(cpvi.VolID, nodeId) {
+			continue
+		}
+		vol, err := vh.store.GetVolume(cpvi.VolID)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+		if !vol.IsBlock || vol.VolumeLease.NodeID != nodeId {
+			continue
+		}
+		klog.V(5).Infof("AdoptVolumeLeases node %s tracks lease of volume %s expiring at %v", nodeId, vol.VolID, vol.VolumeLease.ExpiresAt)
+		vh.leases.acquired(vol.VolID, nodeId, vol.VolPath, vol.VolumeLease.ExpiresAt)
+	}
+	return nil
+}
+
+// VolumeLeaseFenced reports whether the node should not write to the volume, since the lease held by
+// the node is not renewed before the fence margin of its expiry. The known expiry is returned.
+func (vh *VolumeHelper) VolumeLeaseFenced(volid string, now time.Time) (bool, time.Time) {
+	vh.leases.Lock()
+	defer vh.leases.Unlock()
+	lease, found := vh.leases.leases[volid]
+	if !found {
+		return false, time.Time{}
+	}
+	return lease.fenced || !now.Before(lease.expiresAt.Add(-volumeLeaseFenceMargin)), lease.expiresAt
+}
+
+// FenceVolumeLeases marks the leases which are not renewed in time fenced and returns all fenced
+// volumes of the node, so their writes are stopped until they are unstaged.
+func (vh *VolumeHelper) FenceVolumeLeases(now time.Time) []FencedLease {
+	vh.leases.Lock()
+	defer vh.leases.Unlock()
+	var fenced []FencedLease
+	for volid, lease := range vh.leases.leases {
+		if !lease.fenced && !now.Before(lease.expiresAt.Add(-volumeLeaseFenceMargin)) {
+			klog.V(5).Infof("FenceVolumeLeases lease of volume %s expiring at %v is not renewed in time", volid, lease.expiresAt)
+			lease.fenced = true
+		}
+		if lease.fenced {
+			fenced = append(fenced, FencedLease{VolID: volid, VolPath: lease.volPath})
+		}
+	}
+	return fenced
+}
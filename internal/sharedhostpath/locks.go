@@ -0,0 +1,59 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"sync"
+)
+
+const volumeOperationAlreadyExistsFmt = "an operation with the given id %s already exists"
+
+// volumeLocks is a set of volume ids, names or snapshot ids which have an operation in flight.
+// the zero value is an empty set.
+type volumeLocks struct {
+	mutex sync.Mutex
+	keys  map[string]struct{}
+}
+
+// TryAcquire adds all keys to the set, it returns false without adding any key when one of them
+// is already in the set.
+func (vl *volumeLocks) TryAcquire(keys ...string) bool {
+	vl.mutex.Lock()
+	defer vl.mutex.Unlock()
+
+	if vl.keys == nil {
+		vl.keys = make(map[string]struct{})
+	}
+	for _, key := range keys {
+		if _, found := vl.keys[key]; found {
+			return false
+		}
+	}
+	for _, key := range keys {
+		vl.keys[key] = struct{}{}
+	}
+	return true
+}
+
+func (vl *volumeLocks) Release(keys ...string) {
+	vl.mutex.Lock()
+	defer vl.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(vl.keys, key)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	boltDSNPrefix       = "bolt://"
+	kubernetesDSNPrefix = "kubernetes://"
+)
+
+// ErrRecordNotFound is returned by all metadata stores when a record does not exist.
+var ErrRecordNotFound = gorm.ErrRecordNotFound
+
+var errLockOutsideTransaction = errors.New("volume lock outside of a transaction")
+
+var errVolumeLockLost = errors.New("volume lock is lost")
+
+// heldLock is a volume lock of a transaction at the stores which renew their lock records. The lock is
+// lost when it is taken over or cannot be renewed within its duration, locking it again then fails.
+type heldLock struct {
+	holder  string
+	release func()
+	lost    int32
+}
+
+func (hl *heldLock) markLost() {
+	atomic.StoreInt32(&hl.lost, 1)
+}
+
+func (hl *heldLock) isLost() bool {
+	return atomic.LoadInt32(&hl.lost) != 0
+}
+
+// MetadataStore keeps the volume, snapshot, node and publish records of the driver.
+type MetadataStore interface {
+	// Transaction runs fn with a store whose changes are committed only when fn returns nil.
+	Transaction(fn func(store MetadataStore) error) error
+	// LockVolume blocks until the volume is locked against all driver instances sharing the store,
+	// the lock is released when the transaction ends. It is only valid inside transactions.
+	LockVolume(volid string) error
+	// TryLead makes the holder the leader of the controllers sharing the store or keeps it so, false is
+	// returned while another holder leads. The leadership can be taken over when it is not renewed
+	// within the duration.
+	TryLead(holder string, duration time.Duration) (bool, error)
+	// ResignLead ends the leadership of the holder.
+	ResignLead(holder string) error
+	Close() error
+
+	CreateVolume(vol *Volume) error
+	GetVolume(volid string) (*Volume, error)
+	GetVolumeByName(volname string) (*Volume, error)
+	GetVolumes(offset, limit int) ([]Volume, error)
+	GetVolumeCount() (int, error)
+	GetPoolVolumes(pool string) ([]Volume, error)
+	GetDeletedPoolVolumes(pool string) ([]Volume, error)
+	HasVolumeAtPath(path string) (bool, error)
+	UpdateVolumeCapacity(volid string, capacity int64) error
+	UpdateVolumeProjectID(volid string, projectID uint32) error
+	UpdateVolumeCondition(volid string, condition VolumeCondition) error
+	UpdateVolumeLease(volid string, lease VolumeLease) error
+	// RenewVolumeLease extends the volume lease without the volume lock only when the node still holds
+	// it, ErrRecordNotFound is returned otherwise.
+	RenewVolumeLease(volid, nodeId string, expiresAt time.Time) error
+	GetMaxProjectID() (uint32, error)
+	DeleteVolume(volid string) error
+
+	UpdateNodeInfoLastSeen(nodeId string, lastSeen time.Time) error
+	GetNodeInfo(nodeId string, minLastSeen time.Time) (*NodeInfo, error)
+	GetNodeInfos() ([]NodeInfo, error)
+	// MarkNodeDead marks the node dead only when it is last seen before the deadline, ErrRecordNotFound
+	// is returned when it is seen meanwhile.
+	MarkNodeDead(nodeId string, deadline time.Time) error
+
+	CreateControllerPublishVolumeInfo(cpvi *ControllerPublishVolumeInfo) error
+	GetControllerPublishVolumeInfo(volId, nodeId string) (*ControllerPublishVolumeInfo, error)
+	GetControllerPublishVolumeInfos(volId string) ([]ControllerPublishVolumeInfo, error)
+	GetNodeControllerPublishVolumeInfos(nodeId string) ([]ControllerPublishVolumeInfo, error)
+	DeleteControllerPublishVolumeInfo(volId, nodeId string) error
+
+	CreateNodePublishVolumeInfo(npvi *NodePublishVolumeInfo) error
+	GetNodePublishVolumeInfo(volId, nodeId, mountPath string) (*NodePublishVolumeInfo, error)
+	// GetNodePublishVolumeInfos returns the infos of all nodes when nodeId is empty.
+	GetNodePublishVolumeInfos(volId, nodeId string) ([]NodePublishVolumeInfo, error)
+	DeleteNodePublishVolumeInfo(volId, nodeId, mountPath string) error
+
+	CreateSnapshot(snap *Snapshot) error
+	UpdateSnapshot(snap *Snapshot) error
+	GetSnapshot(snapid string) (*Snapshot, error)
+	GetSnapshotByName(snapname string) (*Snapshot, error)
+	GetSnapshots(snapid, srcvolid string, offset, limit int) ([]Snapshot, error)
+	GetSnapshotCount(snapid, srcvolid string) (int, error)
+	DeleteSnapshot(snapid string) error
+}
+
+// NewMetadataStore selects the backend with the dsn. A dsn starting with bolt:// is an embedded
+// database file, which is created inside the default data root when the path is omitted.
+// A dsn starting with kubernetes:// keeps the metadata as custom resources, the path is an
+// optional kubeconfig and the in cluster config is used without it.
+// Other dsns are postgres connection strings.
+func NewMetadataStore(dsn, dataRoot string) (MetadataStore, error) {
+	if strings.HasPrefix(dsn, boltDSNPrefix) {
+		path := strings.TrimPrefix(dsn, boltDSNPrefix)
+		if path == "" {
+			path = filepath.Join(dataRoot, dbname)
+		}
+		return NewBoltStore(path)
+	}
+	if strings.HasPrefix(dsn, kubernetesDSNPrefix) {
+		client, err := NewKubernetesClient(strings.TrimPrefix(dsn, kubernetesDSNPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return NewCRDStore(client)
+	}
+	return NewPostgresStore(dsn)
+}
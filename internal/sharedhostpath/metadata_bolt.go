@@ -0,0 +1,801 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	"gorm.io/gorm"
+	klog "k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	boltOpenTimeout      = 30 * time.Second
+	boltLockDuration     = 60 * time.Second
+	boltLockPollInterval = 100 * time.Millisecond
+)
+
+var errBoltRollback = errors.New("bolt transaction is rolled back")
+
+var (
+	volumesBucket           = []byte("volumes")
+	snapshotsBucket         = []byte("snapshots")
+	nodeInfosBucket         = []byte("node_infos")
+	controllerPublishBucket = []byte("controller_publish_volume_infos")
+	nodePublishBucket       = []byte("node_publish_volume_infos")
+	locksBucket             = []byte("locks")
+)
+
+// boltStore keeps the metadata inside a bbolt file at the shared storage. The database is opened only
+// while a single change runs and a lock file next to it allows many readers or a single writer, so the
+// controllers and the nodes can share the file. The changes inside a transaction are kept in memory
+// and written inside a single write transaction of the database at commit, so the file is never locked
+// while volumes are populated or copied and the others never see the changes of a failed transaction. Since every call opens and locks the file at the shared storage,
+// the store is meant only for small setups with a single controller.
+type boltStore struct {
+	path     string
+	lockPath string
+	pending  *[]func(tx *bolt.Tx) error
+	held     map[string]*heldLock
+}
+
+// boltLock is the lock record of a volume. The holder renews the lock while its transaction runs,
+// a lock which is not renewed within its duration is taken over.
+type boltLock struct {
+	Holder          string    `json:"holder"`
+	RenewTime       time.Time `json:"renewTime"`
+	DurationSeconds int64     `json:"durationSeconds"`
+}
+
+func NewBoltStore(path string) (*boltStore, error) {
+	path, _ = filepath.Abs(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		klog.V(5).Error(err, "NewBoltStore cannot create db folder of %s", path)
+		return nil, err
+	}
+
+	bs := &boltStore{path: path, lockPath: path + ".lock"}
+	err := bs.update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{volumesBucket, snapshotsBucket, nodeInfosBucket, controllerPublishBucket, nodePublishBucket, locksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		klog.V(5).Error(err, "NewBoltStore cannot create db schema at %s", path)
+		return nil, err
+	}
+	klog.V(5).Infof("NewBoltStore database %s is ready", path)
+
+	return bs, nil
+}
+
+func (bs *boltStore) run(writable bool, fn func(tx *bolt.Tx) error) error {
+	lock, err := lockFile(bs.lockPath, writable, boltOpenTimeout)
+	if err != nil {
+		klog.V(5).Error(err, "boltStore cannot lock %s", bs.lockPath)
+		return err
+	}
+	defer unlockFile(lock)
+
+	db, err := bolt.Open(bs.path, 0640, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: !writable})
+	if err != nil {
+		klog.V(5).Error(err, "boltStore cannot open %s", bs.path)
+		return err
+	}
+	defer db.Close()
+
+	if writable {
+		return db.Update(fn)
+	}
+	return db.View(fn)
+}
+
+func (bs *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	if bs.pending != nil && len(*bs.pending) != 0 {
+		return bs.withPending(fn)
+	}
+	return bs.run(false, fn)
+}
+
+func (bs *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	return bs.run(true, fn)
+}
+
+// withPending runs fn after the pending changes of the transaction inside a write transaction of the
+// database which is rolled back, so the transaction sees its own changes before they are committed.
+func (bs *boltStore) withPending(fn func(tx *bolt.Tx) error) error {
+	err := bs.update(func(tx *bolt.Tx) error {
+		for _, change := range *bs.pending {
+			if err := change(tx); err != nil {
+				return err
+			}
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return errBoltRollback
+	})
+	if errors.Is(err, errBoltRollback) {
+		return nil
+	}
+	return err
+}
+
+// change runs fn inside a short write transaction of the database. When the store belongs to a
+// transaction, fn is checked against the pending changes and kept until the transaction is committed.
+func (bs *boltStore) change(bucket []byte, fn func(b *bolt.Bucket) error) error {
+	change := func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(bucket))
+	}
+	if bs.pending == nil {
+		return bs.update(change)
+	}
+	if err := bs.withPending(change); err != nil {
+		return err
+	}
+	*bs.pending = append(*bs.pending, change)
+	return nil
+}
+
+func (bs *boltStore) Transaction(fn func(store MetadataStore) error) error {
+	if bs.pending != nil {
+		return fn(bs)
+	}
+	pending := []func(tx *bolt.Tx) error{}
+	held := map[string]*heldLock{}
+	err := fn(&boltStore{path: bs.path, lockPath: bs.lockPath, pending: &pending, held: held})
+	if err == nil && len(pending) != 0 {
+		err = bs.commit(pending, held)
+	}
+	for _, hl := range held {
+		hl.release()
+	}
+	return err
+}
+
+// commit writes the pending changes inside a single write transaction of the database, only while the
+// volume locks of the transaction are still held.
+func (bs *boltStore) commit(pending []func(tx *bolt.Tx) error, held map[string]*heldLock) error {
+	return bs.update(func(tx *bolt.Tx) error {
+		for volid, hl := range held {
+			var lock boltLock
+			if err := getRecord(tx.Bucket(locksBucket), volid, &lock); err != nil && !errors.Is(err, ErrRecordNotFound) {
+				return err
+			}
+			if lock.Holder != hl.holder {
+				return fmt.Errorf("%w: volume %s", errVolumeLockLost, volid)
+			}
+		}
+		for _, change := range pending {
+			if err := change(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LockVolume writes a lock record of the volume, the database file itself is locked only while the
+// record is written.
+func (bs *boltStore) LockVolume(volid string) error {
+	if bs.held == nil {
+		return errLockOutsideTransaction
+	}
+	if hl, found := bs.held[volid]; found {
+		if hl.isLost() {
+			return errVolumeLockLost
+		}
+		return nil
+	}
+
+	holder := uuid.New().String()
+	for {
+		err := bs.tryLock(volid, holder)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errVolumeLocked) {
+			klog.V(5).Error(err, "LockVolume cannot lock volume %s", volid)
+			return err
+		}
+		time.Sleep(boltLockPollInterval)
+	}
+
+	stop := make(chan struct{})
+	hl := &heldLock{holder: holder}
+	go bs.renewLock(volid, holder, hl, stop)
+	bs.held[volid] = hl
+	hl.release = func() {
+		close(stop)
+		err := bs.update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(locksBucket)
+			var lock boltLock
+			if err := getRecord(b, volid, &lock); err != nil || lock.Holder != holder {
+				return err
+			}
+			return b.Delete([]byte(volid))
+		})
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			klog.V(5).Error(err, "LockVolume cannot unlock volume %s", volid)
+		}
+	}
+	return nil
+}
+
+func (bs *boltStore) tryLock(volid, holder string) error {
+	return bs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(locksBucket)
+		var lock boltLock
+		err := getRecord(b, volid, &lock)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		if err == nil {
+			if time.Since(lock.RenewTime) < time.Duration(lock.DurationSeconds)*time.Second {
+				return errVolumeLocked
+			}
+			klog.V(5).Infof("LockVolume expired lock of volume %s held by %s is taken over", volid, lock.Holder)
+		}
+		return putRecord(b, volid, &boltLock{Holder: holder, RenewTime: time.Now(), DurationSeconds: int64(boltLockDuration / time.Second)})
+	})
+}
+
+func (bs *boltStore) renewLock(volid, holder string, hl *heldLock, stop chan struct{}) {
+	ticker := time.NewTicker(boltLockDuration / 3)
+	defer ticker.Stop()
+	lastRenewal := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := bs.update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(locksBucket)
+			var lock boltLock
+			if err := getRecord(b, volid, &lock); err != nil {
+				return err
+			}
+			if lock.Holder != holder {
+				return errVolumeLocked
+			}
+			lock.RenewTime = time.Now()
+			return putRecord(b, volid, &lock)
+		})
+		if errors.Is(err, errVolumeLocked) || errors.Is(err, ErrRecordNotFound) {
+			klog.V(5).Infof("LockVolume lock of volume %s is taken over", volid)
+			hl.markLost()
+			<-stop
+			return
+		}
+		if err != nil {
+			klog.V(5).Error(err, "LockVolume cannot renew lock of volume %s", volid)
+			if time.Since(lastRenewal) >= boltLockDuration {
+				hl.markLost()
+			}
+			continue
+		}
+		lastRenewal = time.Now()
+	}
+}
+
+// TryLead writes the leadership record of the holder when it does not exist, is expired or belongs to
+// the holder.
+func (bs *boltStore) TryLead(holder string, duration time.Duration) (bool, error) {
+	leading := false
+	err := bs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(locksBucket)
+		var lock boltLock
+		err := getRecord(b, controllerLeaderLockKey, &lock)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		if err == nil && lock.Holder != holder && time.Since(lock.RenewTime) < time.Duration(lock.DurationSeconds)*time.Second {
+			return nil
+		}
+		leading = true
+		return putRecord(b, controllerLeaderLockKey, &boltLock{Holder: holder, RenewTime: time.Now(), DurationSeconds: int64(duration / time.Second)})
+	})
+	return leading, err
+}
+
+func (bs *boltStore) ResignLead(holder string) error {
+	return bs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(locksBucket)
+		var lock boltLock
+		if err := getRecord(b, controllerLeaderLockKey, &lock); err != nil || lock.Holder != holder {
+			return nil
+		}
+		return b.Delete([]byte(controllerLeaderLockKey))
+	})
+}
+
+func (bs *boltStore) Close() error {
+	return nil
+}
+
+func getRecord(b *bolt.Bucket, key string, v interface{}) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return ErrRecordNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putRecord(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func forEachRecord(b *bolt.Bucket, newRecord func() interface{}, fn func(v interface{}) error) error {
+	return b.ForEach(func(k, data []byte) error {
+		v := newRecord()
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+		return fn(v)
+	})
+}
+
+func paginate(count, offset, limit int) (int, int) {
+	if offset > count {
+		offset = count
+	}
+	end := count
+	if limit > 0 && offset+limit < count {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+func (bs *boltStore) findVolumes(filter func(vol *Volume) bool) ([]Volume, error) {
+	var vols []Volume
+	err := bs.view(func(tx *bolt.Tx) error {
+		return forEachRecord(tx.Bucket(volumesBucket), func() interface{} { return &Volume{} }, func(v interface{}) error {
+			vol := v.(*Volume)
+			if filter(vol) {
+				vols = append(vols, *vol)
+			}
+			return nil
+		})
+	})
+	sort.Slice(vols, func(i, j int) bool { return vols[i].StorageID < vols[j].StorageID })
+	return vols, err
+}
+
+func (bs *boltStore) CreateVolume(vol *Volume) error {
+	return bs.change(volumesBucket, func(b *bolt.Bucket) error {
+		if b.Get([]byte(vol.VolID)) != nil {
+			return fmt.Errorf("volume %s already exists", vol.VolID)
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		vol.StorageID = int64(id)
+		vol.CreatedAt = time.Now()
+		vol.UpdatedAt = vol.CreatedAt
+		if vol.Pool == "" {
+			vol.Pool = defaultPool
+		}
+		return putRecord(b, vol.VolID, vol)
+	})
+}
+
+func (bs *boltStore) GetVolume(volid string) (*Volume, error) {
+	var vol Volume
+	err := bs.view(func(tx *bolt.Tx) error {
+		return getRecord(tx.Bucket(volumesBucket), volid, &vol)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if vol.DeletedAt.Valid {
+		return nil, ErrRecordNotFound
+	}
+	return &vol, nil
+}
+
+func (bs *boltStore) GetVolumeByName(volname string) (*Volume, error) {
+	vols, err := bs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid && vol.VolName == volname
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(vols) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &vols[0], nil
+}
+
+func (bs *boltStore) GetVolumes(offset, limit int) ([]Volume, error) {
+	vols, err := bs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid
+	})
+	if err != nil {
+		return nil, err
+	}
+	start, end := paginate(len(vols), offset, limit)
+	return vols[start:end], nil
+}
+
+func (bs *boltStore) GetVolumeCount() (int, error) {
+	vols, err := bs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid
+	})
+	return len(vols), err
+}
+
+func (bs *boltStore) GetPoolVolumes(pool string) ([]Volume, error) {
+	return bs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid && vol.Pool == pool
+	})
+}
+
+func (bs *boltStore) GetDeletedPoolVolumes(pool string) ([]Volume, error) {
+	return bs.findVolumes(func(vol *Volume) bool {
+		return vol.DeletedAt.Valid && vol.Pool == pool
+	})
+}
+
+func (bs *boltStore) HasVolumeAtPath(path string) (bool, error) {
+	vols, err := bs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid && vol.VolPath == path
+	})
+	return len(vols) != 0, err
+}
+
+func (bs *boltStore) updateVolume(volid string, fn func(vol *Volume)) error {
+	return bs.change(volumesBucket, func(b *bolt.Bucket) error {
+		var vol Volume
+		if err := getRecord(b, volid, &vol); err != nil {
+			return err
+		}
+		if vol.DeletedAt.Valid {
+			return ErrRecordNotFound
+		}
+		fn(&vol)
+		vol.UpdatedAt = time.Now()
+		return putRecord(b, volid, &vol)
+	})
+}
+
+func (bs *boltStore) UpdateVolumeCapacity(volid string, capacity int64) error {
+	return bs.updateVolume(volid, func(vol *Volume) {
+		vol.Capacity = capacity
+	})
+}
+
+func (bs *boltStore) UpdateVolumeProjectID(volid string, projectID uint32) error {
+	return bs.updateVolume(volid, func(vol *Volume) {
+		vol.ProjectID = projectID
+	})
+}
+
+func (bs *boltStore) UpdateVolumeCondition(volid string, condition VolumeCondition) error {
+	return bs.updateVolume(volid, func(vol *Volume) {
+		vol.VolumeCondition = condition
+	})
+}
+
+func (bs *boltStore) UpdateVolumeLease(volid string, lease VolumeLease) error {
+	return bs.updateVolume(volid, func(vol *Volume) {
+		vol.VolumeLease = lease
+	})
+}
+
+func (bs *boltStore) RenewVolumeLease(volid, nodeId string, expiresAt time.Time) error {
+	return bs.change(volumesBucket, func(b *bolt.Bucket) error {
+		var vol Volume
+		if err := getRecord(b, volid, &vol); err != nil {
+			return err
+		}
+		if vol.DeletedAt.Valid || vol.VolumeLease.NodeID != nodeId {
+			return ErrRecordNotFound
+		}
+		vol.VolumeLease.ExpiresAt = expiresAt
+		vol.UpdatedAt = time.Now()
+		return putRecord(b, volid, &vol)
+	})
+}
+
+func (bs *boltStore) GetMaxProjectID() (uint32, error) {
+	var maxProjectID uint32
+	_, err := bs.findVolumes(func(vol *Volume) bool {
+		if vol.ProjectID > maxProjectID {
+			maxProjectID = vol.ProjectID
+		}
+		return false
+	})
+	return maxProjectID, err
+}
+
+func (bs *boltStore) DeleteVolume(volid string) error {
+	err := bs.updateVolume(volid, func(vol *Volume) {
+		// volumes are soft deleted like gorm does, dangling volume cleanup needs them
+		vol.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	})
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (bs *boltStore) UpdateNodeInfoLastSeen(nodeId string, lastSeen time.Time) error {
+	return bs.change(nodeInfosBucket, func(b *bolt.Bucket) error {
+		return putRecord(b, nodeId, &NodeInfo{ID: nodeId, LastSeen: lastSeen})
+	})
+}
+
+func (bs *boltStore) GetNodeInfo(nodeId string, minLastSeen time.Time) (*NodeInfo, error) {
+	var ni NodeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return getRecord(tx.Bucket(nodeInfosBucket), nodeId, &ni)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ni.LastSeen.Before(minLastSeen) {
+		return nil, ErrRecordNotFound
+	}
+	return &ni, nil
+}
+
+func (bs *boltStore) GetNodeInfos() ([]NodeInfo, error) {
+	var nis []NodeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return forEachRecord(tx.Bucket(nodeInfosBucket), func() interface{} { return &NodeInfo{} }, func(v interface{}) error {
+			nis = append(nis, *v.(*NodeInfo))
+			return nil
+		})
+	})
+	return nis, err
+}
+
+func (bs *boltStore) MarkNodeDead(nodeId string, deadline time.Time) error {
+	return bs.change(nodeInfosBucket, func(b *bolt.Bucket) error {
+		var ni NodeInfo
+		if err := getRecord(b, nodeId, &ni); err != nil {
+			return err
+		}
+		if !ni.LastSeen.Before(deadline) {
+			return ErrRecordNotFound
+		}
+		ni.Dead = true
+		return putRecord(b, nodeId, &ni)
+	})
+}
+
+func controllerPublishKey(volId, nodeId string) string {
+	return volId + "/" + nodeId
+}
+
+func (bs *boltStore) CreateControllerPublishVolumeInfo(cpvi *ControllerPublishVolumeInfo) error {
+	return bs.change(controllerPublishBucket, func(b *bolt.Bucket) error {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		cpvi.StorageID = int64(id)
+		cpvi.CreatedAt = time.Now()
+		cpvi.UpdatedAt = cpvi.CreatedAt
+		return putRecord(b, controllerPublishKey(cpvi.VolID, cpvi.NodeID), cpvi)
+	})
+}
+
+func (bs *boltStore) GetControllerPublishVolumeInfo(volId, nodeId string) (*ControllerPublishVolumeInfo, error) {
+	var cpvi ControllerPublishVolumeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return getRecord(tx.Bucket(controllerPublishBucket), controllerPublishKey(volId, nodeId), &cpvi)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cpvi, nil
+}
+
+func (bs *boltStore) GetControllerPublishVolumeInfos(volId string) ([]ControllerPublishVolumeInfo, error) {
+	var cpvis []ControllerPublishVolumeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return forEachRecord(tx.Bucket(controllerPublishBucket), func() interface{} { return &ControllerPublishVolumeInfo{} }, func(v interface{}) error {
+			if cpvi := v.(*ControllerPublishVolumeInfo); cpvi.VolID == volId {
+				cpvis = append(cpvis, *cpvi)
+			}
+			return nil
+		})
+	})
+	return cpvis, err
+}
+
+func (bs *boltStore) GetNodeControllerPublishVolumeInfos(nodeId string) ([]ControllerPublishVolumeInfo, error) {
+	var cpvis []ControllerPublishVolumeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return forEachRecord(tx.Bucket(controllerPublishBucket), func() interface{} { return &ControllerPublishVolumeInfo{} }, func(v interface{}) error {
+			if cpvi := v.(*ControllerPublishVolumeInfo); cpvi.NodeID == nodeId {
+				cpvis = append(cpvis, *cpvi)
+			}
+			return nil
+		})
+	})
+	return cpvis, err
+}
+
+func (bs *boltStore) DeleteControllerPublishVolumeInfo(volId, nodeId string) error {
+	key := controllerPublishKey(volId, nodeId)
+	return bs.change(controllerPublishBucket, func(b *bolt.Bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+func nodePublishKey(volId, nodeId, mountPath string) string {
+	return volId + "/" + nodeId + "/" + mountPath
+}
+
+func (bs *boltStore) CreateNodePublishVolumeInfo(npvi *NodePublishVolumeInfo) error {
+	return bs.change(nodePublishBucket, func(b *bolt.Bucket) error {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		npvi.StorageID = int64(id)
+		npvi.CreatedAt = time.Now()
+		npvi.UpdatedAt = npvi.CreatedAt
+		return putRecord(b, nodePublishKey(npvi.VolID, npvi.NodeID, npvi.MountPath), npvi)
+	})
+}
+
+func (bs *boltStore) GetNodePublishVolumeInfo(volId, nodeId, mountPath string) (*NodePublishVolumeInfo, error) {
+	var npvi NodePublishVolumeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return getRecord(tx.Bucket(nodePublishBucket), nodePublishKey(volId, nodeId, mountPath), &npvi)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &npvi, nil
+}
+
+func (bs *boltStore) GetNodePublishVolumeInfos(volId, nodeId string) ([]NodePublishVolumeInfo, error) {
+	var npvis []NodePublishVolumeInfo
+	err := bs.view(func(tx *bolt.Tx) error {
+		return forEachRecord(tx.Bucket(nodePublishBucket), func() interface{} { return &NodePublishVolumeInfo{} }, func(v interface{}) error {
+			if npvi := v.(*NodePublishVolumeInfo); npvi.VolID == volId && (nodeId == "" || npvi.NodeID == nodeId) {
+				npvis = append(npvis, *npvi)
+			}
+			return nil
+		})
+	})
+	return npvis, err
+}
+
+func (bs *boltStore) DeleteNodePublishVolumeInfo(volId, nodeId, mountPath string) error {
+	key := nodePublishKey(volId, nodeId, mountPath)
+	return bs.change(nodePublishBucket, func(b *bolt.Bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+func (bs *boltStore) findSnapshots(filter func(snap *Snapshot) bool) ([]Snapshot, error) {
+	var snaps []Snapshot
+	err := bs.view(func(tx *bolt.Tx) error {
+		return forEachRecord(tx.Bucket(snapshotsBucket), func() interface{} { return &Snapshot{} }, func(v interface{}) error {
+			if snap := v.(*Snapshot); filter(snap) {
+				snaps = append(snaps, *snap)
+			}
+			return nil
+		})
+	})
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].StorageID < snaps[j].StorageID })
+	return snaps, err
+}
+
+func (bs *boltStore) CreateSnapshot(snap *Snapshot) error {
+	return bs.change(snapshotsBucket, func(b *bolt.Bucket) error {
+		if b.Get([]byte(snap.SnapID)) != nil {
+			return fmt.Errorf("snapshot %s already exists", snap.SnapID)
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		snap.StorageID = int64(id)
+		snap.CreatedAt = time.Now()
+		snap.UpdatedAt = snap.CreatedAt
+		if snap.Pool == "" {
+			snap.Pool = defaultPool
+		}
+		return putRecord(b, snap.SnapID, snap)
+	})
+}
+
+func (bs *boltStore) UpdateSnapshot(snap *Snapshot) error {
+	return bs.change(snapshotsBucket, func(b *bolt.Bucket) error {
+		var stored Snapshot
+		if err := getRecord(b, snap.SnapID, &stored); err != nil {
+			return err
+		}
+		stored.ReadyToUse = snap.ReadyToUse
+		stored.CopyMethod = snap.CopyMethod
+		stored.AllocatedSize = snap.AllocatedSize
+		stored.UpdatedAt = time.Now()
+		return putRecord(b, snap.SnapID, &stored)
+	})
+}
+
+func (bs *boltStore) GetSnapshot(snapid string) (*Snapshot, error) {
+	var snap Snapshot
+	err := bs.view(func(tx *bolt.Tx) error {
+		return getRecord(tx.Bucket(snapshotsBucket), snapid, &snap)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (bs *boltStore) GetSnapshotByName(snapname string) (*Snapshot, error) {
+	snaps, err := bs.findSnapshots(func(snap *Snapshot) bool {
+		return snap.SnapName == snapname
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &snaps[0], nil
+}
+
+func snapshotFilter(snapid, srcvolid string) func(snap *Snapshot) bool {
+	return func(snap *Snapshot) bool {
+		return (snapid == "" || snap.SnapID == snapid) && (srcvolid == "" || snap.SourceVolID == srcvolid)
+	}
+}
+
+func (bs *boltStore) GetSnapshots(snapid, srcvolid string, offset, limit int) ([]Snapshot, error) {
+	snaps, err := bs.findSnapshots(snapshotFilter(snapid, srcvolid))
+	if err != nil {
+		return nil, err
+	}
+	start, end := paginate(len(snaps), offset, limit)
+	return snaps[start:end], nil
+}
+
+func (bs *boltStore) GetSnapshotCount(snapid, srcvolid string) (int, error) {
+	snaps, err := bs.findSnapshots(snapshotFilter(snapid, srcvolid))
+	return len(snaps), err
+}
+
+func (bs *boltStore) DeleteSnapshot(snapid string) error {
+	return bs.change(snapshotsBucket, func(b *bolt.Bucket) error {
+		return b.Delete([]byte(snapid))
+	})
+}
@@ -0,0 +1,1379 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	klog "k8s.io/klog/v2"
+	"sort"
+	"time"
+)
+
+const (
+	crdKindVolume      = "SharedHostPathVolume"
+	crdKindSnapshot    = "SharedHostPathSnapshot"
+	crdKindNode        = "SharedHostPathNode"
+	crdKindLock        = "SharedHostPathLock"
+	crdKindTransaction = "SharedHostPathTransaction"
+
+	crdLockDuration     = 60 * time.Second
+	crdLockPollInterval = time.Second
+
+	crdTransactionAnnotation = "sharedhostpath.sanaldiyar.com/transaction"
+	crdPreviousAnnotation    = "sharedhostpath.sanaldiyar.com/previous"
+	crdDeletedAnnotation     = "sharedhostpath.sanaldiyar.com/deleted"
+
+	crdTransactionPending   = "Pending"
+	crdTransactionCommitted = "Committed"
+)
+
+var (
+	crdGroupVersion      = schema.GroupVersion{Group: "sharedhostpath.sanaldiyar.com", Version: "v1alpha1"}
+	volumesResource      = crdGroupVersion.WithResource("sharedhostpathvolumes")
+	snapshotsResource    = crdGroupVersion.WithResource("sharedhostpathsnapshots")
+	nodesResource        = crdGroupVersion.WithResource("sharedhostpathnodes")
+	locksResource        = crdGroupVersion.WithResource("sharedhostpathlocks")
+	transactionsResource = crdGroupVersion.WithResource("sharedhostpathtransactions")
+)
+
+var errVolumeLocked = errors.New("volume is locked")
+
+// crdVolumeStatus is the status of a SharedHostPathVolume, it holds the publish records of the volume.
+type crdVolumeStatus struct {
+	ControllerPublishVolumeInfos []ControllerPublishVolumeInfo `json:"controllerPublishVolumeInfos,omitempty"`
+	NodePublishVolumeInfos       []NodePublishVolumeInfo       `json:"nodePublishVolumeInfos,omitempty"`
+}
+
+// crdStore keeps the metadata as cluster scoped custom resources. The api server has no transactions,
+// so the changes inside a transaction are kept in memory until the transaction is committed. A commit
+// which changes many resources writes them as pending with a SharedHostPathTransaction record, the
+// readers see their new content only after the record is marked committed.
+type crdStore struct {
+	client  dynamic.Interface
+	changes *[]*crdChange
+	held    map[string]*heldLock
+}
+
+// crdOp changes the object of a resource, a nil object is a resource which does not exist.
+type crdOp func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
+
+// crdChange is a change of a resource inside a transaction. The operations are applied again to the
+// current object at commit, obj is the object as the transaction sees it.
+type crdChange struct {
+	res  schema.GroupVersionResource
+	name string
+	ops  []crdOp
+	obj  *unstructured.Unstructured
+}
+
+// crdTransactionSpec is the spec of a SharedHostPathTransaction. The resources of a transaction which is
+// not committed show their previous content, a pending transaction which is not committed within the
+// lock duration is abandoned and its resources are rolled back by the next writer.
+type crdTransactionSpec struct {
+	Phase     string    `json:"phase"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// crdLockSpec is the spec of a SharedHostPathLock. The holder renews the lock while its transaction
+// runs, a lock which is not renewed within its duration is taken over.
+type crdLockSpec struct {
+	Holder          string    `json:"holder"`
+	RenewTime       time.Time `json:"renewTime"`
+	DurationSeconds int64     `json:"durationSeconds"`
+}
+
+// kubernetesConfig uses the in cluster config when the kubeconfig is empty.
+func kubernetesConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+func NewKubernetesClient(kubeconfig string) (dynamic.Interface, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func NewKubernetesClientset(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+func NewCRDStore(client dynamic.Interface) (*crdStore, error) {
+	_, err := client.Resource(volumesResource).List(context.Background(), metav1.ListOptions{Limit: 1})
+	if err != nil {
+		klog.V(5).Error(err, "NewCRDStore cannot list %s, are the crds installed?", volumesResource.Resource)
+		return nil, err
+	}
+	klog.V(5).Infof("NewCRDStore custom resources are ready")
+	return &crdStore{client: client}, nil
+}
+
+func (cs *crdStore) Transaction(fn func(store MetadataStore) error) error {
+	if cs.changes != nil {
+		return fn(cs)
+	}
+	changes := []*crdChange{}
+	held := map[string]*heldLock{}
+	err := fn(&crdStore{client: cs.client, changes: &changes, held: held})
+	if err == nil && len(changes) != 0 {
+		err = cs.commit(changes, held)
+	}
+	for _, hl := range held {
+		hl.release()
+	}
+	return err
+}
+
+// commit writes the changes of a transaction while its volume locks are still held. A single change is
+// written at once, many changes are written as pending and become visible when the transaction record
+// is marked committed.
+func (cs *crdStore) commit(changes []*crdChange, held map[string]*heldLock) error {
+	for volid, hl := range held {
+		obj, err := cs.get(locksResource, volid)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		var lock crdLockSpec
+		if obj != nil {
+			if err := fromUnstructuredField(obj, "spec", &lock); err != nil {
+				return err
+			}
+		}
+		if hl.isLost() || lock.Holder != hl.holder {
+			return fmt.Errorf("%w: volume %s", errVolumeLockLost, volid)
+		}
+	}
+	if len(changes) == 1 {
+		return cs.apply(changes[0].res, changes[0].name, changes[0].ops)
+	}
+
+	record, err := cs.createTransaction()
+	if err != nil {
+		klog.V(5).Error(err, "Transaction cannot create transaction record")
+		return err
+	}
+	var written []*crdChange
+	for _, change := range changes {
+		var obj *unstructured.Unstructured
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current, err := cs.current(change.res, change.name)
+			if err != nil {
+				return err
+			}
+			target, err := applyOps(current, change.ops)
+			if err != nil {
+				return err
+			}
+			pending, err := pendingObject(record.GetName(), current, target)
+			if err != nil || pending == nil {
+				return err
+			}
+			obj, err = cs.write(change.res, current, pending)
+			return err
+		})
+		if err == nil && obj != nil {
+			written = append(written, &crdChange{res: change.res, name: change.name, obj: obj})
+		}
+		if err != nil {
+			klog.V(5).Error(err, "Transaction cannot write %s %s", change.res.Resource, change.name)
+			cs.abort(record, written)
+			return err
+		}
+	}
+
+	if err := unstructured.SetNestedField(record.Object, crdTransactionCommitted, "spec", "phase"); err != nil {
+		cs.abort(record, written)
+		return err
+	}
+	if _, err := cs.client.Resource(transactionsResource).Update(context.Background(), record, metav1.UpdateOptions{}); err != nil {
+		klog.V(5).Error(err, "Transaction cannot commit transaction %s", record.GetName())
+		cs.abort(record, written)
+		return err
+	}
+
+	// the record is kept until all resources are finalized, the readers see the committed content
+	// meanwhile and the next writer finalizes the leftovers
+	finalized := true
+	for _, change := range written {
+		if _, err := cs.write(change.res, change.obj, committedObject(change.obj)); err != nil {
+			klog.V(5).Error(err, "Transaction cannot finalize %s %s", change.res.Resource, change.name)
+			finalized = false
+		}
+	}
+	if finalized {
+		if err := cs.client.Resource(transactionsResource).Delete(context.Background(), record.GetName(), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			klog.V(5).Error(err, "Transaction cannot remove transaction record %s", record.GetName())
+		}
+	}
+	return nil
+}
+
+func (cs *crdStore) createTransaction() (*unstructured.Unstructured, error) {
+	specMap, err := toUnstructuredField(&crdTransactionSpec{Phase: crdTransactionPending, StartTime: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": specMap}}
+	obj.SetAPIVersion(crdGroupVersion.String())
+	obj.SetKind(crdKindTransaction)
+	obj.SetName(uuid.New().String())
+	return cs.client.Resource(transactionsResource).Create(context.Background(), obj, metav1.CreateOptions{})
+}
+
+// abort removes the record of a transaction which is not committed, the pending resources show their
+// previous content without the record and are rolled back here or by the next writer.
+func (cs *crdStore) abort(record *unstructured.Unstructured, written []*crdChange) {
+	rv := record.GetResourceVersion()
+	err := cs.client.Resource(transactionsResource).Delete(context.Background(), record.GetName(), metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &rv}})
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.V(5).Error(err, "Transaction cannot remove transaction record %s", record.GetName())
+		return
+	}
+	for _, change := range written {
+		previous, err := previousObject(change.obj)
+		if err == nil {
+			_, err = cs.write(change.res, change.obj, previous)
+		}
+		if err != nil {
+			klog.V(5).Error(err, "Transaction cannot roll back %s %s", change.res.Resource, change.name)
+		}
+	}
+}
+
+func (cs *crdStore) LockVolume(volid string) error {
+	if cs.held == nil {
+		return errLockOutsideTransaction
+	}
+	if hl, found := cs.held[volid]; found {
+		if hl.isLost() {
+			return errVolumeLockLost
+		}
+		return nil
+	}
+
+	holder := uuid.New().String()
+	var resourceVersion string
+	for {
+		var err error
+		resourceVersion, err = cs.tryLock(volid, holder)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errVolumeLocked) {
+			klog.V(5).Error(err, "LockVolume cannot lock volume %s", volid)
+			return err
+		}
+		time.Sleep(crdLockPollInterval)
+	}
+
+	stop := make(chan struct{})
+	renewed := make(chan string)
+	hl := &heldLock{holder: holder}
+	go cs.renewLock(volid, holder, resourceVersion, hl, stop, renewed)
+	cs.held[volid] = hl
+	hl.release = func() {
+		close(stop)
+		// the lock is deleted only at the resource version of the last renewal, a lock which is
+		// taken over meanwhile belongs to the new holder
+		rv := <-renewed
+		err := cs.client.Resource(locksResource).Delete(context.Background(), volid, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &rv}})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.V(5).Error(err, "LockVolume cannot unlock volume %s", volid)
+		}
+	}
+	return nil
+}
+
+// tryLock returns the resource version of the created lock.
+func (cs *crdStore) tryLock(volid, holder string) (string, error) {
+	specMap, err := toUnstructuredField(&crdLockSpec{Holder: holder, RenewTime: time.Now(), DurationSeconds: int64(crdLockDuration / time.Second)})
+	if err != nil {
+		return "", err
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": specMap}}
+	obj.SetAPIVersion(crdGroupVersion.String())
+	obj.SetKind(crdKindLock)
+	obj.SetName(volid)
+	created, err := cs.client.Resource(locksResource).Create(context.Background(), obj, metav1.CreateOptions{})
+	if err == nil {
+		return created.GetResourceVersion(), nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return "", err
+	}
+
+	current, err := cs.get(locksResource, volid)
+	if errors.Is(err, ErrRecordNotFound) {
+		return "", errVolumeLocked
+	}
+	if err != nil {
+		return "", err
+	}
+	var lock crdLockSpec
+	if err := fromUnstructuredField(current, "spec", &lock); err != nil {
+		return "", err
+	}
+	if time.Since(lock.RenewTime) < time.Duration(lock.DurationSeconds)*time.Second {
+		return "", errVolumeLocked
+	}
+
+	// the precondition keeps a lock which is renewed meanwhile
+	klog.V(5).Infof("LockVolume expired lock of volume %s held by %s is removed", volid, lock.Holder)
+	rv := current.GetResourceVersion()
+	err = cs.client.Resource(locksResource).Delete(context.Background(), volid, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &rv}})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		return "", err
+	}
+	return "", errVolumeLocked
+}
+
+// renewLock renews the lock while the holder still owns it, and sends the resource version of the
+// last renewal after stop is closed.
+func (cs *crdStore) renewLock(volid, holder, resourceVersion string, hl *heldLock, stop chan struct{}, renewed chan string) {
+	ticker := time.NewTicker(crdLockDuration / 3)
+	defer ticker.Stop()
+	lastRenewal := time.Now()
+	for {
+		select {
+		case <-stop:
+			renewed <- resourceVersion
+			return
+		case <-ticker.C:
+		}
+		rv, err := cs.renewLockOnce(volid, holder)
+		if err == nil {
+			resourceVersion = rv
+			lastRenewal = time.Now()
+		}
+		if errors.Is(err, errVolumeLocked) || errors.Is(err, ErrRecordNotFound) {
+			klog.V(5).Infof("LockVolume lock of volume %s is taken over", volid)
+			hl.markLost()
+			<-stop
+			renewed <- resourceVersion
+			return
+		}
+		if err != nil {
+			klog.V(5).Error(err, "LockVolume cannot renew lock of volume %s", volid)
+			if time.Since(lastRenewal) >= crdLockDuration {
+				hl.markLost()
+			}
+		}
+	}
+}
+
+// renewLockOnce renews the lock only when the holder still owns it, and returns the resource version
+// of the renewed lock.
+func (cs *crdStore) renewLockOnce(volid, holder string) (string, error) {
+	var resourceVersion string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := cs.get(locksResource, volid)
+		if err != nil {
+			return err
+		}
+		var lock crdLockSpec
+		if err := fromUnstructuredField(obj, "spec", &lock); err != nil {
+			return err
+		}
+		if lock.Holder != holder {
+			return errVolumeLocked
+		}
+		if err := unstructured.SetNestedField(obj.Object, time.Now().Format(time.RFC3339Nano), "spec", "renewTime"); err != nil {
+			return err
+		}
+		updated, err := cs.client.Resource(locksResource).Update(context.Background(), obj, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		resourceVersion = updated.GetResourceVersion()
+		return nil
+	})
+	return resourceVersion, err
+}
+
+// TryLead keeps the leadership as the lock resource of the controllers, it is created or taken over
+// when it is expired and renewed by its holder. Updates are conditional on the resource version, so
+// only one holder wins a race.
+func (cs *crdStore) TryLead(holder string, duration time.Duration) (bool, error) {
+	specMap, err := toUnstructuredField(&crdLockSpec{Holder: holder, RenewTime: time.Now(), DurationSeconds: int64(duration / time.Second)})
+	if err != nil {
+		return false, err
+	}
+	obj, err := cs.get(locksResource, controllerLeaderLockKey)
+	if errors.Is(err, ErrRecordNotFound) {
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{"spec": specMap}}
+		obj.SetAPIVersion(crdGroupVersion.String())
+		obj.SetKind(crdKindLock)
+		obj.SetName(controllerLeaderLockKey)
+		_, err = cs.client.Resource(locksResource).Create(context.Background(), obj, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	var lock crdLockSpec
+	if err := fromUnstructuredField(obj, "spec", &lock); err != nil {
+		return false, err
+	}
+	if lock.Holder != holder && time.Since(lock.RenewTime) < time.Duration(lock.DurationSeconds)*time.Second {
+		return false, nil
+	}
+	obj.Object["spec"] = specMap
+	_, err = cs.client.Resource(locksResource).Update(context.Background(), obj, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (cs *crdStore) ResignLead(holder string) error {
+	obj, err := cs.get(locksResource, controllerLeaderLockKey)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var lock crdLockSpec
+	if err := fromUnstructuredField(obj, "spec", &lock); err != nil || lock.Holder != holder {
+		return err
+	}
+	rv := obj.GetResourceVersion()
+	err = cs.client.Resource(locksResource).Delete(context.Background(), controllerLeaderLockKey, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &rv}})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+func (cs *crdStore) Close() error {
+	return nil
+}
+
+// toUnstructuredField converts the record through json, so unsigned fields become int64 values
+// which unstructured objects can hold.
+func toUnstructuredField(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func fromUnstructuredField(obj *unstructured.Unstructured, field string, v interface{}) error {
+	m, found, err := unstructured.NestedMap(obj.Object, field)
+	if err != nil || !found {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// get returns the resource as the transaction of the store sees it.
+func (cs *crdStore) get(res schema.GroupVersionResource, name string) (*unstructured.Unstructured, error) {
+	if change := cs.pendingChange(res, name); change != nil {
+		if change.obj == nil {
+			return nil, ErrRecordNotFound
+		}
+		return change.obj.DeepCopy(), nil
+	}
+	obj, err := cs.client.Resource(res).Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrRecordNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj, err = cs.visible(res, obj)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, ErrRecordNotFound
+	}
+	return obj, nil
+}
+
+func (cs *crdStore) list(res schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
+	objs, err := cs.client.Resource(res).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var items []unstructured.Unstructured
+	for i := range objs.Items {
+		if cs.pendingChange(res, objs.Items[i].GetName()) != nil {
+			continue
+		}
+		obj, err := cs.visible(res, &objs.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		if obj != nil {
+			items = append(items, *obj)
+		}
+	}
+	if cs.changes != nil {
+		for _, change := range *cs.changes {
+			if change.res == res && change.obj != nil {
+				items = append(items, *change.obj.DeepCopy())
+			}
+		}
+	}
+	return items, nil
+}
+
+func (cs *crdStore) pendingChange(res schema.GroupVersionResource, name string) *crdChange {
+	if cs.changes == nil {
+		return nil
+	}
+	for _, change := range *cs.changes {
+		if change.res == res && change.name == name {
+			return change
+		}
+	}
+	return nil
+}
+
+// visible returns the resource as the readers see it, the resources of a transaction show their new
+// content only after the transaction is committed. nil is returned for a resource which does not
+// exist for the readers.
+func (cs *crdStore) visible(res schema.GroupVersionResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	for {
+		txid := obj.GetAnnotations()[crdTransactionAnnotation]
+		if txid == "" {
+			return obj, nil
+		}
+		record, err := cs.getTransaction(txid)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			if record.Phase == crdTransactionCommitted {
+				return committedObject(obj), nil
+			}
+			return previousObject(obj)
+		}
+		// the record is removed either after the resource is finalized or when the transaction is
+		// aborted, the resource is read again to tell them apart
+		current, err := cs.client.Resource(res).Get(context.Background(), obj.GetName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if current.GetAnnotations()[crdTransactionAnnotation] == txid {
+			return previousObject(current)
+		}
+		obj = current
+	}
+}
+
+// getTransaction returns nil when the transaction record does not exist.
+func (cs *crdStore) getTransaction(txid string) (*crdTransactionSpec, error) {
+	obj, err := cs.client.Resource(transactionsResource).Get(context.Background(), txid, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record crdTransactionSpec
+	if err := fromUnstructuredField(obj, "spec", &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// current returns the stored resource for a change, or nil when it does not exist. The pending
+// transaction of the resource is settled before: the changes of a committed transaction are finalized,
+// the changes of an aborted or abandoned one are rolled back and a running one is waited for.
+func (cs *crdStore) current(res schema.GroupVersionResource, name string) (*unstructured.Unstructured, error) {
+	for {
+		obj, err := cs.client.Resource(res).Get(context.Background(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		txid := obj.GetAnnotations()[crdTransactionAnnotation]
+		if txid == "" {
+			return obj, nil
+		}
+		record, err := cs.client.Resource(transactionsResource).Get(context.Background(), txid, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		var spec crdTransactionSpec
+		if err == nil {
+			if err := fromUnstructuredField(record, "spec", &spec); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case err == nil && spec.Phase == crdTransactionCommitted:
+			return cs.write(res, obj, committedObject(obj))
+		case err == nil && time.Since(spec.StartTime) < crdLockDuration:
+			time.Sleep(crdLockPollInterval)
+			continue
+		case err == nil:
+			// removing the record of the abandoned transaction keeps it from being committed
+			klog.V(5).Infof("Transaction abandoned transaction %s is aborted", txid)
+			rv := record.GetResourceVersion()
+			err := cs.client.Resource(transactionsResource).Delete(context.Background(), txid, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &rv}})
+			if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+				return nil, err
+			}
+			continue
+		}
+		previous, err := previousObject(obj)
+		if err != nil {
+			return nil, err
+		}
+		return cs.write(res, obj, previous)
+	}
+}
+
+// write replaces the stored resource current with target at the resource version of current, nil
+// objects are resources which do not exist.
+func (cs *crdStore) write(res schema.GroupVersionResource, current, target *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	switch {
+	case current == nil && target == nil:
+		return nil, nil
+	case current == nil:
+		created, err := cs.client.Resource(res).Create(context.Background(), target, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("%s %s already exists", target.GetKind(), target.GetName())
+		}
+		return created, err
+	case target == nil:
+		rv := current.GetResourceVersion()
+		err := cs.client.Resource(res).Delete(context.Background(), current.GetName(), metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &rv}})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	target.SetResourceVersion(current.GetResourceVersion())
+	return cs.client.Resource(res).Update(context.Background(), target, metav1.UpdateOptions{})
+}
+
+func applyOps(current *unstructured.Unstructured, ops []crdOp) (*unstructured.Unstructured, error) {
+	obj := current
+	if obj != nil {
+		obj = obj.DeepCopy()
+	}
+	for _, op := range ops {
+		var err error
+		if obj, err = op(obj); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// pendingObject returns the target of a change as a resource of the transaction, which keeps the spec
+// and the status of current at an annotation. A removed resource keeps its content and is marked.
+func pendingObject(txid string, current, target *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if current == nil && target == nil {
+		return nil, nil
+	}
+	previous := ""
+	if current != nil {
+		fields := map[string]interface{}{}
+		for _, field := range []string{"spec", "status"} {
+			if value, found := current.Object[field]; found {
+				fields[field] = value
+			}
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		previous = string(data)
+	}
+	annotations := map[string]string{crdTransactionAnnotation: txid, crdPreviousAnnotation: previous}
+	pending := target
+	if pending == nil {
+		pending = current
+		annotations[crdDeletedAnnotation] = "true"
+	}
+	pending = pending.DeepCopy()
+	for key, value := range pending.GetAnnotations() {
+		if _, found := annotations[key]; !found {
+			annotations[key] = value
+		}
+	}
+	pending.SetAnnotations(annotations)
+	return pending, nil
+}
+
+// committedObject returns the resource of a committed transaction without the transaction annotations,
+// or nil when it is removed by the transaction.
+func committedObject(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	if obj.GetAnnotations()[crdDeletedAnnotation] == "true" {
+		return nil
+	}
+	return withoutTransaction(obj)
+}
+
+// previousObject returns the resource before the transaction, or nil when it is created by the
+// transaction.
+func previousObject(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	data := obj.GetAnnotations()[crdPreviousAnnotation]
+	if data == "" {
+		return nil, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return nil, err
+	}
+	previous := withoutTransaction(obj)
+	for _, field := range []string{"spec", "status"} {
+		if value, found := fields[field]; found {
+			previous.Object[field] = value
+		} else {
+			delete(previous.Object, field)
+		}
+	}
+	return previous, nil
+}
+
+func withoutTransaction(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	obj = obj.DeepCopy()
+	annotations := obj.GetAnnotations()
+	delete(annotations, crdTransactionAnnotation)
+	delete(annotations, crdPreviousAnnotation)
+	delete(annotations, crdDeletedAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+// change applies op to the resource at once, or inside a transaction checks it against the object as
+// the transaction sees it and keeps it until the transaction is committed.
+func (cs *crdStore) change(res schema.GroupVersionResource, name string, op crdOp) error {
+	if cs.changes == nil {
+		return cs.apply(res, name, []crdOp{op})
+	}
+	change := cs.pendingChange(res, name)
+	if change == nil {
+		obj, err := cs.get(res, name)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		change = &crdChange{res: res, name: name, obj: obj}
+		obj, err = applyOps(change.obj, []crdOp{op})
+		if err != nil {
+			return err
+		}
+		change.obj = obj
+		change.ops = append(change.ops, op)
+		*cs.changes = append(*cs.changes, change)
+		return nil
+	}
+	obj, err := applyOps(change.obj, []crdOp{op})
+	if err != nil {
+		return err
+	}
+	change.obj = obj
+	change.ops = append(change.ops, op)
+	return nil
+}
+
+// apply applies the operations to the current resource, they are applied again on conflicts.
+func (cs *crdStore) apply(res schema.GroupVersionResource, name string, ops []crdOp) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := cs.current(res, name)
+		if err != nil {
+			return err
+		}
+		target, err := applyOps(current, ops)
+		if err != nil {
+			return err
+		}
+		_, err = cs.write(res, current, target)
+		return err
+	})
+}
+
+func (cs *crdStore) create(res schema.GroupVersionResource, kind, name string, spec interface{}) error {
+	specMap, err := toUnstructuredField(spec)
+	if err != nil {
+		return err
+	}
+	return cs.change(res, name, func(current *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		if current != nil {
+			return nil, fmt.Errorf("%s %s already exists", kind, name)
+		}
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": runtime.DeepCopyJSON(specMap)}}
+		obj.SetAPIVersion(crdGroupVersion.String())
+		obj.SetKind(kind)
+		obj.SetName(name)
+		return obj, nil
+	})
+}
+
+func (cs *crdStore) modify(res schema.GroupVersionResource, name string, fn func(obj *unstructured.Unstructured) error) error {
+	return cs.change(res, name, func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		if obj == nil {
+			return nil, ErrRecordNotFound
+		}
+		if err := fn(obj); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	})
+}
+
+func (cs *crdStore) delete(res schema.GroupVersionResource, name string) error {
+	return cs.change(res, name, func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return nil, nil
+	})
+}
+
+func (cs *crdStore) findVolumes(filter func(vol *Volume) bool) ([]Volume, error) {
+	objs, err := cs.list(volumesResource)
+	if err != nil {
+		return nil, err
+	}
+	var vols []Volume
+	for i := range objs {
+		var vol Volume
+		if err := fromUnstructuredField(&objs[i], "spec", &vol); err != nil {
+			return nil, err
+		}
+		if filter(&vol) {
+			vols = append(vols, vol)
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].StorageID < vols[j].StorageID })
+	return vols, nil
+}
+
+func (cs *crdStore) modifyVolume(volid string, fn func(vol *Volume, status *crdVolumeStatus) error) error {
+	return cs.modify(volumesResource, volid, func(obj *unstructured.Unstructured) error {
+		var vol Volume
+		var status crdVolumeStatus
+		if err := fromUnstructuredField(obj, "spec", &vol); err != nil {
+			return err
+		}
+		if vol.DeletedAt.Valid {
+			return ErrRecordNotFound
+		}
+		if err := fromUnstructuredField(obj, "status", &status); err != nil {
+			return err
+		}
+		if err := fn(&vol, &status); err != nil {
+			return err
+		}
+		vol.UpdatedAt = time.Now()
+		spec, err := toUnstructuredField(&vol)
+		if err != nil {
+			return err
+		}
+		statusMap, err := toUnstructuredField(&status)
+		if err != nil {
+			return err
+		}
+		obj.Object["spec"] = spec
+		obj.Object["status"] = statusMap
+		return nil
+	})
+}
+
+func (cs *crdStore) getVolumeStatus(volid string) (*crdVolumeStatus, error) {
+	obj, err := cs.get(volumesResource, volid)
+	if err != nil {
+		return nil, err
+	}
+	var status crdVolumeStatus
+	if err := fromUnstructuredField(obj, "status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (cs *crdStore) CreateVolume(vol *Volume) error {
+	vol.StorageID = time.Now().UnixNano()
+	vol.CreatedAt = time.Now()
+	vol.UpdatedAt = vol.CreatedAt
+	if vol.Pool == "" {
+		vol.Pool = defaultPool
+	}
+	return cs.create(volumesResource, crdKindVolume, vol.VolID, vol)
+}
+
+func (cs *crdStore) GetVolume(volid string) (*Volume, error) {
+	obj, err := cs.get(volumesResource, volid)
+	if err != nil {
+		return nil, err
+	}
+	var vol Volume
+	if err := fromUnstructuredField(obj, "spec", &vol); err != nil {
+		return nil, err
+	}
+	if vol.DeletedAt.Valid {
+		return nil, ErrRecordNotFound
+	}
+	return &vol, nil
+}
+
+func (cs *crdStore) GetVolumeByName(volname string) (*Volume, error) {
+	vols, err := cs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid && vol.VolName == volname
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(vols) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &vols[0], nil
+}
+
+func (cs *crdStore) GetVolumes(offset, limit int) ([]Volume, error) {
+	vols, err := cs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid
+	})
+	if err != nil {
+		return nil, err
+	}
+	start, end := paginate(len(vols), offset, limit)
+	return vols[start:end], nil
+}
+
+func (cs *crdStore) GetVolumeCount() (int, error) {
+	vols, err := cs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid
+	})
+	return len(vols), err
+}
+
+func (cs *crdStore) GetPoolVolumes(pool string) ([]Volume, error) {
+	return cs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid && vol.Pool == pool
+	})
+}
+
+func (cs *crdStore) GetDeletedPoolVolumes(pool string) ([]Volume, error) {
+	return cs.findVolumes(func(vol *Volume) bool {
+		return vol.DeletedAt.Valid && vol.Pool == pool
+	})
+}
+
+func (cs *crdStore) HasVolumeAtPath(path string) (bool, error) {
+	vols, err := cs.findVolumes(func(vol *Volume) bool {
+		return !vol.DeletedAt.Valid && vol.VolPath == path
+	})
+	return len(vols) != 0, err
+}
+
+func (cs *crdStore) UpdateVolumeCapacity(volid string, capacity int64) error {
+	return cs.modifyVolume(volid, func(vol *Volume, status *crdVolumeStatus) error {
+		vol.Capacity = capacity
+		return nil
+	})
+}
+
+func (cs *crdStore) UpdateVolumeProjectID(volid string, projectID uint32) error {
+	return cs.modifyVolume(volid, func(vol *Volume, status *crdVolumeStatus) error {
+		vol.ProjectID = projectID
+		return nil
+	})
+}
+
+func (cs *crdStore) UpdateVolumeCondition(volid string, condition VolumeCondition) error {
+	return cs.modifyVolume(volid, func(vol *Volume, status *crdVolumeStatus) error {
+		vol.VolumeCondition = condition
+		return nil
+	})
+}
+
+func (cs *crdStore) UpdateVolumeLease(volid string, lease VolumeLease) error {
+	return cs.modifyVolume(volid, func(vol *Volume, status *crdVolumeStatus) error {
+		vol.VolumeLease = lease
+		return nil
+	})
+}
+
+func (cs *crdStore) RenewVolumeLease(volid, nodeId string, expiresAt time.Time) error {
+	// updates are conditional on the resource version, the holder is checked again on conflicts
+	return cs.modifyVolume(volid, func(vol *Volume, status *crdVolumeStatus) error {
+		if vol.VolumeLease.NodeID != nodeId {
+			return ErrRecordNotFound
+		}
+		vol.VolumeLease.ExpiresAt = expiresAt
+		return nil
+	})
+}
+
+func (cs *crdStore) GetMaxProjectID() (uint32, error) {
+	var maxProjectID uint32
+	_, err := cs.findVolumes(func(vol *Volume) bool {
+		if vol.ProjectID > maxProjectID {
+			maxProjectID = vol.ProjectID
+		}
+		return false
+	})
+	return maxProjectID, err
+}
+
+func (cs *crdStore) DeleteVolume(volid string) error {
+	err := cs.modifyVolume(volid, func(vol *Volume, status *crdVolumeStatus) error {
+		// volumes are soft deleted like gorm does, dangling volume cleanup needs them
+		vol.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+		return nil
+	})
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (cs *crdStore) UpdateNodeInfoLastSeen(nodeId string, lastSeen time.Time) error {
+	ni := &NodeInfo{ID: nodeId, LastSeen: lastSeen}
+	err := cs.modify(nodesResource, nodeId, func(obj *unstructured.Unstructured) error {
+		spec, err := toUnstructuredField(ni)
+		if err != nil {
+			return err
+		}
+		obj.Object["spec"] = spec
+		return nil
+	})
+	if errors.Is(err, ErrRecordNotFound) {
+		err = cs.create(nodesResource, crdKindNode, nodeId, ni)
+	}
+	return err
+}
+
+func (cs *crdStore) GetNodeInfo(nodeId string, minLastSeen time.Time) (*NodeInfo, error) {
+	obj, err := cs.get(nodesResource, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	var ni NodeInfo
+	if err := fromUnstructuredField(obj, "spec", &ni); err != nil {
+		return nil, err
+	}
+	if ni.LastSeen.Before(minLastSeen) {
+		return nil, ErrRecordNotFound
+	}
+	return &ni, nil
+}
+
+func (cs *crdStore) GetNodeInfos() ([]NodeInfo, error) {
+	objs, err := cs.list(nodesResource)
+	if err != nil {
+		return nil, err
+	}
+	var nis []NodeInfo
+	for i := range objs {
+		var ni NodeInfo
+		if err := fromUnstructuredField(&objs[i], "spec", &ni); err != nil {
+			return nil, err
+		}
+		nis = append(nis, ni)
+	}
+	sort.Slice(nis, func(i, j int) bool { return nis[i].ID < nis[j].ID })
+	return nis, nil
+}
+
+func (cs *crdStore) MarkNodeDead(nodeId string, deadline time.Time) error {
+	return cs.modify(nodesResource, nodeId, func(obj *unstructured.Unstructured) error {
+		var ni NodeInfo
+		if err := fromUnstructuredField(obj, "spec", &ni); err != nil {
+			return err
+		}
+		if !ni.LastSeen.Before(deadline) {
+			return ErrRecordNotFound
+		}
+		ni.Dead = true
+		spec, err := toUnstructuredField(&ni)
+		if err != nil {
+			return err
+		}
+		obj.Object["spec"] = spec
+		return nil
+	})
+}
+
+func (cs *crdStore) CreateControllerPublishVolumeInfo(cpvi *ControllerPublishVolumeInfo) error {
+	return cs.modifyVolume(cpvi.VolID, func(vol *Volume, status *crdVolumeStatus) error {
+		cpvi.StorageID = time.Now().UnixNano()
+		cpvi.CreatedAt = time.Now()
+		cpvi.UpdatedAt = cpvi.CreatedAt
+		var cpvis []ControllerPublishVolumeInfo
+		for _, item := range status.ControllerPublishVolumeInfos {
+			if item.NodeID != cpvi.NodeID {
+				cpvis = append(cpvis, item)
+			}
+		}
+		status.ControllerPublishVolumeInfos = append(cpvis, *cpvi)
+		return nil
+	})
+}
+
+func (cs *crdStore) GetControllerPublishVolumeInfo(volId, nodeId string) (*ControllerPublishVolumeInfo, error) {
+	cpvis, err := cs.GetControllerPublishVolumeInfos(volId)
+	if err != nil {
+		return nil, err
+	}
+	for _, cpvi := range cpvis {
+		if cpvi.NodeID == nodeId {
+			return &cpvi, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (cs *crdStore) GetControllerPublishVolumeInfos(volId string) ([]ControllerPublishVolumeInfo, error) {
+	status, err := cs.getVolumeStatus(volId)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status.ControllerPublishVolumeInfos, nil
+}
+
+func (cs *crdStore) GetNodeControllerPublishVolumeInfos(nodeId string) ([]ControllerPublishVolumeInfo, error) {
+	objs, err := cs.list(volumesResource)
+	if err != nil {
+		return nil, err
+	}
+	var cpvis []ControllerPublishVolumeInfo
+	for i := range objs {
+		var status crdVolumeStatus
+		if err := fromUnstructuredField(&objs[i], "status", &status); err != nil {
+			return nil, err
+		}
+		for _, cpvi := range status.ControllerPublishVolumeInfos {
+			if cpvi.NodeID == nodeId {
+				cpvis = append(cpvis, cpvi)
+			}
+		}
+	}
+	return cpvis, nil
+}
+
+func (cs *crdStore) DeleteControllerPublishVolumeInfo(volId, nodeId string) error {
+	err := cs.modifyVolume(volId, func(vol *Volume, status *crdVolumeStatus) error {
+		var cpvis []ControllerPublishVolumeInfo
+		for _, item := range status.ControllerPublishVolumeInfos {
+			if item.NodeID != nodeId {
+				cpvis = append(cpvis, item)
+			}
+		}
+		status.ControllerPublishVolumeInfos = cpvis
+		return nil
+	})
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (cs *crdStore) CreateNodePublishVolumeInfo(npvi *NodePublishVolumeInfo) error {
+	return cs.modifyVolume(npvi.VolID, func(vol *Volume, status *crdVolumeStatus) error {
+		npvi.StorageID = time.Now().UnixNano()
+		npvi.CreatedAt = time.Now()
+		npvi.UpdatedAt = npvi.CreatedAt
+		var npvis []NodePublishVolumeInfo
+		for _, item := range status.NodePublishVolumeInfos {
+			if item.NodeID != npvi.NodeID || item.MountPath != npvi.MountPath {
+				npvis = append(npvis, item)
+			}
+		}
+		status.NodePublishVolumeInfos = append(npvis, *npvi)
+		return nil
+	})
+}
+
+func (cs *crdStore) GetNodePublishVolumeInfo(volId, nodeId, mountPath string) (*NodePublishVolumeInfo, error) {
+	npvis, err := cs.GetNodePublishVolumeInfos(volId, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	for _, npvi := range npvis {
+		if npvi.MountPath == mountPath {
+			return &npvi, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (cs *crdStore) GetNodePublishVolumeInfos(volId, nodeId string) ([]NodePublishVolumeInfo, error) {
+	status, err := cs.getVolumeStatus(volId)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var npvis []NodePublishVolumeInfo
+	for _, npvi := range status.NodePublishVolumeInfos {
+		if nodeId == "" || npvi.NodeID == nodeId {
+			npvis = append(npvis, npvi)
+		}
+	}
+	return npvis, nil
+}
+
+func (cs *crdStore) DeleteNodePublishVolumeInfo(volId, nodeId, mountPath string) error {
+	err := cs.modifyVolume(volId, func(vol *Volume, status *crdVolumeStatus) error {
+		var npvis []NodePublishVolumeInfo
+		for _, item := range status.NodePublishVolumeInfos {
+			if item.NodeID != nodeId || item.MountPath != mountPath {
+				npvis = append(npvis, item)
+			}
+		}
+		status.NodePublishVolumeInfos = npvis
+		return nil
+	})
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (cs *crdStore) findSnapshots(filter func(snap *Snapshot) bool) ([]Snapshot, error) {
+	objs, err := cs.list(snapshotsResource)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	for i := range objs {
+		var snap Snapshot
+		if err := fromUnstructuredField(&objs[i], "spec", &snap); err != nil {
+			return nil, err
+		}
+		if filter(&snap) {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].StorageID < snaps[j].StorageID })
+	return snaps, nil
+}
+
+func (cs *crdStore) CreateSnapshot(snap *Snapshot) error {
+	snap.StorageID = time.Now().UnixNano()
+	snap.CreatedAt = time.Now()
+	snap.UpdatedAt = snap.CreatedAt
+	if snap.Pool == "" {
+		snap.Pool = defaultPool
+	}
+	return cs.create(snapshotsResource, crdKindSnapshot, snap.SnapID, snap)
+}
+
+func (cs *crdStore) UpdateSnapshot(snap *Snapshot) error {
+	return cs.modify(snapshotsResource, snap.SnapID, func(obj *unstructured.Unstructured) error {
+		var stored Snapshot
+		if err := fromUnstructuredField(obj, "spec", &stored); err != nil {
+			return err
+		}
+		stored.ReadyToUse = snap.ReadyToUse
+		stored.CopyMethod = snap.CopyMethod
+		stored.AllocatedSize = snap.AllocatedSize
+		stored.UpdatedAt = time.Now()
+		spec, err := toUnstructuredField(&stored)
+		if err != nil {
+			return err
+		}
+		obj.Object["spec"] = spec
+		return nil
+	})
+}
+
+func (cs *crdStore) GetSnapshot(snapid string) (*Snapshot, error) {
+	obj, err := cs.get(snapshotsResource, snapid)
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := fromUnstructuredField(obj, "spec", &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (cs *crdStore) GetSnapshotByName(snapname string) (*Snapshot, error) {
+	snaps, err := cs.findSnapshots(func(snap *Snapshot) bool {
+		return snap.SnapName == snapname
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &snaps[0], nil
+}
+
+func (cs *crdStore) GetSnapshots(snapid, srcvolid string, offset, limit int) ([]Snapshot, error) {
+	snaps, err := cs.findSnapshots(snapshotFilter(snapid, srcvolid))
+	if err != nil {
+		return nil, err
+	}
+	start, end := paginate(len(snaps), offset, limit)
+	return snaps[start:end], nil
+}
+
+func (cs *crdStore) GetSnapshotCount(snapid, srcvolid string) (int, error) {
+	snaps, err := cs.findSnapshots(snapshotFilter(snapid, srcvolid))
+	return len(snaps), err
+}
+
+func (cs *crdStore) DeleteSnapshot(snapid string) error {
+	return cs.delete(snapshotsResource, snapid)
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"time"
+)
+
+// metricsStore observes the latency of each query of the wrapped metadata store.
+type metricsStore struct {
+	store MetadataStore
+}
+
+func newMetricsStore(store MetadataStore) MetadataStore {
+	return &metricsStore{store: store}
+}
+
+func (ms *metricsStore) Transaction(fn func(store MetadataStore) error) error {
+	defer observeMetadataQuery("Transaction", time.Now())
+	return ms.store.Transaction(func(store MetadataStore) error {
+		return fn(&metricsStore{store: store})
+	})
+}
+
+func (ms *metricsStore) LockVolume(volid string) error {
+	defer observeMetadataQuery("LockVolume", time.Now())
+	return ms.store.LockVolume(volid)
+}
+
+func (ms *metricsStore) TryLead(holder string, duration time.Duration) (bool, error) {
+	defer observeMetadataQuery("TryLead", time.Now())
+	return ms.store.TryLead(holder, duration)
+}
+
+func (ms *metricsStore) ResignLead(holder string) error {
+	defer observeMetadataQuery("ResignLead", time.Now())
+	return ms.store.ResignLead(holder)
+}
+
+func (ms *metricsStore) Close() error {
+	return ms.store.Close()
+}
+
+func (ms *metricsStore) CreateVolume(vol *Volume) error {
+	defer observeMetadataQuery("CreateVolume", time.Now())
+	return ms.store.CreateVolume(vol)
+}
+
+func (ms *metricsStore) GetVolume(volid string) (*Volume, error) {
+	defer observeMetadataQuery("GetVolume", time.Now())
+	return ms.store.GetVolume(volid)
+}
+
+func (ms *metricsStore) GetVolumeByName(volname string) (*Volume, error) {
+	defer observeMetadataQuery("GetVolumeByName", time.Now())
+	return ms.store.GetVolumeByName(volname)
+}
+
+func (ms *metricsStore) GetVolumes(offset, limit int) ([]Volume, error) {
+	defer observeMetadataQuery("GetVolumes", time.Now())
+	return ms.store.GetVolumes(offset, limit)
+}
+
+func (ms *metricsStore) GetVolumeCount() (int, error) {
+	defer observeMetadataQuery("GetVolumeCount", time.Now())
+	return ms.store.GetVolumeCount()
+}
+
+func (ms *metricsStore) GetPoolVolumes(pool string) ([]Volume, error) {
+	defer observeMetadataQuery("GetPoolVolumes", time.Now())
+	return ms.store.GetPoolVolumes(pool)
+}
+
+func (ms *metricsStore) GetDeletedPoolVolumes(pool string) ([]Volume, error) {
+	defer observeMetadataQuery("GetDeletedPoolVolumes", time.Now())
+	return ms.store.GetDeletedPoolVolumes(pool)
+}
+
+func (ms *metricsStore) HasVolumeAtPath(path string) (bool, error) {
+	defer observeMetadataQuery("HasVolumeAtPath", time.Now())
+	return ms.store.HasVolumeAtPath(path)
+}
+
+func (ms *metricsStore) UpdateVolumeCapacity(volid string, capacity int64) error {
+	defer observeMetadataQuery("UpdateVolumeCapacity", time.Now())
+	return ms.store.UpdateVolumeCapacity(volid, capacity)
+}
+
+func (ms *metricsStore) UpdateVolumeProjectID(volid string, projectID uint32) error {
+	defer observeMetadataQuery("UpdateVolumeProjectID", time.Now())
+	return ms.store.UpdateVolumeProjectID(volid, projectID)
+}
+
+func (ms *metricsStore) UpdateVolumeCondition(volid string, condition VolumeCondition) error {
+	defer observeMetadataQuery("UpdateVolumeCondition", time.Now())
+	return ms.store.UpdateVolumeCondition(volid, condition)
+}
+
+func (ms *metricsStore) UpdateVolumeLease(volid string, lease VolumeLease) error {
+	defer observeMetadataQuery("UpdateVolumeLease", time.Now())
+	return ms.store.UpdateVolumeLease(volid, lease)
+}
+
+func (ms *metricsStore) RenewVolumeLease(volid, nodeId string, expiresAt time.Time) error {
+	defer observeMetadataQuery("RenewVolumeLease", time.Now())
+	return ms.store.RenewVolumeLease(volid, nodeId, expiresAt)
+}
+
+func (ms *metricsStore) GetMaxProjectID() (uint32, error) {
+	defer observeMetadataQuery("GetMaxProjectID", time.Now())
+	return ms.store.GetMaxProjectID()
+}
+
+func (ms *metricsStore) DeleteVolume(volid string) error {
+	defer observeMetadataQuery("DeleteVolume", time.Now())
+	return ms.store.DeleteVolume(volid)
+}
+
+func (ms *metricsStore) UpdateNodeInfoLastSeen(nodeId string, lastSeen time.Time) error {
+	defer observeMetadataQuery("UpdateNodeInfoLastSeen", time.Now())
+	return ms.store.UpdateNodeInfoLastSeen(nodeId, lastSeen)
+}
+
+func (ms *metricsStore) GetNodeInfo(nodeId string, minLastSeen time.Time) (*NodeInfo, error) {
+	defer observeMetadataQuery("GetNodeInfo", time.Now())
+	return ms.store.GetNodeInfo(nodeId, minLastSeen)
+}
+
+func (ms *metricsStore) GetNodeInfos() ([]NodeInfo, error) {
+	defer observeMetadataQuery("GetNodeInfos", time.Now())
+	return ms.store.GetNodeInfos()
+}
+
+func (ms *metricsStore) MarkNodeDead(nodeId string, deadline time.Time) error {
+	defer observeMetadataQuery("MarkNodeDead", time.Now())
+	return ms.store.MarkNodeDead(nodeId, deadline)
+}
+
+func (ms *metricsStore) CreateControllerPublishVolumeInfo(cpvi *ControllerPublishVolumeInfo) error {
+	defer observeMetadataQuery("CreateControllerPublishVolumeInfo", time.Now())
+	return ms.store.CreateControllerPublishVolumeInfo(cpvi)
+}
+
+func (ms *metricsStore) GetControllerPublishVolumeInfo(volId, nodeId string) (*ControllerPublishVolumeInfo, error) {
+	defer observeMetadataQuery("GetControllerPublishVolumeInfo", time.Now())
+	return ms.store.GetControllerPublishVolumeInfo(volId, nodeId)
+}
+
+func (ms *metricsStore) GetControllerPublishVolumeInfos(volId string) ([]ControllerPublishVolumeInfo, error) {
+	defer observeMetadataQuery("GetControllerPublishVolumeInfos", time.Now())
+	return ms.store.GetControllerPublishVolumeInfos(volId)
+}
+
+func (ms *metricsStore) GetNodeControllerPublishVolumeInfos(nodeId string) ([]ControllerPublishVolumeInfo, error) {
+	defer observeMetadataQuery("GetNodeControllerPublishVolumeInfos", time.Now())
+	return ms.store.GetNodeControllerPublishVolumeInfos(nodeId)
+}
+
+func (ms *metricsStore) DeleteControllerPublishVolumeInfo(volId, nodeId string) error {
+	defer observeMetadataQuery("DeleteControllerPublishVolumeInfo", time.Now())
+	return ms.store.DeleteControllerPublishVolumeInfo(volId, nodeId)
+}
+
+func (ms *metricsStore) CreateNodePublishVolumeInfo(npvi *NodePublishVolumeInfo) error {
+	defer observeMetadataQuery("CreateNodePublishVolumeInfo", time.Now())
+	return ms.store.CreateNodePublishVolumeInfo(npvi)
+}
+
+func (ms *metricsStore) GetNodePublishVolumeInfo(volId, nodeId, mountPath string) (*NodePublishVolumeInfo, error) {
+	defer observeMetadataQuery("GetNodePublishVolumeInfo", time.Now())
+	return ms.store.GetNodePublishVolumeInfo(volId, nodeId, mountPath)
+}
+
+func (ms *metricsStore) GetNodePublishVolumeInfos(volId, nodeId string) ([]NodePublishVolumeInfo, error) {
+	defer observeMetadataQuery("GetNodePublishVolumeInfos", time.Now())
+	return ms.store.GetNodePublishVolumeInfos(volId, nodeId)
+}
+
+func (ms *metricsStore) DeleteNodePublishVolumeInfo(volId, nodeId, mountPath string) error {
+	defer observeMetadataQuery("DeleteNodePublishVolumeInfo", time.Now())
+	return ms.store.DeleteNodePublishVolumeInfo(volId, nodeId, mountPath)
+}
+
+func (ms *metricsStore) CreateSnapshot(snap *Snapshot) error {
+	defer observeMetadataQuery("CreateSnapshot", time.Now())
+	return ms.store.CreateSnapshot(snap)
+}
+
+func (ms *metricsStore) UpdateSnapshot(snap *Snapshot) error {
+	defer observeMetadataQuery("UpdateSnapshot", time.Now())
+	return ms.store.UpdateSnapshot(snap)
+}
+
+func (ms *metricsStore) GetSnapshot(snapid string) (*Snapshot, error) {
+	defer observeMetadataQuery("GetSnapshot", time.Now())
+	return ms.store.GetSnapshot(snapid)
+}
+
+func (ms *metricsStore) GetSnapshotByName(snapname string) (*Snapshot, error) {
+	defer observeMetadataQuery("GetSnapshotByName", time.Now())
+	return ms.store.GetSnapshotByName(snapname)
+}
+
+func (ms *metricsStore) GetSnapshots(snapid, srcvolid string, offset, limit int) ([]Snapshot, error) {
+	defer observeMetadataQuery("GetSnapshots", time.Now())
+	return ms.store.GetSnapshots(snapid, srcvolid, offset, limit)
+}
+
+func (ms *metricsStore) GetSnapshotCount(snapid, srcvolid string) (int, error) {
+	defer observeMetadataQuery("GetSnapshotCount", time.Now())
+	return ms.store.GetSnapshotCount(snapid, srcvolid)
+}
+
+func (ms *metricsStore) DeleteSnapshot(snapid string) error {
+	defer observeMetadataQuery("DeleteSnapshot", time.Now())
+	return ms.store.DeleteSnapshot(snapid)
+}
@@ -0,0 +1,380 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"context"
+	"database/sql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"hash/fnv"
+	klog "k8s.io/klog/v2"
+	"sync"
+	"time"
+)
+
+type postgresStore struct {
+	db *gorm.DB
+	// leaderConn is the dedicated connection whose session holds the leadership lock, it is guarded
+	// by leaderLock.
+	leaderLock sync.Mutex
+	leaderConn *sql.Conn
+}
+
+func NewPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		klog.V(5).Error(err, "NewPostgresStore cannot connect to dsn %s", dsn)
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		klog.V(5).Error(err, "NewPostgresStore cannot get db connection")
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(5)
+	klog.V(5).Infof("NewPostgresStore db connection established")
+
+	err = db.AutoMigrate(&Volume{}, &NodeInfo{}, &ControllerPublishVolumeInfo{}, &NodePublishVolumeInfo{}, &Snapshot{})
+	if err != nil {
+		klog.V(5).Error(err, "NewPostgresStore cannot create db schema on dsn %s", dsn)
+		return nil, err
+	}
+	klog.V(5).Info("NewPostgresStore database schema created")
+
+	return &postgresStore{db: db}, nil
+}
+
+func (ps *postgresStore) Transaction(fn func(store MetadataStore) error) error {
+	return ps.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&postgresStore{db: tx})
+	})
+}
+
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// LockVolume takes a transaction level advisory lock keyed by the hash of the volume id.
+func (ps *postgresStore) LockVolume(volid string) error {
+	if _, ok := ps.db.Statement.ConnPool.(gorm.TxCommitter); !ok {
+		return errLockOutsideTransaction
+	}
+	return ps.db.Exec("SELECT pg_advisory_xact_lock(?)", advisoryLockKey(volid)).Error
+}
+
+// TryLead takes a session level advisory lock on a dedicated connection, the lock is held as long as
+// the connection lives, so no transaction is kept open. The holder and the duration are not needed,
+// the server releases the lock when the connection is lost.
+func (ps *postgresStore) TryLead(holder string, duration time.Duration) (bool, error) {
+	ps.leaderLock.Lock()
+	defer ps.leaderLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	if ps.leaderConn != nil {
+		if err := ps.leaderConn.PingContext(ctx); err != nil {
+			klog.V(5).Error(err, "TryLead leadership connection is lost")
+			ps.leaderConn.Close()
+			ps.leaderConn = nil
+			return false, err
+		}
+		return true, nil
+	}
+
+	sqlDB, err := ps.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", advisoryLockKey(controllerLeaderLockKey)).Scan(&locked); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !locked {
+		conn.Close()
+		return false, nil
+	}
+	ps.leaderConn = conn
+	return true, nil
+}
+
+func (ps *postgresStore) ResignLead(holder string) error {
+	ps.leaderLock.Lock()
+	defer ps.leaderLock.Unlock()
+
+	if ps.leaderConn == nil {
+		return nil
+	}
+	conn := ps.leaderConn
+	ps.leaderConn = nil
+	defer conn.Close()
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockKey(controllerLeaderLockKey))
+	return err
+}
+
+func (ps *postgresStore) Close() error {
+	sqlDB, err := ps.db.DB()
+	if err != nil {
+		klog.V(5).Error(err, "Close error occured")
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (ps *postgresStore) CreateVolume(vol *Volume) error {
+	return ps.db.Create(vol).Error
+}
+
+func (ps *postgresStore) GetVolume(volid string) (*Volume, error) {
+	var vol Volume
+	result := ps.db.Where("vol_id = ?", volid).First(&vol)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &vol, nil
+}
+
+func (ps *postgresStore) GetVolumeByName(volname string) (*Volume, error) {
+	var vol Volume
+	result := ps.db.Where("vol_name = ?", volname).First(&vol)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &vol, nil
+}
+
+func (ps *postgresStore) GetVolumes(offset, limit int) ([]Volume, error) {
+	var vols []Volume
+	result := ps.db.Order("storage_id").Offset(offset).Limit(limit).Find(&vols)
+	return vols, result.Error
+}
+
+func (ps *postgresStore) GetVolumeCount() (int, error) {
+	var vc int64
+	result := ps.db.Model(&Volume{}).Count(&vc)
+	return int(vc), result.Error
+}
+
+func (ps *postgresStore) GetPoolVolumes(pool string) ([]Volume, error) {
+	var vols []Volume
+	result := ps.db.Where("pool = ?", pool).Find(&vols)
+	return vols, result.Error
+}
+
+func (ps *postgresStore) GetDeletedPoolVolumes(pool string) ([]Volume, error) {
+	var vols []Volume
+	result := ps.db.Unscoped().Where("deleted_at is not null and pool = ?", pool).Find(&vols)
+	return vols, result.Error
+}
+
+func (ps *postgresStore) HasVolumeAtPath(path string) (bool, error) {
+	var vols []Volume
+	result := ps.db.Where("vol_path = ?", path).Find(&vols)
+	return result.RowsAffected != 0, result.Error
+}
+
+func (ps *postgresStore) UpdateVolumeCapacity(volid string, capacity int64) error {
+	return ps.db.Model(&Volume{}).Where("vol_id = ?", volid).Update("capacity", capacity).Error
+}
+
+func (ps *postgresStore) UpdateVolumeProjectID(volid string, projectID uint32) error {
+	return ps.db.Model(&Volume{}).Where("vol_id = ?", volid).Update("project_id", projectID).Error
+}
+
+func (ps *postgresStore) UpdateVolumeCondition(volid string, condition VolumeCondition) error {
+	return ps.db.Model(&Volume{}).Where("vol_id = ?", volid).Update("volume_condition", condition).Error
+}
+
+func (ps *postgresStore) UpdateVolumeLease(volid string, lease VolumeLease) error {
+	return ps.db.Model(&Volume{}).Where("vol_id = ?", volid).Update("volume_lease", lease).Error
+}
+
+func (ps *postgresStore) RenewVolumeLease(volid, nodeId string, expiresAt time.Time) error {
+	res := ps.db.Model(&Volume{}).Where("vol_id = ? and volume_lease::json->>'nodeId' = ?", volid, nodeId).
+		Update("volume_lease", VolumeLease{NodeID: nodeId, ExpiresAt: expiresAt})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (ps *postgresStore) GetMaxProjectID() (uint32, error) {
+	var maxProjectID uint32
+	err := ps.db.Unscoped().Model(&Volume{}).Select("coalesce(max(project_id), 0)").Scan(&maxProjectID).Error
+	return maxProjectID, err
+}
+
+func (ps *postgresStore) DeleteVolume(volid string) error {
+	return ps.db.Where("vol_id = ?", volid).Delete(&Volume{}).Error
+}
+
+func (ps *postgresStore) UpdateNodeInfoLastSeen(nodeId string, lastSeen time.Time) error {
+	return ps.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_seen", "dead"}),
+	}).Create(&NodeInfo{ID: nodeId, LastSeen: lastSeen}).Error
+}
+
+func (ps *postgresStore) GetNodeInfo(nodeId string, minLastSeen time.Time) (*NodeInfo, error) {
+	var ni NodeInfo
+	result := ps.db.Where("id = ? and last_seen >= ?", nodeId, minLastSeen).First(&ni)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &ni, nil
+}
+
+func (ps *postgresStore) GetNodeInfos() ([]NodeInfo, error) {
+	var nis []NodeInfo
+	err := ps.db.Order("id").Find(&nis).Error
+	return nis, err
+}
+
+func (ps *postgresStore) MarkNodeDead(nodeId string, deadline time.Time) error {
+	result := ps.db.Model(&NodeInfo{}).Where("id = ? and last_seen < ?", nodeId, deadline).Update("dead", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (ps *postgresStore) CreateControllerPublishVolumeInfo(cpvi *ControllerPublishVolumeInfo) error {
+	return ps.db.Create(cpvi).Error
+}
+
+func (ps *postgresStore) GetControllerPublishVolumeInfo(volId, nodeId string) (*ControllerPublishVolumeInfo, error) {
+	var cpvi ControllerPublishVolumeInfo
+	result := ps.db.Where("vol_id = ? and node_id = ?", volId, nodeId).First(&cpvi)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &cpvi, nil
+}
+
+func (ps *postgresStore) GetControllerPublishVolumeInfos(volId string) ([]ControllerPublishVolumeInfo, error) {
+	var cpvis []ControllerPublishVolumeInfo
+	result := ps.db.Where("vol_id = ?", volId).Find(&cpvis)
+	return cpvis, result.Error
+}
+
+func (ps *postgresStore) GetNodeControllerPublishVolumeInfos(nodeId string) ([]ControllerPublishVolumeInfo, error) {
+	var cpvis []ControllerPublishVolumeInfo
+	result := ps.db.Where("node_id = ?", nodeId).Find(&cpvis)
+	return cpvis, result.Error
+}
+
+func (ps *postgresStore) DeleteControllerPublishVolumeInfo(volId, nodeId string) error {
+	return ps.db.Where("vol_id = ? and node_id = ?", volId, nodeId).Delete(&ControllerPublishVolumeInfo{}).Error
+}
+
+func (ps *postgresStore) CreateNodePublishVolumeInfo(npvi *NodePublishVolumeInfo) error {
+	return ps.db.Create(npvi).Error
+}
+
+func (ps *postgresStore) GetNodePublishVolumeInfo(volId, nodeId, mountPath string) (*NodePublishVolumeInfo, error) {
+	var npvi NodePublishVolumeInfo
+	result := ps.db.Where("vol_id = ? and node_id = ? and mount_path = ?", volId, nodeId, mountPath).First(&npvi)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &npvi, nil
+}
+
+func (ps *postgresStore) GetNodePublishVolumeInfos(volId, nodeId string) ([]NodePublishVolumeInfo, error) {
+	var npvis []NodePublishVolumeInfo
+	query := ps.db.Where("vol_id = ?", volId)
+	if nodeId != "" {
+		query = query.Where("node_id = ?", nodeId)
+	}
+	result := query.Find(&npvis)
+	return npvis, result.Error
+}
+
+func (ps *postgresStore) DeleteNodePublishVolumeInfo(volId, nodeId, mountPath string) error {
+	return ps.db.Where("vol_id = ? and node_id = ? and mount_path = ?", volId, nodeId, mountPath).Delete(&NodePublishVolumeInfo{}).Error
+}
+
+func (ps *postgresStore) CreateSnapshot(snap *Snapshot) error {
+	return ps.db.Create(snap).Error
+}
+
+func (ps *postgresStore) UpdateSnapshot(snap *Snapshot) error {
+	return ps.db.Model(&Snapshot{}).Where("snap_id = ?", snap.SnapID).Updates(map[string]interface{}{
+		"ready_to_use":   snap.ReadyToUse,
+		"copy_method":    snap.CopyMethod,
+		"allocated_size": snap.AllocatedSize,
+	}).Error
+}
+
+func (ps *postgresStore) GetSnapshot(snapid string) (*Snapshot, error) {
+	var snap Snapshot
+	result := ps.db.Where("snap_id = ?", snapid).First(&snap)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &snap, nil
+}
+
+func (ps *postgresStore) GetSnapshotByName(snapname string) (*Snapshot, error) {
+	var snap Snapshot
+	result := ps.db.Where("snap_name = ?", snapname).First(&snap)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &snap, nil
+}
+
+func (ps *postgresStore) snapshotQuery(snapid, srcvolid string) *gorm.DB {
+	query := ps.db.Model(&Snapshot{})
+	if snapid != "" {
+		query = query.Where("snap_id = ?", snapid)
+	}
+	if srcvolid != "" {
+		query = query.Where("source_vol_id = ?", srcvolid)
+	}
+	return query
+}
+
+func (ps *postgresStore) GetSnapshots(snapid, srcvolid string, offset, limit int) ([]Snapshot, error) {
+	var snaps []Snapshot
+	result := ps.snapshotQuery(snapid, srcvolid).Order("storage_id").Offset(offset).Limit(limit).Find(&snaps)
+	return snaps, result.Error
+}
+
+func (ps *postgresStore) GetSnapshotCount(snapid, srcvolid string) (int, error) {
+	var sc int64
+	result := ps.snapshotQuery(snapid, srcvolid).Count(&sc)
+	return int(sc), result.Error
+}
+
+func (ps *postgresStore) DeleteSnapshot(snapid string) error {
+	return ps.db.Where("snap_id = ?", snapid).Delete(&Snapshot{}).Error
+}
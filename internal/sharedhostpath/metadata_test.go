@@ -0,0 +1,611 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Metadata Store Tests", func() {
+
+	Context("Bolt Store", func() {
+
+		var store MetadataStore
+		var dbRoot string
+
+		BeforeEach(func() {
+			var err error
+			dbRoot = *dataRoot + "-bolt"
+			store, err = NewMetadataStore(boltDSNPrefix, dbRoot)
+			Expect(store, err).ToNot(BeNil(), "cannot create bolt store")
+		})
+
+		AfterEach(func() {
+			Expect(store.Close()).To(BeNil(), "cannot close bolt store")
+			os.RemoveAll(dbRoot)
+		})
+
+		It("database and lock file should be inside data root", func() {
+			Expect(filepath.Join(dbRoot, dbname)).Should(BeAnExistingFile(), "database file should exist")
+			Expect(filepath.Join(dbRoot, dbname+".lock")).Should(BeAnExistingFile(), "lock file should exist")
+		})
+
+		It("volumes should be stored and soft deleted", func() {
+			for _, volid := range []string{"vol-1", "vol-2", "vol-3"} {
+				err := store.CreateVolume(&Volume{VolID: volid, VolName: "name-" + volid, VolPath: "/vols/" + volid, Pool: defaultPool, Capacity: GiB})
+				Expect(err).To(BeNil(), "cannot create volume")
+			}
+			Expect(store.CreateVolume(&Volume{VolID: "vol-1"})).NotTo(BeNil(), "duplicate volume should fail")
+
+			vol, err := store.GetVolumeByName("name-vol-2")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume by name")
+			Expect(vol.VolID).To(Equal("vol-2"))
+
+			Expect(store.UpdateVolumeCapacity("vol-2", 2*GiB)).To(BeNil(), "cannot update capacity")
+			Expect(store.UpdateVolumeProjectID("vol-3", projectIDBase+3)).To(BeNil(), "cannot update project id")
+			vol, err = store.GetVolume("vol-2")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(2 * GiB)))
+
+			vols, err := store.GetVolumes(1, 1)
+			Expect(err).To(BeNil(), "cannot list volumes")
+			Expect(vols).To(HaveLen(1))
+			Expect(vols[0].VolID).To(Equal("vol-2"), "volumes should be ordered by creation")
+
+			Expect(store.DeleteVolume("vol-3")).To(BeNil(), "cannot delete volume")
+			_, err = store.GetVolume("vol-3")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+			vc, err := store.GetVolumeCount()
+			Expect(vc, err).To(Equal(2))
+			deleted, err := store.GetDeletedPoolVolumes(defaultPool)
+			Expect(err).To(BeNil(), "cannot get deleted volumes")
+			Expect(deleted).To(HaveLen(1))
+			found, err := store.HasVolumeAtPath("/vols/vol-3")
+			Expect(found, err).To(BeFalse(), "deleted volume should not be found by path")
+			maxProjectID, err := store.GetMaxProjectID()
+			Expect(maxProjectID, err).To(Equal(uint32(projectIDBase+3)), "deleted volumes should keep project ids")
+		})
+
+		It("volume locks should be valid only inside transactions", func() {
+			Expect(store.LockVolume("vol-1")).Should(MatchError(errLockOutsideTransaction))
+			err := store.Transaction(func(tx MetadataStore) error {
+				return tx.LockVolume("vol-1")
+			})
+			Expect(err).To(BeNil(), "cannot lock volume inside transaction")
+		})
+
+		It("failed transactions should be rolled back", func() {
+			failure := errors.New("failure")
+			err := store.Transaction(func(tx MetadataStore) error {
+				if err := tx.CreateVolume(&Volume{VolID: "vol-tx", VolPath: "/vols/vol-tx"}); err != nil {
+					return err
+				}
+				return failure
+			})
+			Expect(err).Should(MatchError(failure))
+			_, err = store.GetVolume("vol-tx")
+			Expect(err).Should(MatchError(ErrRecordNotFound), "volume should be rolled back")
+
+			Expect(store.CreateVolume(&Volume{VolID: "vol-r", VolPath: "/vols/vol-r", Capacity: GiB})).To(BeNil())
+			err = store.Transaction(func(tx MetadataStore) error {
+				if err := tx.UpdateVolumeCapacity("vol-r", 2*GiB); err != nil {
+					return err
+				}
+				if err := store.UpdateVolumeCondition("vol-r", VolumeCondition{Abnormal: true, Message: "others"}); err != nil {
+					return err
+				}
+				return failure
+			})
+			Expect(err).Should(MatchError(failure))
+			vol, err := store.GetVolume("vol-r")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(GiB)), "changed field should not be written")
+			Expect(vol.VolumeCondition.Abnormal).To(BeTrue(), "fields changed by others should be kept")
+		})
+
+		It("transaction changes should be seen by others only after commit", func() {
+			Expect(store.CreateVolume(&Volume{VolID: "vol-c", VolPath: "/vols/vol-c", Capacity: GiB})).To(BeNil())
+			err := store.Transaction(func(tx MetadataStore) error {
+				if err := tx.CreateVolume(&Volume{VolID: "vol-n", VolName: "name-vol-n", VolPath: "/vols/vol-n"}); err != nil {
+					return err
+				}
+				if err := tx.UpdateVolumeCapacity("vol-c", 2*GiB); err != nil {
+					return err
+				}
+				vol, err := tx.GetVolumeByName("name-vol-n")
+				Expect(vol, err).ToNot(BeNil(), "transaction should see its own volume")
+				vol, err = tx.GetVolume("vol-c")
+				Expect(vol, err).ToNot(BeNil(), "cannot get volume inside transaction")
+				Expect(vol.Capacity).To(Equal(int64(2*GiB)), "transaction should see its own change")
+
+				_, err = store.GetVolume("vol-n")
+				Expect(err).Should(MatchError(ErrRecordNotFound), "others should not see the uncommitted volume")
+				vol, err = store.GetVolume("vol-c")
+				Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+				Expect(vol.Capacity).To(Equal(int64(GiB)), "others should not see the uncommitted change")
+				return store.UpdateVolumeCondition("vol-c", VolumeCondition{Abnormal: true, Message: "others"})
+			})
+			Expect(err).To(BeNil(), "cannot commit transaction")
+
+			_, err = store.GetVolume("vol-n")
+			Expect(err).To(BeNil(), "committed volume should be stored")
+			vol, err := store.GetVolume("vol-c")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(2*GiB)), "committed change should be stored")
+			Expect(vol.VolumeCondition.Abnormal).To(BeTrue(), "changes of others should be kept")
+		})
+
+		It("volume locks should block other transactions but not the database", func() {
+			locked := make(chan struct{})
+			release := make(chan struct{})
+			first := make(chan error)
+			go func() {
+				first <- store.Transaction(func(tx MetadataStore) error {
+					if err := tx.LockVolume("vol-l"); err != nil {
+						return err
+					}
+					Expect(tx.LockVolume("vol-l")).To(BeNil(), "lock should be reentrant inside transaction")
+					close(locked)
+					<-release
+					return nil
+				})
+			}()
+			Eventually(locked).Should(BeClosed())
+
+			Expect(store.UpdateNodeInfoLastSeen("node-1", time.Now())).To(BeNil(), "database should not be locked by the transaction")
+
+			var acquired int32
+			second := make(chan error)
+			go func() {
+				second <- store.Transaction(func(tx MetadataStore) error {
+					err := tx.LockVolume("vol-l")
+					atomic.StoreInt32(&acquired, 1)
+					return err
+				})
+			}()
+			Consistently(func() int32 { return atomic.LoadInt32(&acquired) }, "500ms").Should(BeZero(), "locked volume should not be locked again")
+
+			close(release)
+			Eventually(first).Should(Receive(BeNil()))
+			Eventually(second, "5s").Should(Receive(BeNil()))
+		})
+
+		It("expired volume locks should be taken over", func() {
+			Expect(store.(*boltStore).update(func(tx *bolt.Tx) error {
+				return putRecord(tx.Bucket(locksBucket), "vol-e", &boltLock{Holder: "crashed", RenewTime: time.Now().Add(-2 * boltLockDuration), DurationSeconds: int64(boltLockDuration / time.Second)})
+			})).To(BeNil(), "cannot expire lock")
+
+			done := make(chan error)
+			go func() {
+				done <- store.Transaction(func(tx MetadataStore) error {
+					return tx.LockVolume("vol-e")
+				})
+			}()
+			Eventually(done, "5s").Should(Receive(BeNil()), "expired lock should be taken over")
+		})
+
+		It("file locks should time out", func() {
+			lock, err := lockFile(filepath.Join(dbRoot, dbname+".lock"), true, time.Second)
+			Expect(lock, err).ToNot(BeNil(), "cannot lock file")
+			defer unlockFile(lock)
+			_, err = lockFile(filepath.Join(dbRoot, dbname+".lock"), false, 100*time.Millisecond)
+			Expect(err).ShouldNot(BeNil(), "locked file should not be locked again")
+		})
+
+		It("node and publish infos should be stored", func() {
+			Expect(store.UpdateNodeInfoLastSeen("node-1", time.Now())).To(BeNil(), "cannot update node info")
+			ni, err := store.GetNodeInfo("node-1", time.Now().Add(-time.Minute))
+			Expect(ni, err).ToNot(BeNil(), "cannot get node info")
+			_, err = store.GetNodeInfo("node-1", time.Now().Add(time.Minute))
+			Expect(err).Should(MatchError(ErrRecordNotFound), "old node info should not be found")
+			Expect(store.MarkNodeDead("node-1", time.Now().Add(-time.Minute))).Should(MatchError(ErrRecordNotFound), "node seen after deadline should not be marked dead")
+			Expect(store.MarkNodeDead("node-1", time.Now())).To(BeNil(), "cannot mark node dead")
+			nis, err := store.GetNodeInfos()
+			Expect(err).To(BeNil(), "cannot get node infos")
+			Expect(nis).To(HaveLen(1))
+			Expect(nis[0].Dead).To(BeTrue(), "node should be dead")
+			Expect(store.UpdateNodeInfoLastSeen("node-1", time.Now())).To(BeNil(), "cannot update node info")
+			ni, err = store.GetNodeInfo("node-1", time.Now().Add(-time.Minute))
+			Expect(ni, err).ToNot(BeNil(), "cannot get node info")
+			Expect(ni.Dead).To(BeFalse(), "reporting node should not be dead")
+
+			Expect(store.CreateControllerPublishVolumeInfo(&ControllerPublishVolumeInfo{VolID: "vol-1", NodeID: "node-1"})).To(BeNil())
+			cpvis, err := store.GetControllerPublishVolumeInfos("vol-1")
+			Expect(err).To(BeNil(), "cannot get controller publish infos")
+			Expect(cpvis).To(HaveLen(1))
+			cpvis, err = store.GetNodeControllerPublishVolumeInfos("node-1")
+			Expect(err).To(BeNil(), "cannot get controller publish infos of node")
+			Expect(cpvis).To(HaveLen(1))
+			Expect(store.DeleteControllerPublishVolumeInfo("vol-1", "node-1")).To(BeNil())
+			_, err = store.GetControllerPublishVolumeInfo("vol-1", "node-1")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+
+			Expect(store.CreateNodePublishVolumeInfo(&NodePublishVolumeInfo{VolID: "vol-1", NodeID: "node-1", MountPath: "/mnt/a"})).To(BeNil())
+			Expect(store.CreateNodePublishVolumeInfo(&NodePublishVolumeInfo{VolID: "vol-1", NodeID: "node-1", MountPath: "/mnt/b"})).To(BeNil())
+			npvis, err := store.GetNodePublishVolumeInfos("vol-1", "node-1")
+			Expect(err).To(BeNil(), "cannot get node publish infos")
+			Expect(npvis).To(HaveLen(2))
+			Expect(store.DeleteNodePublishVolumeInfo("vol-1", "node-1", "/mnt/a")).To(BeNil())
+			_, err = store.GetNodePublishVolumeInfo("vol-1", "node-1", "/mnt/a")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+		})
+
+		It("snapshots should be stored", func() {
+			snap := &Snapshot{SnapID: "snap-1", SnapName: "name-snap-1", SourceVolID: "vol-1", SnapPath: "/snaps/snap-1"}
+			Expect(store.CreateSnapshot(snap)).To(BeNil(), "cannot create snapshot")
+			Expect(store.CreateSnapshot(&Snapshot{SnapID: "snap-2", SourceVolID: "vol-2", SnapPath: "/snaps/snap-2"})).To(BeNil())
+
+			snap.ReadyToUse = true
+			snap.CopyMethod = copyMethodSparse
+			Expect(store.UpdateSnapshot(snap)).To(BeNil(), "cannot update snapshot")
+			stored, err := store.GetSnapshotByName("name-snap-1")
+			Expect(stored, err).ToNot(BeNil(), "cannot get snapshot by name")
+			Expect(stored.ReadyToUse).To(BeTrue())
+			Expect(stored.CopyMethod).To(Equal(copyMethodSparse))
+
+			sc, err := store.GetSnapshotCount("", "vol-2")
+			Expect(sc, err).To(Equal(1))
+			snaps, err := store.GetSnapshots("", "", 0, 0)
+			Expect(err).To(BeNil(), "cannot list snapshots")
+			Expect(snaps).To(HaveLen(2))
+
+			Expect(store.DeleteSnapshot("snap-1")).To(BeNil(), "cannot delete snapshot")
+			_, err = store.GetSnapshot("snap-1")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+		})
+	})
+
+	Context("CRD Store", func() {
+
+		var store MetadataStore
+		var client *fake.FakeDynamicClient
+
+		BeforeEach(func() {
+			var err error
+			client = fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				volumesResource:      crdKindVolume + "List",
+				snapshotsResource:    crdKindSnapshot + "List",
+				nodesResource:        crdKindNode + "List",
+				locksResource:        crdKindLock + "List",
+				transactionsResource: crdKindTransaction + "List",
+			})
+			store, err = NewCRDStore(client)
+			Expect(store, err).ToNot(BeNil(), "cannot create crd store")
+		})
+
+		It("volumes should be stored as custom resources", func() {
+			vol := &Volume{VolID: "vol-1", VolName: "name-vol-1", VolPath: "/vols/vol-1", Capacity: GiB, IsBlock: true, OwnerUID: 1000, Mode: 0750}
+			Expect(store.CreateVolume(vol)).To(BeNil(), "cannot create volume")
+			Expect(store.CreateVolume(&Volume{VolID: "vol-1"})).NotTo(BeNil(), "duplicate volume should fail")
+
+			obj, err := client.Resource(volumesResource).Get(context.Background(), "vol-1", metav1.GetOptions{})
+			Expect(obj, err).ToNot(BeNil(), "custom resource should be created")
+			Expect(obj.GetKind()).To(Equal(crdKindVolume))
+			Expect(obj.Object["spec"]).To(HaveKeyWithValue("volumePath", "/vols/vol-1"))
+
+			stored, err := store.GetVolume("vol-1")
+			Expect(stored, err).ToNot(BeNil(), "cannot get volume")
+			Expect(stored.Capacity).To(Equal(int64(GiB)))
+			Expect(stored.IsBlock).To(BeTrue())
+			Expect(stored.OwnerUID).To(Equal(1000))
+			Expect(stored.Mode).To(Equal(uint32(0750)))
+			Expect(stored.Pool).To(Equal(defaultPool))
+
+			Expect(store.UpdateVolumeCapacity("vol-1", 2*GiB)).To(BeNil(), "cannot update capacity")
+			stored, err = store.GetVolumeByName("name-vol-1")
+			Expect(stored, err).ToNot(BeNil(), "cannot get volume by name")
+			Expect(stored.Capacity).To(Equal(int64(2 * GiB)))
+
+			Expect(store.DeleteVolume("vol-1")).To(BeNil(), "cannot delete volume")
+			_, err = store.GetVolume("vol-1")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+			deleted, err := store.GetDeletedPoolVolumes(defaultPool)
+			Expect(err).To(BeNil(), "cannot get deleted volumes")
+			Expect(deleted).To(HaveLen(1))
+		})
+
+		It("publish infos should be stored at volume status", func() {
+			Expect(store.CreateVolume(&Volume{VolID: "vol-2", VolPath: "/vols/vol-2"})).To(BeNil(), "cannot create volume")
+			Expect(store.CreateControllerPublishVolumeInfo(&ControllerPublishVolumeInfo{VolID: "vol-2", NodeID: "node-1", ReadOnly: true})).To(BeNil())
+			Expect(store.CreateNodePublishVolumeInfo(&NodePublishVolumeInfo{VolID: "vol-2", NodeID: "node-1", MountPath: "/mnt/a"})).To(BeNil())
+
+			obj, err := client.Resource(volumesResource).Get(context.Background(), "vol-2", metav1.GetOptions{})
+			Expect(obj, err).ToNot(BeNil(), "custom resource should exist")
+			Expect(obj.Object["status"]).To(HaveKey("controllerPublishVolumeInfos"))
+
+			cpvi, err := store.GetControllerPublishVolumeInfo("vol-2", "node-1")
+			Expect(cpvi, err).ToNot(BeNil(), "cannot get controller publish info")
+			Expect(cpvi.ReadOnly).To(BeTrue())
+			cpvis, err := store.GetNodeControllerPublishVolumeInfos("node-1")
+			Expect(err).To(BeNil(), "cannot get controller publish infos of node")
+			Expect(cpvis).To(HaveLen(1))
+			npvis, err := store.GetNodePublishVolumeInfos("vol-2", "node-1")
+			Expect(err).To(BeNil(), "cannot get node publish infos")
+			Expect(npvis).To(HaveLen(1))
+
+			Expect(store.DeleteNodePublishVolumeInfo("vol-2", "node-1", "/mnt/a")).To(BeNil())
+			_, err = store.GetNodePublishVolumeInfo("vol-2", "node-1", "/mnt/a")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+			Expect(store.DeleteControllerPublishVolumeInfo("vol-2", "node-1")).To(BeNil())
+			_, err = store.GetControllerPublishVolumeInfo("vol-2", "node-1")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+		})
+
+		It("failed transactions should not be written", func() {
+			Expect(store.CreateVolume(&Volume{VolID: "vol-3", VolPath: "/vols/vol-3", Capacity: GiB})).To(BeNil(), "cannot create volume")
+			failure := errors.New("failure")
+			err := store.Transaction(func(tx MetadataStore) error {
+				if err := tx.CreateVolume(&Volume{VolID: "vol-tx", VolPath: "/vols/vol-tx"}); err != nil {
+					return err
+				}
+				if err := tx.UpdateVolumeCapacity("vol-3", 2*GiB); err != nil {
+					return err
+				}
+				if err := store.UpdateVolumeCondition("vol-3", VolumeCondition{Abnormal: true, Message: "others"}); err != nil {
+					return err
+				}
+				return failure
+			})
+			Expect(err).Should(MatchError(failure))
+			_, err = store.GetVolume("vol-tx")
+			Expect(err).Should(MatchError(ErrRecordNotFound), "created volume should be removed")
+			vol, err := store.GetVolume("vol-3")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(GiB)), "capacity should not be changed")
+			Expect(vol.VolumeCondition.Abnormal).To(BeTrue(), "fields changed by others should be kept")
+		})
+
+		It("transaction changes should be seen by others only after commit", func() {
+			Expect(store.CreateVolume(&Volume{VolID: "vol-c", VolPath: "/vols/vol-c", Capacity: GiB})).To(BeNil())
+			err := store.Transaction(func(tx MetadataStore) error {
+				if err := tx.CreateVolume(&Volume{VolID: "vol-n", VolName: "name-vol-n", VolPath: "/vols/vol-n"}); err != nil {
+					return err
+				}
+				if err := tx.UpdateVolumeCapacity("vol-c", 2*GiB); err != nil {
+					return err
+				}
+				vol, err := tx.GetVolumeByName("name-vol-n")
+				Expect(vol, err).ToNot(BeNil(), "transaction should see its own volume")
+				vol, err = tx.GetVolume("vol-c")
+				Expect(vol, err).ToNot(BeNil(), "cannot get volume inside transaction")
+				Expect(vol.Capacity).To(Equal(int64(2*GiB)), "transaction should see its own change")
+
+				_, err = store.GetVolume("vol-n")
+				Expect(err).Should(MatchError(ErrRecordNotFound), "others should not see the uncommitted volume")
+				vol, err = store.GetVolume("vol-c")
+				Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+				Expect(vol.Capacity).To(Equal(int64(GiB)), "others should not see the uncommitted change")
+				return store.UpdateVolumeCondition("vol-c", VolumeCondition{Abnormal: true, Message: "others"})
+			})
+			Expect(err).To(BeNil(), "cannot commit transaction")
+
+			_, err = store.GetVolume("vol-n")
+			Expect(err).To(BeNil(), "committed volume should be stored")
+			vol, err := store.GetVolume("vol-c")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(2*GiB)), "committed change should be stored")
+			Expect(vol.VolumeCondition.Abnormal).To(BeTrue(), "changes of others should be kept")
+		})
+
+		It("resources of a transaction should be seen only after its record is committed", func() {
+			cs := store.(*crdStore)
+			Expect(store.CreateVolume(&Volume{VolID: "vol-p", VolPath: "/vols/vol-p", Capacity: GiB})).To(BeNil(), "cannot create volume")
+			Expect(store.CreateVolume(&Volume{VolID: "vol-f", VolPath: "/vols/vol-f", Capacity: GiB})).To(BeNil(), "cannot create volume")
+
+			writePending := func(txid, volid string, capacity int64) {
+				current, err := client.Resource(volumesResource).Get(context.Background(), volid, metav1.GetOptions{})
+				Expect(current, err).ToNot(BeNil(), "cannot get volume resource")
+				target := current.DeepCopy()
+				Expect(unstructured.SetNestedField(target.Object, capacity, "spec", "capacity")).To(BeNil())
+				pending, err := pendingObject(txid, current, target)
+				Expect(pending, err).ToNot(BeNil(), "cannot build pending resource")
+				_, err = cs.write(volumesResource, current, pending)
+				Expect(err).To(BeNil(), "cannot write pending resource")
+			}
+
+			By("resources of an abandoned transaction should show the previous content")
+			abandoned, err := cs.createTransaction()
+			Expect(abandoned, err).ToNot(BeNil(), "cannot create transaction record")
+			Expect(unstructured.SetNestedField(abandoned.Object, time.Now().Add(-2*crdLockDuration).Format(time.RFC3339Nano), "spec", "startTime")).To(BeNil())
+			_, err = client.Resource(transactionsResource).Update(context.Background(), abandoned, metav1.UpdateOptions{})
+			Expect(err).To(BeNil(), "cannot expire transaction record")
+			writePending(abandoned.GetName(), "vol-p", 2*GiB)
+			created, err := pendingObject(abandoned.GetName(), nil, &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"volumeId": "vol-q"}}})
+			Expect(created, err).ToNot(BeNil(), "cannot build pending resource")
+			created.SetAPIVersion(crdGroupVersion.String())
+			created.SetKind(crdKindVolume)
+			created.SetName("vol-q")
+			_, err = cs.write(volumesResource, nil, created)
+			Expect(err).To(BeNil(), "cannot write pending resource")
+
+			vol, err := store.GetVolume("vol-p")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(GiB)), "uncommitted change should not be seen")
+			_, err = store.GetVolume("vol-q")
+			Expect(err).Should(MatchError(ErrRecordNotFound), "uncommitted volume should not be seen")
+			vc, err := store.GetVolumeCount()
+			Expect(vc, err).To(Equal(2), "uncommitted volume should not be listed")
+
+			By("writers should roll the abandoned transaction back")
+			Expect(store.UpdateVolumeCondition("vol-p", VolumeCondition{Abnormal: true})).To(BeNil(), "cannot update volume")
+			Expect(store.CreateVolume(&Volume{VolID: "vol-q", VolPath: "/vols/vol-q", Capacity: GiB})).To(BeNil(), "volume of the abandoned transaction should be created again")
+			obj, err := client.Resource(volumesResource).Get(context.Background(), "vol-p", metav1.GetOptions{})
+			Expect(obj, err).ToNot(BeNil(), "cannot get volume resource")
+			Expect(obj.GetAnnotations()).ToNot(HaveKey(crdTransactionAnnotation), "volume should be rolled back")
+			Expect(obj.Object["spec"]).To(HaveKeyWithValue("capacity", BeNumerically("==", GiB)))
+			obj, err = client.Resource(volumesResource).Get(context.Background(), "vol-q", metav1.GetOptions{})
+			Expect(obj, err).ToNot(BeNil(), "cannot get volume resource")
+			Expect(obj.GetAnnotations()).ToNot(HaveKey(crdTransactionAnnotation), "volume should be created again")
+			_, err = client.Resource(transactionsResource).Get(context.Background(), abandoned.GetName(), metav1.GetOptions{})
+			Expect(err).ShouldNot(BeNil(), "abandoned transaction record should be removed")
+
+			By("resources of a committed transaction should show the new content")
+			committed, err := cs.createTransaction()
+			Expect(committed, err).ToNot(BeNil(), "cannot create transaction record")
+			writePending(committed.GetName(), "vol-f", 3*GiB)
+			vol, err = store.GetVolume("vol-f")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(GiB)), "change of a pending transaction should not be seen")
+			Expect(unstructured.SetNestedField(committed.Object, crdTransactionCommitted, "spec", "phase")).To(BeNil())
+			_, err = client.Resource(transactionsResource).Update(context.Background(), committed, metav1.UpdateOptions{})
+			Expect(err).To(BeNil(), "cannot commit transaction record")
+			vol, err = store.GetVolume("vol-f")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(3*GiB)), "committed change should be seen")
+			Expect(store.UpdateVolumeCondition("vol-f", VolumeCondition{Abnormal: true})).To(BeNil(), "cannot update volume")
+			vol, err = store.GetVolume("vol-f")
+			Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+			Expect(vol.Capacity).To(Equal(int64(3*GiB)), "committed change should be kept by writers")
+			Expect(vol.VolumeCondition.Abnormal).To(BeTrue())
+		})
+
+		It("nodes and snapshots should be stored", func() {
+			Expect(store.UpdateNodeInfoLastSeen("node-1", time.Now())).To(BeNil(), "cannot create node info")
+			Expect(store.UpdateNodeInfoLastSeen("node-1", time.Now())).To(BeNil(), "cannot update node info")
+			ni, err := store.GetNodeInfo("node-1", time.Now().Add(-time.Minute))
+			Expect(ni, err).ToNot(BeNil(), "cannot get node info")
+			Expect(store.MarkNodeDead("node-1", time.Now().Add(-time.Minute))).Should(MatchError(ErrRecordNotFound), "node seen after deadline should not be marked dead")
+			Expect(store.MarkNodeDead("node-1", time.Now())).To(BeNil(), "cannot mark node dead")
+			nis, err := store.GetNodeInfos()
+			Expect(err).To(BeNil(), "cannot get node infos")
+			Expect(nis).To(HaveLen(1))
+			Expect(nis[0].Dead).To(BeTrue(), "node should be dead")
+
+			snap := &Snapshot{SnapID: "snap-1", SnapName: "name-snap-1", SourceVolID: "vol-1", SnapPath: "/snaps/snap-1"}
+			Expect(store.CreateSnapshot(snap)).To(BeNil(), "cannot create snapshot")
+			snap.ReadyToUse = true
+			snap.AllocatedSize = MiB
+			Expect(store.UpdateSnapshot(snap)).To(BeNil(), "cannot update snapshot")
+			stored, err := store.GetSnapshot("snap-1")
+			Expect(stored, err).ToNot(BeNil(), "cannot get snapshot")
+			Expect(stored.ReadyToUse).To(BeTrue())
+			Expect(stored.AllocatedSize).To(Equal(int64(MiB)))
+			sc, err := store.GetSnapshotCount("", "vol-1")
+			Expect(sc, err).To(Equal(1))
+
+			Expect(store.DeleteSnapshot("snap-1")).To(BeNil(), "cannot delete snapshot")
+			_, err = store.GetSnapshot("snap-1")
+			Expect(err).Should(MatchError(ErrRecordNotFound))
+		})
+
+		It("volume locks should block other transactions until released", func() {
+			Expect(store.LockVolume("vol-l")).Should(MatchError(errLockOutsideTransaction))
+
+			locked := make(chan struct{})
+			release := make(chan struct{})
+			first := make(chan error)
+			go func() {
+				first <- store.Transaction(func(tx MetadataStore) error {
+					if err := tx.LockVolume("vol-l"); err != nil {
+						return err
+					}
+					Expect(tx.LockVolume("vol-l")).To(BeNil(), "lock should be reentrant inside transaction")
+					close(locked)
+					<-release
+					return nil
+				})
+			}()
+			Eventually(locked).Should(BeClosed())
+
+			var acquired int32
+			second := make(chan error)
+			go func() {
+				second <- store.Transaction(func(tx MetadataStore) error {
+					err := tx.LockVolume("vol-l")
+					atomic.StoreInt32(&acquired, 1)
+					return err
+				})
+			}()
+			Consistently(func() int32 { return atomic.LoadInt32(&acquired) }, "1500ms").Should(BeZero(), "locked volume should not be locked again")
+
+			close(release)
+			Eventually(first).Should(Receive(BeNil()))
+			Eventually(second, "5s").Should(Receive(BeNil()))
+			_, err := client.Resource(locksResource).Get(context.Background(), "vol-l", metav1.GetOptions{})
+			Expect(err).ShouldNot(BeNil(), "lock should be removed after transaction")
+		})
+
+		It("expired volume locks should be taken over", func() {
+			_, err := (&crdStore{client: client}).tryLock("vol-e", "crashed")
+			Expect(err).To(BeNil(), "cannot create lock")
+			Expect(store.(*crdStore).modify(locksResource, "vol-e", func(obj *unstructured.Unstructured) error {
+				return unstructured.SetNestedField(obj.Object, time.Now().Add(-2*crdLockDuration).Format(time.RFC3339Nano), "spec", "renewTime")
+			})).To(BeNil(), "cannot expire lock")
+
+			done := make(chan error)
+			go func() {
+				done <- store.Transaction(func(tx MetadataStore) error {
+					return tx.LockVolume("vol-e")
+				})
+			}()
+			Eventually(done, "5s").Should(Receive(BeNil()), "expired lock should be taken over")
+		})
+
+		It("leadership should be taken over only when it is not renewed", func() {
+			leading, err := store.TryLead("first", time.Minute)
+			Expect(leading, err).To(BeTrue(), "first holder should lead")
+			leading, err = store.TryLead("second", time.Minute)
+			Expect(leading, err).To(BeFalse(), "second holder should wait")
+			leading, err = store.TryLead("first", time.Minute)
+			Expect(leading, err).To(BeTrue(), "leader should renew its leadership")
+
+			Expect(store.(*crdStore).modify(locksResource, controllerLeaderLockKey, func(obj *unstructured.Unstructured) error {
+				return unstructured.SetNestedField(obj.Object, time.Now().Add(-2*time.Minute).Format(time.RFC3339Nano), "spec", "renewTime")
+			})).To(BeNil(), "cannot expire leadership")
+			leading, err = store.TryLead("second", time.Minute)
+			Expect(leading, err).To(BeTrue(), "expired leadership should be taken over")
+			Expect(store.ResignLead("first")).To(BeNil())
+			leading, err = store.TryLead("first", time.Minute)
+			Expect(leading, err).To(BeFalse(), "previous leader should not resign the new leader")
+			Expect(store.ResignLead("second")).To(BeNil())
+			leading, err = store.TryLead("first", time.Minute)
+			Expect(leading, err).To(BeTrue(), "resigned leadership should be taken")
+		})
+
+		It("volume locks taken over should not be renewed by the previous holder", func() {
+			cs := &crdStore{client: client}
+			_, err := cs.tryLock("vol-r", "first")
+			Expect(err).To(BeNil(), "cannot create lock")
+			_, err = cs.renewLockOnce("vol-r", "first")
+			Expect(err).To(BeNil(), "holder should renew its lock")
+
+			Expect(client.Resource(locksResource).Delete(context.Background(), "vol-r", metav1.DeleteOptions{})).To(BeNil(), "cannot remove lock")
+			_, err = cs.tryLock("vol-r", "second")
+			Expect(err).To(BeNil(), "cannot take lock over")
+			_, err = cs.renewLockOnce("vol-r", "first")
+			Expect(err).Should(MatchError(errVolumeLocked), "previous holder should not renew the lock")
+			obj, err := cs.get(locksResource, "vol-r")
+			Expect(obj, err).ToNot(BeNil(), "cannot get lock")
+			var lock crdLockSpec
+			Expect(fromUnstructuredField(obj, "spec", &lock)).To(BeNil())
+			Expect(lock.Holder).To(Equal("second"))
+		})
+	})
+})
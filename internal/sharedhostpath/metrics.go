@@ -0,0 +1,189 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	klog "k8s.io/klog/v2"
+	"math"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "sharedhostpath"
+
+// metricsRegistry keeps all metrics of the driver, it is served at the metrics address.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	grpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of handled grpc requests by method and grpc code.",
+	}, []string{"method", "code"})
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Latency of grpc requests by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"method"})
+	metadataQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "metadata_query_duration_seconds",
+		Help:      "Latency of metadata store queries by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"operation"})
+	heartbeatFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_heartbeat_failures_total",
+		Help:      "Number of failed node last seen updates.",
+	})
+	fenceFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_fence_failures_total",
+		Help:      "Number of failed attempts to stop the writes to volumes whose leases are not renewed.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		grpcRequests,
+		grpcRequestDuration,
+		metadataQueryDuration,
+		heartbeatFailures,
+		fenceFailures,
+	)
+}
+
+// metricsGRPC counts the grpc requests with their result codes and observes their latencies.
+func metricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcRequestDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func observeMetadataQuery(operation string, start time.Time) {
+	metadataQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+var (
+	poolBytesDesc = prometheus.NewDesc(metricsNamespace+"_pool_bytes",
+		"Size of storage pools by state (total, used or available).", []string{"pool", "state"}, nil)
+	poolInodesDesc = prometheus.NewDesc(metricsNamespace+"_pool_inodes",
+		"Inodes of storage pools by state (total, used or available).", []string{"pool", "state"}, nil)
+	volumesDesc = prometheus.NewDesc(metricsNamespace+"_volumes",
+		"Number of volumes by pool, type and namespace.", []string{"pool", "type", "namespace"}, nil)
+	provisionedBytesDesc = prometheus.NewDesc(metricsNamespace+"_provisioned_bytes",
+		"Provisioned capacity of volumes by pool, type and namespace.", []string{"pool", "type", "namespace"}, nil)
+	snapshotAllocatedBytesDesc = prometheus.NewDesc(metricsNamespace+"_snapshot_allocated_bytes",
+		"Allocated size of each snapshot with the method used to copy it (reflink or sparse).", []string{"snapshot", "source_volume", "pool", "copy_method"}, nil)
+)
+
+// volumeCollector reads the pool usages and the volume records of the volume helper at each scrape.
+type volumeCollector struct {
+	vh *VolumeHelper
+}
+
+func (vc *volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolBytesDesc
+	ch <- poolInodesDesc
+	ch <- volumesDesc
+	ch <- provisionedBytesDesc
+	ch <- snapshotAllocatedBytesDesc
+}
+
+func (vc *volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	type volumeGroup struct {
+		pool, vtype, namespace string
+	}
+
+	for _, pool := range vc.vh.sortedPoolNames() {
+		stats, err := vc.vh.GetStatistics(pool)
+		if err != nil {
+			klog.V(5).Error(err, "volumeCollector cannot get statistics of pool %s", pool)
+			ch <- prometheus.NewInvalidMetric(poolBytesDesc, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(poolBytesDesc, prometheus.GaugeValue, float64(stats.totalBytes), pool, "total")
+			ch <- prometheus.MustNewConstMetric(poolBytesDesc, prometheus.GaugeValue, float64(stats.usedBytes), pool, "used")
+			ch <- prometheus.MustNewConstMetric(poolBytesDesc, prometheus.GaugeValue, float64(stats.availableBytes), pool, "available")
+			ch <- prometheus.MustNewConstMetric(poolInodesDesc, prometheus.GaugeValue, float64(stats.totalInodes), pool, "total")
+			ch <- prometheus.MustNewConstMetric(poolInodesDesc, prometheus.GaugeValue, float64(stats.usedInodes), pool, "used")
+			ch <- prometheus.MustNewConstMetric(poolInodesDesc, prometheus.GaugeValue, float64(stats.availableInodes), pool, "available")
+		}
+
+		vols, err := vc.vh.store.GetPoolVolumes(pool)
+		if err != nil {
+			klog.V(5).Error(err, "volumeCollector cannot get volumes of pool %s", pool)
+			ch <- prometheus.NewInvalidMetric(volumesDesc, err)
+			continue
+		}
+		counts := make(map[volumeGroup]int)
+		capacities := make(map[volumeGroup]int64)
+		for _, vol := range vols {
+			group := volumeGroup{pool: pool, vtype: "folder", namespace: vol.NSName}
+			if vol.IsBlock {
+				group.vtype = "disk"
+			}
+			counts[group]++
+			capacities[group] += vol.Capacity
+		}
+		for group, count := range counts {
+			ch <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(count), group.pool, group.vtype, group.namespace)
+			ch <- prometheus.MustNewConstMetric(provisionedBytesDesc, prometheus.GaugeValue, float64(capacities[group]), group.pool, group.vtype, group.namespace)
+		}
+	}
+
+	snaps, err := vc.vh.store.GetSnapshots("", "", 0, math.MaxInt32)
+	if err != nil {
+		klog.V(5).Error(err, "volumeCollector cannot get snapshots")
+		ch <- prometheus.NewInvalidMetric(snapshotAllocatedBytesDesc, err)
+		return
+	}
+	for _, snap := range snaps {
+		ch <- prometheus.MustNewConstMetric(snapshotAllocatedBytesDesc, prometheus.GaugeValue, float64(snap.AllocatedSize), snap.SnapID, snap.SourceVolID, snap.Pool, snap.CopyMethod)
+	}
+}
+
+// registerVolumeCollector adds the pool and volume metrics of the volume helper to the registry.
+func registerVolumeCollector(vh *VolumeHelper) error {
+	err := metricsRegistry.Register(&volumeCollector{vh: vh})
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		metricsRegistry.Unregister(are.ExistingCollector)
+		err = metricsRegistry.Register(&volumeCollector{vh: vh})
+	}
+	return err
+}
+
+// serveMetrics serves the registry at /metrics of the address until the process exits.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	klog.V(1).Infof("Serving metrics on address: %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Fatalf("Failed to serve metrics: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+	"os"
+	"time"
+)
+
+const (
+	volumeMonitorComponent    = "sharedhostpath-volume-monitor"
+	volumeAbnormalReason      = "VolumeConditionAbnormal"
+	volumeRecoveredReason     = "VolumeConditionRecovered"
+	persistentVolumeClaimKind = "PersistentVolumeClaim"
+)
+
+// SetVolumeMonitor configures the periodic volume checks of the controller. Pools with less free
+// space than minFreePercent mark their volumes abnormal, zero disables the check. Condition changes
+// are reported as events on the pvcs when the events client is not nil.
+func (vh *VolumeHelper) SetVolumeMonitor(interval time.Duration, minFreePercent float64, events kubernetes.Interface) {
+	vh.monitorInterval = interval
+	vh.monitorMinFreePercent = minFreePercent
+	vh.eventClient = events
+}
+
+// addProblem marks the condition abnormal and appends the problem to its message.
+func (vc *VolumeCondition) addProblem(problem string) {
+	if vc.Abnormal {
+		vc.Message += "; " + problem
+	} else {
+		vc.Message = problem
+	}
+	vc.Abnormal = true
+}
+
+// checkVolumeCondition checks the backing path of the volume and the image size of disk volumes.
+func checkVolumeCondition(vol *Volume) VolumeCondition {
+	condition := VolumeCondition{Abnormal: true, CheckedAt: time.Now()}
+	fi, err := os.Stat(vol.VolPath)
+	if err != nil {
+		condition.Message = err.Error()
+	} else if vol.IsBlock && fi.Size() != vol.Capacity {
+		condition.Message = fmt.Sprintf("file size dismatch: image size is %d, capacity is %d", fi.Size(), vol.Capacity)
+	} else {
+		condition.Abnormal = false
+		condition.Message = "ok"
+		if !vol.IsBlock && vol.ProjectID == 0 {
+			condition.Message = "ok, capacity is not enforced: filesystem does not support project quotas"
+		}
+	}
+	return condition
+}
+
+// poolSpaceProblem returns why the free space of the pool is not enough, or empty string.
+func (vh *VolumeHelper) poolSpaceProblem(pool string) string {
+	if vh.monitorMinFreePercent <= 0 {
+		return ""
+	}
+	stats, err := vh.GetStatistics(pool)
+	if err != nil {
+		return fmt.Sprintf("cannot get free space of storage pool %s: %v", pool, err)
+	}
+	if stats.totalBytes == 0 {
+		return ""
+	}
+	free := float64(stats.availableBytes) * 100 / float64(stats.totalBytes)
+	if free < vh.monitorMinFreePercent {
+		// the message does not contain the free space, so it is not reported again at each change
+		return fmt.Sprintf("free space of storage pool %s is below %.1f%%", pool, vh.monitorMinFreePercent)
+	}
+	return ""
+}
+
+// CheckVolumes checks all volumes once and stores their conditions.
+func (vh *VolumeHelper) CheckVolumes() error {
+	var errs []error
+	deadNodes, err := vh.deadNodePublishes()
+	if err != nil {
+		klog.V(5).Error(err, "CheckVolumes cannot get volumes of dead nodes")
+		errs = append(errs, err)
+	}
+	for _, pool := range vh.sortedPoolNames() {
+		spaceProblem := vh.poolSpaceProblem(pool)
+		vols, err := vh.store.GetPoolVolumes(pool)
+		if err != nil {
+			klog.V(5).Error(err, "CheckVolumes cannot get volumes of pool %s", pool)
+			errs = append(errs, err)
+			continue
+		}
+		for i := range vols {
+			if err := vh.checkVolume(&vols[i], spaceProblem, deadNodes[vols[i].VolID]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("cannot check %d volumes or pools, first error: %v", len(errs), errs[0])
+	}
+	return nil
+}
+
+// checkVolume stores the condition of the volume and reports its changes.
+func (vh *VolumeHelper) checkVolume(vol *Volume, spaceProblem string, deadNodes []string) error {
+	condition := checkVolumeCondition(vol)
+	if spaceProblem != "" {
+		condition.addProblem(spaceProblem)
+	}
+	for _, nodeId := range deadNodes {
+		condition.addProblem(fmt.Sprintf("volume is published to dead node %s", nodeId))
+	}
+
+	err := vh.store.UpdateVolumeCondition(vol.VolID, condition)
+	if errors.Is(err, ErrRecordNotFound) {
+		// the volume is deleted after the listing
+		return nil
+	}
+	if err != nil {
+		klog.V(5).Error(err, "checkVolume cannot store condition of volume %s", vol.VolID)
+		return err
+	}
+
+	previous := vol.VolumeCondition
+	if condition.Abnormal && (!previous.Abnormal || previous.Message != condition.Message) {
+		klog.V(5).Infof("checkVolume volume %s of %s/%s is abnormal: %s", vol.VolID, vol.NSName, vol.PVCName, condition.Message)
+		vh.recordVolumeEvent(vol, corev1.EventTypeWarning, volumeAbnormalReason, condition.Message)
+	} else if !condition.Abnormal && previous.Abnormal {
+		klog.V(5).Infof("checkVolume volume %s of %s/%s is recovered", vol.VolID, vol.NSName, vol.PVCName)
+		vh.recordVolumeEvent(vol, corev1.EventTypeNormal, volumeRecoveredReason, condition.Message)
+	}
+	vol.VolumeCondition = condition
+	return nil
+}
+
+// recordVolumeEvent creates an event on the pvc of the volume.
+func (vh *VolumeHelper) recordVolumeEvent(vol *Volume, eventType, reason, message string) {
+	if vh.eventClient == nil || vol.PVCName == "" || vol.NSName == "" {
+		return
+	}
+	ctx := context.Background()
+	pvc, err := vh.eventClient.CoreV1().PersistentVolumeClaims(vol.NSName).Get(ctx, vol.PVCName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(5).Error(err, "recordVolumeEvent cannot get pvc %s/%s of volume %s", vol.NSName, vol.PVCName, vol.VolID)
+		return
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", pvc.Name, now.UnixNano()),
+			Namespace: pvc.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:            persistentVolumeClaimKind,
+			APIVersion:      "v1",
+			Namespace:       pvc.Namespace,
+			Name:            pvc.Name,
+			UID:             pvc.UID,
+			ResourceVersion: pvc.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Source:         corev1.EventSource{Component: volumeMonitorComponent},
+	}
+	if _, err := vh.eventClient.CoreV1().Events(pvc.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		klog.V(5).Error(err, "recordVolumeEvent cannot create event on pvc %s/%s", pvc.Namespace, pvc.Name)
+	}
+}
+
+// RunVolumeMonitor checks the volumes periodically while the controller is the leader, it never returns.
+func (vh *VolumeHelper) RunVolumeMonitor() {
+	for {
+		if !vh.IsLeader() {
+			time.Sleep(leaderCheckInterval)
+			continue
+		}
+		if err := vh.CheckVolumes(); err != nil {
+			klog.V(5).Error(err, "RunVolumeMonitor cannot check volumes")
+		}
+		time.Sleep(vh.monitorInterval)
+	}
+}
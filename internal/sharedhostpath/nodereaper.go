@@ -0,0 +1,166 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+	"sort"
+	"time"
+)
+
+const (
+	nodeReapInterval             = 30 * time.Second
+	volumeForceUnpublishedReason = "VolumeForceUnpublished"
+)
+
+// SetNodeReaper marks the nodes which are not seen for the timeout dead, zero disables the reaper.
+// Volumes published to dead nodes are unpublished from them when forceUnpublish is set, otherwise
+// they are reported abnormal until the node comes back.
+func (vh *VolumeHelper) SetNodeReaper(timeout time.Duration, forceUnpublish bool) {
+	vh.nodeTimeout = timeout
+	vh.nodeForceUnpublish = forceUnpublish
+}
+
+// deadNodePublishes returns the dead nodes which each volume is still published to.
+func (vh *VolumeHelper) deadNodePublishes() (map[string][]string, error) {
+	nis, err := vh.store.GetNodeInfos()
+	if err != nil {
+		return nil, err
+	}
+	deadNodes := make(map[string][]string)
+	for _, ni := range nis {
+		if !ni.Dead {
+			continue
+		}
+		cpvis, err := vh.store.GetNodeControllerPublishVolumeInfos(ni.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, cpvi := range cpvis {
+			deadNodes[cpvi.VolID] = append(deadNodes[cpvi.VolID], ni.ID)
+		}
+	}
+	return deadNodes, nil
+}
+
+// ReapDeadNodes marks the nodes which are not seen for the timeout dead, then unpublishes or reports
+// the volumes published to the dead nodes.
+func (vh *VolumeHelper) ReapDeadNodes() error {
+	start := time.Now()
+	nis, err := vh.store.GetNodeInfos()
+	if err != nil {
+		klog.V(5).Error(err, "ReapDeadNodes cannot get nodes")
+		return err
+	}
+	// the nodes cannot be judged when the reads of the reaper itself are delayed as much
+	if elapsed := time.Since(start); elapsed > vh.nodeTimeout {
+		klog.V(5).Infof("ReapDeadNodes skips the pass, reading the nodes took %v", elapsed)
+		return nil
+	}
+	deadline := start.Add(-vh.nodeTimeout)
+	for _, ni := range nis {
+		if ni.Dead || ni.LastSeen.After(deadline) {
+			continue
+		}
+		err := vh.store.MarkNodeDead(ni.ID, deadline)
+		if errors.Is(err, ErrRecordNotFound) {
+			klog.V(5).Infof("ReapDeadNodes node %s is seen again", ni.ID)
+			continue
+		}
+		if err != nil {
+			klog.V(5).Error(err, "ReapDeadNodes cannot mark node %s dead", ni.ID)
+			return err
+		}
+		klog.V(5).Infof("ReapDeadNodes node %s is dead, it is last seen at %v", ni.ID, ni.LastSeen)
+	}
+
+	deadNodes, err := vh.deadNodePublishes()
+	if err != nil {
+		klog.V(5).Error(err, "ReapDeadNodes cannot get volumes of dead nodes")
+		return err
+	}
+	volids := make([]string, 0, len(deadNodes))
+	for volid := range deadNodes {
+		volids = append(volids, volid)
+	}
+	sort.Strings(volids)
+
+	var errs []error
+	for _, volid := range volids {
+		vol, err := vh.store.GetVolume(volid)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		if !vh.nodeForceUnpublish {
+			if vol != nil {
+				if err := vh.checkVolume(vol, vh.poolSpaceProblem(vol.Pool), deadNodes[volid]); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+		for _, nodeId := range deadNodes[volid] {
+			if err := vh.forceUnpublish(volid, nodeId); err != nil {
+				klog.V(5).Error(err, "ReapDeadNodes cannot unpublish volume %s from dead node %s", volid, nodeId)
+				errs = append(errs, err)
+				continue
+			}
+			klog.V(5).Infof("ReapDeadNodes volume %s is unpublished from dead node %s", volid, nodeId)
+			if vol != nil {
+				vh.recordVolumeEvent(vol, corev1.EventTypeWarning, volumeForceUnpublishedReason, fmt.Sprintf("volume is unpublished from dead node %s", nodeId))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("cannot handle %d volumes of dead nodes, first error: %v", len(errs), errs[0])
+	}
+	return nil
+}
+
+// forceUnpublish removes the publish records of the volume at the node, so the volume can be
+// published to other nodes.
+func (vh *VolumeHelper) forceUnpublish(volid, nodeId string) error {
+	return vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(volid); err != nil {
+			return err
+		}
+		npvis, err := store.GetNodePublishVolumeInfos(volid, nodeId)
+		if err != nil {
+			return err
+		}
+		for _, npvi := range npvis {
+			if err := store.DeleteNodePublishVolumeInfo(volid, nodeId, npvi.MountPath); err != nil {
+				return err
+			}
+		}
+		return store.DeleteControllerPublishVolumeInfo(volid, nodeId)
+	})
+}
+
+// RunNodeReaper reaps the dead nodes periodically while the controller is the leader, it never returns.
+func (vh *VolumeHelper) RunNodeReaper() {
+	for {
+		if vh.IsLeader() {
+			vh.ReapDeadNodes()
+		}
+		time.Sleep(nodeReapInterval)
+	}
+}
@@ -28,9 +28,24 @@ import (
 	utilexec "k8s.io/utils/exec"
 	"k8s.io/utils/mount"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// mount flags which break isolation or the mounts managed by the driver
+var deniedMountFlags = map[string]bool{
+	"bind":    true,
+	"rbind":   true,
+	"move":    true,
+	"remount": true,
+	"loop":    true,
+	"shared":  true,
+	"rshared": true,
+	"suid":    true,
+	"dev":     true,
+}
+
 type nodeServer struct {
 	nodeID            string
 	maxVolumesPerNode int64
@@ -45,14 +60,42 @@ func NewNodeServer(nodeId string, maxVolumesPerNode int64, vh *VolumeHelper) *no
 	}
 	lastSeenTicker := time.NewTicker(5 * time.Second)
 	go func() {
-		for {
-			select {
-			case t := <-lastSeenTicker.C:
-				err := vh.UpdateNodeInfoLastSeen(nodeId, t)
-				if err != nil {
-					klog.V(4).Infof("Cannot update node info %s %v", nodeId, err.Error())
-				} else {
-					klog.V(4).Infof("update node info %s", nodeId)
+		for t := range lastSeenTicker.C {
+			err := vh.UpdateNodeInfoLastSeen(nodeId, t)
+			if err != nil {
+				heartbeatFailures.Inc()
+				klog.V(4).Infof("Cannot update node info %s %v", nodeId, err.Error())
+			} else {
+				klog.V(4).Infof("update node info %s", nodeId)
+			}
+		}
+	}()
+	// leases are renewed apart from the heartbeat, so a slow renewal does not delay the other
+	leaseTicker := time.NewTicker(volumeLeaseDuration / 3)
+	go func() {
+		adopted := false
+		for range leaseTicker.C {
+			if !adopted {
+				if err := vh.AdoptVolumeLeases(nodeId); err != nil {
+					klog.V(4).Infof("Cannot adopt volume leases of node %s %v", nodeId, err.Error())
+					continue
+				}
+				adopted = true
+			}
+			if err := vh.RenewVolumeLeases(nodeId); err != nil {
+				klog.V(4).Infof("Cannot renew volume leases of node %s %v", nodeId, err.Error())
+			}
+		}
+	}()
+	// leases are checked apart from the renewal too, since the renewal may hang on the store
+	fenceTicker := time.NewTicker(volumeLeaseFenceMargin / 5)
+	go func() {
+		for t := range fenceTicker.C {
+			for _, lease := range vh.FenceVolumeLeases(t) {
+				// fencing is retried at every tick until the writes are stopped
+				if err := fenceVolume(lease.VolPath); err != nil {
+					fenceFailures.Inc()
+					klog.Errorf("Cannot stop writes to volume %s whose lease is not renewed %v", lease.VolID, err.Error())
 				}
 			}
 		}
@@ -62,6 +105,13 @@ func NewNodeServer(nodeId string, maxVolumesPerNode int64, vh *VolumeHelper) *no
 		nodeID:            nodeId,
 		maxVolumesPerNode: maxVolumesPerNode,
 		caps: []*csi.NodeServiceCapability{
+			&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
 			&csi.NodeServiceCapability{
 				Type: &csi.NodeServiceCapability_Rpc{
 					Rpc: &csi.NodeServiceCapability_RPC{
@@ -83,15 +133,33 @@ func NewNodeServer(nodeId string, maxVolumesPerNode int64, vh *VolumeHelper) *no
 					},
 				},
 			},
+			&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
 		},
 		vh: vh,
 	}
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	// markers are written by the controller, which may start after the node on a fresh install.
+	// registration is retried until a pool is seen, instead of reporting an empty topology.
+	pools := ns.vh.GetMountedPools()
+	klog.V(4).Infof("mounted storage pools: %v", pools)
+	if len(pools) == 0 {
+		return nil, status.Error(codes.Unavailable, "NodeGetInfo no storage pool marker is found, the controller may not be started yet")
+	}
+
 	topology := &csi.Topology{
 		Segments: map[string]string{},
 	}
+	for _, pool := range pools {
+		topology.Segments[poolTopologyKey(pool)] = "true"
+	}
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:             ns.nodeID,
@@ -130,11 +198,21 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.NotFound, err.Error())
 	}
 
+	readOnly := req.GetReadonly()
+	if vol.IsBlock && !isWriterAccessMode(cap.GetAccessMode().GetMode()) {
+		// readers of disk volumes are staged with read only loop devices
+		readOnly = true
+	}
+	if vol.IsBlock && !readOnly {
+		if err := ns.acquireVolumeLease(volumeId); err != nil {
+			return nil, err
+		}
+	}
+
 	mounter := mount.New("")
 
 	options := []string{}
 
-	readOnly := req.GetReadonly()
 	if readOnly {
 		klog.V(4).Infof("NodePublishVolume readonly mount volume %s on node %s for path %s", volumeId, ns.nodeID, targetPath)
 		options = append(options, "ro")
@@ -149,13 +227,13 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 		volumePathHandler := volumehelpers.VolumePathHandler{}
 
-		// Get loop device from the volume path.
-		loopDevice, err := volumePathHandler.AttachFileDevice(vol.VolPath)
+		// Get loop device attached at staging from the volume path.
+		loopDevice, err := volumePathHandler.GetLoopDevice(vol.VolPath)
 		if err != nil {
-			klog.V(4).Error(err, "")
-			return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to get the loop device: %v", err))
+			klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume cannot find loop device of volume %s on node %s", volumeId, ns.nodeID))
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodePublishVolume volume %s is not staged: %v", volumeId, err))
 		}
-		klog.V(4).Infof("NodePublishVolume volume %s attached to the device %s", volumeId, loopDevice)
+		klog.V(4).Infof("NodePublishVolume volume %s is attached to the device %s", volumeId, loopDevice)
 
 		// Check if the target path exists. Create if not present.
 		_, err = os.Lstat(targetPath)
@@ -208,6 +286,17 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, status.Error(codes.InvalidArgument, "NodePublishVolume cannot mount a block volume as folder volume")
 		}
 
+		mountFlags, err := validateMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume %v", err))
+		}
+		for _, flag := range mountFlags {
+			if readOnly && flag == "rw" {
+				continue
+			}
+			options = append(options, flag)
+		}
+
 		notMnt, err := mount.IsNotMountPoint(mounter, targetPath)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -220,32 +309,35 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			}
 		}
 
+		if notMnt && vtype == "folder" {
+			if err := ns.applyVolumeMountGroup(req.GetVolumeCapability().GetMount(), vol.VolPath); err != nil {
+				klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume cannot apply volume mount group of volume %s on node %s", volumeId, ns.nodeID))
+				return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume cannot apply volume mount group: %v", err))
+			}
+		}
+
 		if notMnt {
 			if vtype == "folder" {
+				// mounter applies the flags with a bind remount since the kernel ignores them at bind
 				options = append(options, "bind")
 				if err := mounter.Mount(vol.VolPath, targetPath, "", options); err != nil {
 					klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume failed to mount volume %s to %s on node %s", vol.VolPath, targetPath, ns.nodeID))
 					return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to mount device: %s at %s: %s", vol.VolPath, targetPath, err.Error()))
 				}
 			} else if vtype == "disk" {
-				var fsType string
-				if fsType, found = volume_context[fstypeParameter]; !found {
-					return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume required parameter not found: %s", fstypeParameter))
-				}
-				if fsType == "xfs" {
-					options = append(options, "nouuid")
+				stagingPath := req.GetStagingTargetPath()
+				if len(stagingPath) == 0 {
+					return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Staging target path missing in request")
 				}
-				volumePathHandler := volumehelpers.NewBlockVolumePathHandler()
-				loopDevice, err := volumePathHandler.AttachFileDevice(vol.VolPath)
-				if err != nil {
-					klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume cannot create loop device: %s for volume %s on node %s", loopDevice, volumeId, ns.nodeID))
-					return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume cannot create loop device: %s", err.Error()))
+				notStaged, err := mount.IsNotMountPoint(mounter, stagingPath)
+				if err != nil || notStaged {
+					klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume volume %s is not staged at %s on node %s", volumeId, stagingPath, ns.nodeID))
+					return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodePublishVolume volume %s is not staged at %s", volumeId, stagingPath))
 				}
-				formatAndMount := mount.SafeFormatAndMount{Interface: mounter, Exec: utilexec.New()}
-				err = formatAndMount.FormatAndMount(loopDevice, targetPath, fsType, options)
-				if err != nil {
-					klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume failed to mount device: %s to %s on node %s", loopDevice, targetPath, ns.nodeID))
-					return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to mount device: %s at %s: %s", loopDevice, targetPath, err.Error()))
+				options = append(options, "bind")
+				if err := mounter.Mount(stagingPath, targetPath, "", options); err != nil {
+					klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume failed to mount staging path %s to %s on node %s", stagingPath, targetPath, ns.nodeID))
+					return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to mount staging path: %s at %s: %s", stagingPath, targetPath, err.Error()))
 				}
 			} else {
 				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume invalid volume type: %s", vtype))
@@ -253,13 +345,6 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
-	if err := os.Chmod(targetPath, 0777); err != nil {
-		klog.V(4).Error(err, fmt.Sprintf("NodePublishVolume cannot change mode for volume %s at target %s on node %s, cleanup", volumeId, targetPath, ns.nodeID))
-		mounter.Unmount(targetPath)
-		os.RemoveAll(targetPath)
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to chown on node %s volume %s path %s info: %v", ns.nodeID, volumeId, targetPath, err))
-	}
-
 	klog.V(4).Infof("NodePublishVolume create npvi for volume %s on node %s", volumeId, ns.nodeID)
 	err = ns.vh.CreateNodePublishVolumeInfo(volumeId, ns.nodeID, targetPath, rawMount, readOnly)
 	if err != nil { // TODO: how to be impodent
@@ -284,7 +369,7 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 
 	klog.V(4).Infof("NodeUnpublishVolume try to unpublish volume %s on node %s for path %s", volumeId, ns.nodeID, targetPath)
 
-	vol, err := ns.vh.GetVolume(volumeId)
+	_, err := ns.vh.GetVolume(volumeId)
 	if err != nil {
 		klog.V(4).Error(err, fmt.Sprintf("NodeUnpublishVolume cannot find volume %s on node %s for path %s", volumeId, ns.nodeID, targetPath))
 		return nil, status.Error(codes.NotFound, err.Error())
@@ -301,17 +386,6 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 			klog.V(4).Error(err, fmt.Sprintf("NodeUnpublishVolume cannot  unmount volume %s on node %s for path %s", volumeId, ns.nodeID, targetPath))
 			return nil, status.Error(codes.Internal, err.Error())
 		}
-
-		if vol.IsBlock {
-			klog.V(4).Infof("NodeUnpublishVolume try detach volume %s device %s", volumeId, vol.VolPath)
-			volumeHelpers := volumehelpers.NewBlockVolumePathHandler()
-			err := volumeHelpers.DetachFileDevice(vol.VolPath)
-			if err != nil {
-				klog.V(4).Error(err, "NodeUnpublishVolume detach failed volume %s device %s", volumeId, vol.VolPath)
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			klog.V(4).Infof("NodeUnpublishVolume detach volume %s device %s succeeded", volumeId, vol.VolPath)
-		}
 	}
 
 	if err = os.RemoveAll(targetPath); err != nil {
@@ -411,13 +485,13 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 
 	klog.V(4).Infof("NodeGetVolumeStats try to get stats for volume %s on path %s at node %s", volumeId, volumePath, ns.nodeID)
 
-	_, err := ns.vh.GetVolume(volumeId)
+	vol, err := ns.vh.GetVolume(volumeId)
 	if err != nil {
 		klog.V(4).Error(err, fmt.Sprintf("NodeGetVolumeStats get stats for volume %s on path %s at node %s failed", volumeId, volumePath, ns.nodeID))
 		return nil, status.Error(codes.NotFound, err.Error())
 	}
 
-	_, err = ns.vh.GetNodePublishVolumeInfo(volumeId, ns.nodeID, volumePath)
+	npvi, err := ns.vh.GetNodePublishVolumeInfo(volumeId, ns.nodeID, volumePath)
 
 	if err != nil {
 		klog.V(4).Error(err, fmt.Sprintf("NodeGetVolumeStats get stats for volume %s on path %s at node %s failed", volumeId, volumePath, ns.nodeID))
@@ -427,15 +501,20 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	fi, err := os.Stat(volumePath)
 	if err != nil {
 		klog.V(4).Error(err, fmt.Sprintf("NodeGetVolumeStats get stats for volume %s on path %s at node %s failed", volumeId, volumePath, ns.nodeID))
+		if isStaleError(err) {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: staleCondition(volumePath, err)}, nil
+		}
 		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats cannot stat volumepath: %s : %v", volumePath, err)
 	}
 
 	var usage []*csi.VolumeUsage
-	var condition = &csi.VolumeCondition{}
 	if (fi.Mode() & os.ModeDir) == os.ModeDir {
 		stats, err := getStatistics(volumePath)
 		if err != nil {
 			klog.V(4).Error(err, fmt.Sprintf("NodeGetVolumeStats get stats for volume %s on path %s at node %s failed", volumeId, volumePath, ns.nodeID))
+			if isStaleError(err) {
+				return &csi.NodeGetVolumeStatsResponse{VolumeCondition: staleCondition(volumePath, err)}, nil
+			}
 			return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats failed to retrieve capacity statistics for volume path %q: %s", volumePath, err)
 		}
 		usage = []*csi.VolumeUsage{
@@ -452,9 +531,6 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		}
-		//TODO: extra check for condition
-		condition.Abnormal = false
-		condition.Message = "ok"
 	} else {
 		totalBytes, err := getBlockDeviceSize(volumePath)
 		if err != nil {
@@ -467,10 +543,13 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 				Total: totalBytes,
 			},
 		}
-		//TODO: extra check for condition
-		condition.Abnormal = false
-		condition.Message = "ok"
 	}
+	fenced, leaseExpiresAt := ns.vh.VolumeLeaseFenced(volumeId, time.Now())
+	condition := volumeCondition(vol, npvi, volumePath, fenced, leaseExpiresAt)
+	if condition.Abnormal {
+		klog.V(4).Infof("NodeGetVolumeStats volume %s on path %s at node %s is abnormal: %s", volumeId, volumePath, ns.nodeID, condition.Message)
+	}
+
 	klog.V(4).Infof("NodeGetVolumeStats get stats for volume %s on path %s at node %s succeeded", volumeId, volumePath, ns.nodeID)
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage:           usage,
@@ -478,12 +557,389 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	}, nil
 }
 
-/* Unimplemented methods beyond */
+func staleCondition(volumePath string, err error) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("shared storage of volume path %s is stale: %v", volumePath, err),
+	}
+}
+
+// volumeCondition checks the published volume and its shared storage, all found problems are
+// joined into the message of an abnormal condition.
+func volumeCondition(vol *Volume, npvi *NodePublishVolumeInfo, volumePath string, fenced bool, leaseExpiresAt time.Time) *csi.VolumeCondition {
+	var problems []string
+
+	if fenced {
+		problems = append(problems, fmt.Sprintf("lease of volume %s expiring at %v is not renewed, writes are stopped until it is unstaged", vol.VolID, leaseExpiresAt))
+	}
+
+	notMnt, err := mount.IsNotMountPoint(mount.New(""), volumePath)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("cannot check mount point %s: %v", volumePath, err))
+	} else if notMnt {
+		problems = append(problems, fmt.Sprintf("volume path %s is not a mount point", volumePath))
+	}
+
+	if _, err := os.Stat(vol.VolPath); err != nil {
+		if isStaleError(err) {
+			problems = append(problems, fmt.Sprintf("shared storage of volume %s is stale: %v", vol.VolPath, err))
+		} else {
+			problems = append(problems, fmt.Sprintf("cannot access volume %s: %v", vol.VolPath, err))
+		}
+	} else if vol.IsBlock {
+		problems = append(problems, loopDeviceProblems(vol, !npvi.ReadOnly)...)
+	}
+
+	if !npvi.ReadOnly && !npvi.RawMount {
+		readOnly, err := isReadOnlyFilesystem(volumePath)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cannot check filesystem of %s: %v", volumePath, err))
+		} else if readOnly {
+			problems = append(problems, fmt.Sprintf("filesystem of %s is read only although the volume is published writable", volumePath))
+		}
+	}
+
+	if len(problems) == 0 {
+		return &csi.VolumeCondition{Abnormal: false, Message: "ok"}
+	}
+	return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+}
+
+// loopDeviceProblems checks that the loop device of a disk volume still backs its image with the
+// capacity of the volume.
+func loopDeviceProblems(vol *Volume, writable bool) []string {
+	loopDevice, err := volumehelpers.VolumePathHandler{}.GetLoopDevice(vol.VolPath)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot find loop device of %s: %v", vol.VolPath, err)}
+	}
+
+	var problems []string
+	backingFile, err := getLoopBackingFile(loopDevice)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("cannot get backing file of loop device %s: %v", loopDevice, err))
+	} else if backingFile != vol.VolPath {
+		problems = append(problems, fmt.Sprintf("loop device %s is backed by %s instead of %s", loopDevice, backingFile, vol.VolPath))
+	}
+
+	size, err := getBlockDeviceSize(loopDevice)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("cannot get size of loop device %s: %v", loopDevice, err))
+	} else if size != vol.Capacity {
+		problems = append(problems, fmt.Sprintf("size %d of loop device %s does not match volume capacity %d", size, loopDevice, vol.Capacity))
+	}
+
+	if writable {
+		readOnly, err := volumehelpers.IsLoopDeviceReadOnly(loopDevice)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cannot check loop device %s: %v", loopDevice, err))
+		} else if readOnly {
+			problems = append(problems, fmt.Sprintf("loop device %s is read only although the volume is published writable", loopDevice))
+		}
+	}
+	return problems
+}
+
+func validateMountFlags(flags []string) ([]string, error) {
+	var options []string
+	for _, flag := range flags {
+		for _, option := range strings.Split(flag, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				continue
+			}
+			name := strings.SplitN(option, "=", 2)[0]
+			if deniedMountFlags[name] {
+				return nil, fmt.Errorf("mount flag is not allowed: %s", option)
+			}
+			options = append(options, option)
+		}
+	}
+	return options, nil
+}
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeId := req.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume ID missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging target path missing in request")
+	}
+
+	cap := req.GetVolumeCapability()
+	if cap == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume capability missing in request")
+	}
+
+	klog.V(4).Infof("NodeStageVolume try to stage volume %s on node %s at path %s", volumeId, ns.nodeID, stagingPath)
+
+	vol, err := ns.vh.GetVolume(volumeId)
+	if err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot find volume %s on node %s", volumeId, ns.nodeID))
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if !vol.IsBlock {
+		// folder volumes are bind mounted directly while publishing
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	volumePathHandler := volumehelpers.NewBlockVolumePathHandler()
+	// a loop device attached by an earlier stage may be in use, only the one attached here is
+	// detached and its lease is released when staging fails.
+	_, err = volumePathHandler.GetLoopDevice(vol.VolPath)
+	attachedBefore := err == nil
+
+	// readers share the image, so they neither take the lease nor write to the image, but they wait
+	// for the writer holding the lease
+	readOnly := !isWriterAccessMode(cap.GetAccessMode().GetMode())
+	if readOnly {
+		if err := ns.vh.CheckVolumeLease(volumeId, ns.nodeID); err != nil {
+			klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot stage volume %s on node %s readonly", volumeId, ns.nodeID))
+			if errors.Is(err, ErrVolumeLeaseHeld) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		if err := ns.acquireVolumeLease(volumeId); err != nil {
+			return nil, err
+		}
+	}
+
+	staged := false
+	defer func() {
+		if staged || attachedBefore {
+			return
+		}
+		if err := volumePathHandler.DetachFileDevice(vol.VolPath); err != nil {
+			klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot detach loop device of volume %s on node %s after failure", volumeId, ns.nodeID))
+			// the lease is kept while the device is attached
+			return
+		}
+		if !readOnly {
+			if err := ns.vh.ReleaseVolumeLease(volumeId, ns.nodeID); err != nil {
+				klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot release lease of volume %s on node %s after failure", volumeId, ns.nodeID))
+			}
+		}
+	}()
+
+	var loopDevice string
+	if readOnly {
+		loopDevice, err = volumePathHandler.AttachFileDeviceReadOnly(vol.VolPath)
+	} else {
+		loopDevice, err = volumePathHandler.AttachFileDevice(vol.VolPath)
+	}
+	if err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot create loop device for volume %s on node %s", volumeId, ns.nodeID))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume cannot create loop device: %s", err.Error()))
+	}
+	klog.V(4).Infof("NodeStageVolume volume %s attached to the device %s", volumeId, loopDevice)
+
+	if cap.GetBlock() != nil {
+		staged = true
+		klog.V(4).Infof("NodeStageVolume stage volume %s on node %s as raw succeeded", volumeId, ns.nodeID)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	var fsType string
+	var found bool
+	if fsType, found = req.GetVolumeContext()[fstypeParameter]; !found {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume required parameter not found: %s", fstypeParameter))
+	}
+
+	mounter := mount.New("")
+	notMnt, err := mount.IsNotMountPoint(mounter, stagingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(stagingPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !notMnt {
+		staged = true
+		klog.V(4).Infof("NodeStageVolume volume %s is already staged at %s on node %s", volumeId, stagingPath, ns.nodeID)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	options, err := validateMountFlags(cap.GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume %v", err))
+	}
+	if fsType == "xfs" {
+		options = append(options, "nouuid")
+	}
+
+	if readOnly {
+		// the image is not formatted and its journal is not replayed, since other nodes read it too
+		roOptions := []string{"ro", "norecovery"}
+		for _, option := range options {
+			if option != "rw" {
+				roOptions = append(roOptions, option)
+			}
+		}
+		if err := mounter.Mount(loopDevice, stagingPath, fsType, roOptions); err != nil {
+			klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume failed to mount device: %s to %s on node %s readonly", loopDevice, stagingPath, ns.nodeID))
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to mount device: %s at %s readonly: %s", loopDevice, stagingPath, err.Error()))
+		}
+		staged = true
+		klog.V(4).Infof("NodeStageVolume stage volume %s on node %s at path %s readonly succeeded", volumeId, ns.nodeID, stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// the ownership of the root is applied only to the filesystem formatted here, later stages keep
+	// the changes made inside the volume.
+	hadFilesystem, err := hasFilesystem(loopDevice)
+	if err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot check filesystem of device %s on node %s", loopDevice, ns.nodeID))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume cannot check filesystem of device: %s: %s", loopDevice, err.Error()))
+	}
+
+	formatAndMount := mount.SafeFormatAndMount{Interface: mounter, Exec: utilexec.New()}
+	err = formatAndMount.FormatAndMount(loopDevice, stagingPath, fsType, options)
+	if err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume failed to mount device: %s to %s on node %s", loopDevice, stagingPath, ns.nodeID))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to mount device: %s at %s: %s", loopDevice, stagingPath, err.Error()))
+	}
+	if vol.HasContentSource() {
+		// restored or cloned images may be smaller than the requested capacity
+		r := volumehelpers.NewResizeFs(&formatAndMount)
+		if _, err := r.Resize(loopDevice, stagingPath); err != nil {
+			klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume failed to resize restored volume %s at %s on node %s", volumeId, stagingPath, ns.nodeID))
+			mounter.Unmount(stagingPath)
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to resize restored volume: %s at %s: %s", volumeId, stagingPath, err.Error()))
+		}
+	}
+
+	// disk filesystems exist only after formatting, so their root gets the volume ownership here
+	if !hadFilesystem {
+		if err := vol.ApplyOwnership(stagingPath); err != nil {
+			klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot apply ownership of volume %s at %s on node %s", volumeId, stagingPath, ns.nodeID))
+			mounter.Unmount(stagingPath)
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume cannot apply ownership: %s at %s: %s", volumeId, stagingPath, err.Error()))
+		}
+	}
+	if err := ns.applyVolumeMountGroup(cap.GetMount(), stagingPath); err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeStageVolume cannot apply volume mount group of volume %s at %s on node %s", volumeId, stagingPath, ns.nodeID))
+		mounter.Unmount(stagingPath)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume cannot apply volume mount group: %s at %s: %s", volumeId, stagingPath, err.Error()))
+	}
+
+	staged = true
+	klog.V(4).Infof("NodeStageVolume stage volume %s on node %s at path %s succeeded", volumeId, ns.nodeID, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeId := req.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Volume ID missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging target path missing in request")
+	}
+
+	klog.V(4).Infof("NodeUnstageVolume try to unstage volume %s on node %s at path %s", volumeId, ns.nodeID, stagingPath)
+
+	vol, err := ns.vh.GetVolume(volumeId)
+	if err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeUnstageVolume cannot find volume %s on node %s", volumeId, ns.nodeID))
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if !vol.IsBlock {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	npvis, err := ns.vh.GetNodePublishVolumeInfos(volumeId, ns.nodeID)
+	if err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeUnstageVolume cannot get publish infos of volume %s on node %s", volumeId, ns.nodeID))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, npvi := range npvis {
+		if _, err := os.Stat(npvi.MountPath); err == nil {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeUnstageVolume volume %s is still published at %s", volumeId, npvi.MountPath))
+		}
+	}
+
+	mounter := mount.New("")
+	if notMnt, err := mount.IsNotMountPoint(mounter, stagingPath); err != nil {
+		if !os.IsNotExist(err) {
+			klog.V(4).Error(err, fmt.Sprintf("NodeUnstageVolume cannot check mount status of volume %s on node %s at path %s", volumeId, ns.nodeID, stagingPath))
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if !notMnt {
+		if err := mounter.Unmount(stagingPath); err != nil {
+			klog.V(4).Error(err, fmt.Sprintf("NodeUnstageVolume cannot unmount volume %s on node %s at path %s", volumeId, ns.nodeID, stagingPath))
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	klog.V(4).Infof("NodeUnstageVolume try detach volume %s device %s", volumeId, vol.VolPath)
+	volumePathHandler := volumehelpers.NewBlockVolumePathHandler()
+	if err := volumePathHandler.DetachFileDevice(vol.VolPath); err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeUnstageVolume detach failed volume %s device %s", volumeId, vol.VolPath))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := ns.vh.ReleaseVolumeLease(volumeId, ns.nodeID); err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("NodeUnstageVolume cannot release lease of volume %s on node %s", volumeId, ns.nodeID))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.V(4).Infof("NodeUnstageVolume unstage volume %s on node %s at path %s succeeded", volumeId, ns.nodeID, stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// acquireVolumeLease fences the writable disk volume, so it is not attached at two nodes at once.
+// Volumes which the node stopped writing to are refused until they are unstaged.
+func (ns *nodeServer) acquireVolumeLease(volumeId string) error {
+	if fenced, expiresAt := ns.vh.VolumeLeaseFenced(volumeId, time.Now()); fenced {
+		klog.V(4).Infof("volume %s on node %s is fenced since its lease expiring at %v is not renewed", volumeId, ns.nodeID, expiresAt)
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is fenced since its lease is not renewed, it should be unstaged", volumeId))
+	}
+	if err := ns.vh.AcquireVolumeLease(volumeId, ns.nodeID); err != nil {
+		klog.V(4).Error(err, fmt.Sprintf("cannot acquire lease of volume %s on node %s", volumeId, ns.nodeID))
+		if errors.Is(err, ErrVolumeLeaseHeld) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// fenceVolume stops the writes to the disk volume whose lease is not renewed, all I/O of its loop
+// device fails, so the filesystems mounted from it cannot write to the image either. A volume which
+// is not attached to a loop device cannot be written.
+func fenceVolume(volPath string) error {
+	loopDevice, err := volumehelpers.VolumePathHandler{}.GetLoopDevice(volPath)
+	if err != nil {
+		if err.Error() == volumehelpers.ErrDeviceNotFound {
+			return nil
+		}
+		return err
+	}
+	return fenceLoopDevice(loopDevice)
+}
+
+func (ns *nodeServer) applyVolumeMountGroup(mnt *csi.VolumeCapability_MountVolume, path string) error {
+	group := mnt.GetVolumeMountGroup()
+	if group == "" {
+		return nil
+	}
+	gid, err := strconv.ParseUint(group, 10, 31)
+	if err != nil {
+		return fmt.Errorf("invalid volume mount group: %s", group)
+	}
+	klog.V(4).Infof("applying volume mount group %d to %s", gid, path)
+	return applyVolumeMountGroup(path, int(gid))
 }
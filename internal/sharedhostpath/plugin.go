@@ -19,8 +19,10 @@ package sharedhostpath
 import (
 	"errors"
 	"fmt"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
 	"os"
+	"time"
 )
 
 type sharedHostPath struct {
@@ -29,6 +31,7 @@ type sharedHostPath struct {
 	version           string
 	endpoint          string
 	maxVolumesPerNode int64
+	metricsAddress    string
 	vh                *VolumeHelper
 
 	ids *identityServer
@@ -39,18 +42,30 @@ type sharedHostPath struct {
 }
 
 var (
-	vendorVersion   = "dev"
-	fstypeParameter = "/fsType"
-	typeParameter   = "/type"
+	vendorVersion            = "dev"
+	fstypeParameter          = "/fsType"
+	typeParameter            = "/type"
+	overcommitRatioParameter = "/overcommitRatio"
+	poolParameter            = "/pool"
+	topologyKeyPrefix        = "/pool-"
+	uidParameter             = "/uid"
+	gidParameter             = "/gid"
+	modeParameter            = "/mode"
 )
 
-func NewSharedHostPathDriver(driverName, nodeID, endpoint, dataRoot, dsn string, maxVolumesPerNode int64, version string) (*sharedHostPath, error) {
+func NewSharedHostPathDriver(driverName, nodeID, endpoint string, pools map[string]string, dsn string, maxVolumesPerNode int64, version string) (*sharedHostPath, error) {
 	if driverName == "" {
 		return nil, errors.New("no driver name provided")
 	}
 
 	fstypeParameter = driverName + fstypeParameter
 	typeParameter = driverName + typeParameter
+	overcommitRatioParameter = driverName + overcommitRatioParameter
+	poolParameter = driverName + poolParameter
+	topologyKeyPrefix = driverName + topologyKeyPrefix
+	uidParameter = driverName + uidParameter
+	gidParameter = driverName + gidParameter
+	modeParameter = driverName + modeParameter
 
 	if nodeID == "" {
 		return nil, errors.New("no node id provided")
@@ -60,8 +75,8 @@ func NewSharedHostPathDriver(driverName, nodeID, endpoint, dataRoot, dsn string,
 		return nil, errors.New("no driver endpoint provided")
 	}
 
-	if dataRoot == "" {
-		return nil, errors.New("no data root provided")
+	if len(pools) == 0 {
+		return nil, errors.New("no data root or storage pool provided")
 	}
 
 	if dsn == "" {
@@ -72,11 +87,13 @@ func NewSharedHostPathDriver(driverName, nodeID, endpoint, dataRoot, dsn string,
 		vendorVersion = version
 	}
 
-	if err := os.MkdirAll(dataRoot, 0750); err != nil {
-		return nil, fmt.Errorf("failed to create DataRoot: %v", err)
+	for name, dataRoot := range pools {
+		if err := os.MkdirAll(dataRoot, 0750); err != nil {
+			return nil, fmt.Errorf("failed to create DataRoot of pool %s: %v", name, err)
+		}
 	}
 
-	vh, err := NewVolumeHelper(dataRoot, dsn)
+	vh, err := NewVolumeHelperWithPools(pools, dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database connection: %v", err)
 	}
@@ -94,7 +111,75 @@ func NewSharedHostPathDriver(driverName, nodeID, endpoint, dataRoot, dsn string,
 	}, nil
 }
 
+// SetTrashRetention keeps the deleted volumes at the trash of their pools for the retention.
+func (shp *sharedHostPath) SetTrashRetention(retention time.Duration) {
+	shp.vh.SetTrashRetention(retention)
+}
+
+func (shp *sharedHostPath) startTrashReaper() {
+	if shp.vh.trashRetention > 0 {
+		go shp.vh.RunTrashReaper()
+	}
+}
+
+// SetVolumeMonitor checks the volumes at the interval at the controller, zero interval disables it.
+func (shp *sharedHostPath) SetVolumeMonitor(interval time.Duration, minFreePercent float64, events kubernetes.Interface) {
+	shp.vh.SetVolumeMonitor(interval, minFreePercent, events)
+}
+
+// SetNodeReaper marks the nodes not seen for the timeout dead at the controller, zero timeout disables it.
+func (shp *sharedHostPath) SetNodeReaper(timeout time.Duration, forceUnpublish bool) {
+	shp.vh.SetNodeReaper(timeout, forceUnpublish)
+}
+
+func (shp *sharedHostPath) startNodeReaper() {
+	if shp.vh.nodeTimeout > 0 {
+		go shp.vh.RunNodeReaper()
+	}
+}
+
+func (shp *sharedHostPath) startVolumeMonitor() {
+	if shp.vh.monitorInterval > 0 {
+		go shp.vh.RunVolumeMonitor()
+	}
+}
+
+// startLeaderElection elects the controller which runs the monitor and the reapers, when any of them
+// is enabled.
+func (shp *sharedHostPath) startLeaderElection() {
+	if shp.vh.trashRetention > 0 || shp.vh.monitorInterval > 0 || shp.vh.nodeTimeout > 0 {
+		go shp.vh.RunLeaderElection()
+	}
+}
+
+// SetMetricsAddress serves the prometheus metrics at the address, empty address disables them.
+func (shp *sharedHostPath) SetMetricsAddress(address string) {
+	shp.metricsAddress = address
+}
+
+// startMetricsServer serves the metrics, volume metrics are added only by the controller.
+func (shp *sharedHostPath) startMetricsServer(withVolumes bool) {
+	if shp.metricsAddress == "" {
+		return
+	}
+	if withVolumes {
+		if err := registerVolumeCollector(shp.vh); err != nil {
+			klog.Fatalf("cannot register volume metrics: %v", err)
+		}
+	}
+	go serveMetrics(shp.metricsAddress)
+}
+
 func (shp *sharedHostPath) RunController() {
+	if err := shp.vh.WritePoolMarkers(); err != nil {
+		klog.Fatalf("cannot write pool markers: %v", err)
+	}
+	shp.startLeaderElection()
+	shp.startTrashReaper()
+	shp.startVolumeMonitor()
+	shp.startNodeReaper()
+	shp.startMetricsServer(true)
+
 	// Create GRPC servers
 	shp.ids = NewIdentityServer(shp.name, true, shp.version)
 	shp.cs = NewControllerServer(shp.nodeID, shp.vh)
@@ -105,6 +190,8 @@ func (shp *sharedHostPath) RunController() {
 }
 
 func (shp *sharedHostPath) RunNode() {
+	shp.startMetricsServer(false)
+
 	// Create GRPC servers
 	shp.ids = NewIdentityServer(shp.name, false, shp.version)
 	shp.ns = NewNodeServer(shp.nodeID, shp.maxVolumesPerNode, shp.vh)
@@ -115,6 +202,15 @@ func (shp *sharedHostPath) RunNode() {
 }
 
 func (shp *sharedHostPath) RunBoth() {
+	if err := shp.vh.WritePoolMarkers(); err != nil {
+		klog.Fatalf("cannot write pool markers: %v", err)
+	}
+	shp.startLeaderElection()
+	shp.startTrashReaper()
+	shp.startVolumeMonitor()
+	shp.startNodeReaper()
+	shp.startMetricsServer(true)
+
 	shp.ids = NewIdentityServer(shp.name, true, shp.version)
 	shp.cs = NewControllerServer(shp.nodeID, shp.vh)
 	shp.ns = NewNodeServer(shp.nodeID, shp.maxVolumesPerNode, shp.vh)
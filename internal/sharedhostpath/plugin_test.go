@@ -36,7 +36,7 @@ var address string = "unix:///tmp/csi.socket"
 
 var _ = BeforeSuite(func() {
 	var err error
-	shp, err = NewSharedHostPathDriver("sharedhostpath.sanaldiyar.com", "testnode", address, *dataRoot, *dsn, 0, "dev")
+	shp, err = NewSharedHostPathDriver("sharedhostpath.sanaldiyar.com", "testnode", address, map[string]string{defaultPool: *dataRoot}, *dsn, 0, "dev")
 	Expect(shp, err).ToNot(BeNil(), "cannot create driver")
 	go func() {
 		shp.RunBoth()
@@ -0,0 +1,185 @@
+// +build linux
+
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	klog "k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+const (
+	fsIocFsGetXattr    = 0x801c581f
+	fsIocFsSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x00000200
+
+	qGetQuota = 0x800007
+	qSetQuota = 0x800008
+	prjQuota  = 2
+	qifBLimit = 1
+
+	quotaBlockSize = 1024
+)
+
+// fsxattr is struct fsxattr of linux/fs.h
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// ifDqblk is struct if_dqblk of linux/quota.h
+type ifDqblk struct {
+	bHardLimit uint64
+	bSoftLimit uint64
+	curSpace   uint64
+	iHardLimit uint64
+	iSoftLimit uint64
+	curInodes  uint64
+	bTime      uint64
+	iTime      uint64
+	valid      uint32
+}
+
+func quotaCmd(cmd, qtype int) int {
+	return (cmd << 8) | (qtype & 0x00ff)
+}
+
+func quotactl(cmd int, device string, id uint32, dqblk *ifDqblk) error {
+	dev, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(cmd), uintptr(unsafe.Pointer(dev)), uintptr(id), uintptr(unsafe.Pointer(dqblk)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getProjectQuotaDevice returns the block device of the filesystem holding
+// path if the filesystem has project quotas enabled.
+func getProjectQuotaDevice(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+
+	mis, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+
+	for _, mi := range mis {
+		if mi.Major != int(unix.Major(uint64(st.Dev))) || mi.Minor != int(unix.Minor(uint64(st.Dev))) {
+			continue
+		}
+		if mi.FsType != "xfs" && mi.FsType != "ext4" {
+			return "", fmt.Errorf("%w: filesystem type %s", errProjectQuotaNotSupported, mi.FsType)
+		}
+		if _, err := os.Stat(mi.Source); err != nil {
+			return "", fmt.Errorf("%w: cannot access device %s: %v", errProjectQuotaNotSupported, mi.Source, err)
+		}
+		var dqblk ifDqblk
+		err = quotactl(quotaCmd(qGetQuota, prjQuota), mi.Source, 0, &dqblk)
+		if err != nil && err != unix.ENOENT {
+			return "", fmt.Errorf("%w: project quotas are not enabled on %s: %v", errProjectQuotaNotSupported, mi.Source, err)
+		}
+		return mi.Source, nil
+	}
+	return "", fmt.Errorf("%w: cannot find mount of %s", errProjectQuotaNotSupported, path)
+}
+
+func setProjectID(path string, projectID uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var fsx fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return errno
+	}
+	fsx.projid = projectID
+	fsx.xflags |= fsXflagProjInherit
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setProjectQuota assigns the project id to the whole tree at path and
+// limits the project to capacity bytes.
+func setProjectQuota(path string, projectID uint32, capacity int64) error {
+	klog.V(5).Infof("setProjectQuota try to set project %d with capacity %d to %s", projectID, capacity, path)
+	device, err := getProjectQuotaDevice(path)
+	if err != nil {
+		klog.V(5).Infof("setProjectQuota cannot use project quota for %s: %v", path, err)
+		return err
+	}
+
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		return setProjectID(p, projectID)
+	})
+	if err != nil {
+		klog.V(5).Error(err, "setProjectQuota cannot set project id %d to %s", projectID, path)
+		return err
+	}
+
+	return setProjectQuotaLimit(device, projectID, capacity)
+}
+
+// updateProjectQuota changes the limit of the project of path.
+func updateProjectQuota(path string, projectID uint32, capacity int64) error {
+	device, err := getProjectQuotaDevice(path)
+	if err != nil {
+		klog.V(5).Infof("updateProjectQuota cannot use project quota for %s: %v", path, err)
+		return err
+	}
+	return setProjectQuotaLimit(device, projectID, capacity)
+}
+
+func setProjectQuotaLimit(device string, projectID uint32, capacity int64) error {
+	dqblk := ifDqblk{
+		bHardLimit: uint64(capacity) / quotaBlockSize,
+		bSoftLimit: uint64(capacity) / quotaBlockSize,
+		valid:      qifBLimit,
+	}
+	err := quotactl(quotaCmd(qSetQuota, prjQuota), device, projectID, &dqblk)
+	if err != nil {
+		klog.V(5).Error(err, "setProjectQuotaLimit cannot set limit of project %d on %s", projectID, device)
+		return err
+	}
+	klog.V(5).Infof("setProjectQuotaLimit limit of project %d on %s set to %d", projectID, device, capacity)
+	return nil
+}
@@ -0,0 +1,33 @@
+// +build !linux
+
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	klog "k8s.io/klog/v2"
+)
+
+func setProjectQuota(path string, projectID uint32, capacity int64) error {
+	klog.V(6).Info("setProjectQuota not supported for this build.")
+	return errProjectQuotaNotSupported
+}
+
+func updateProjectQuota(path string, projectID uint32, capacity int64) error {
+	klog.V(6).Info("updateProjectQuota not supported for this build.")
+	return errProjectQuotaNotSupported
+}
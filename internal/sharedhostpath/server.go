@@ -80,7 +80,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(metricsGRPC, logGRPC),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -0,0 +1,267 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedhostpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	trashInfoFile     = "info.json"
+	trashDataName     = "data"
+	trashReapInterval = 10 * time.Minute
+)
+
+// TrashedVolume is a deleted volume kept at the trash of its pool. The record is stored next to the
+// data, so the volume can be restored after its row is purged.
+type TrashedVolume struct {
+	Volume    Volume    `json:"volume"`
+	DeletedAt time.Time `json:"deletedAt"`
+	dir       string
+}
+
+func (vh *VolumeHelper) SetTrashRetention(retention time.Duration) {
+	vh.trashRetention = retention
+}
+
+// trashVolume moves the data of a deleted volume at path to the trash. Restore and purge of the trashed
+// volume hold the same volume lock.
+func (vh *VolumeHelper) trashVolume(vol *Volume, path string) error {
+	sp, err := vh.getPool(vol.Pool)
+	if err != nil {
+		return err
+	}
+
+	deletedAt := time.Now()
+	if vol.DeletedAt.Valid {
+		deletedAt = vol.DeletedAt.Time
+	}
+	dir := filepath.Join(sp.trash_path, vol.VolID)
+	return vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(vol.VolID); err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// trashed meanwhile
+			return nil
+		}
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(&TrashedVolume{Volume: *vol, DeletedAt: deletedAt}, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, trashInfoFile), data, 0640)
+		}
+		if err == nil {
+			err = os.Rename(path, filepath.Join(dir, trashDataName))
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		klog.V(5).Infof("trashVolume volume %s of %s/%s is moved to %s", vol.VolID, vol.NSName, vol.PVCName, dir)
+		return nil
+	})
+}
+
+// trashDeletingVolumes moves the data of deleted volumes, which cannot be trashed at deletion, to the
+// trash. The dangling volume cleanup keeps them while the trash is enabled.
+func (vh *VolumeHelper) trashDeletingVolumes() {
+	for _, name := range vh.sortedPoolNames() {
+		vols, err := vh.store.GetDeletedPoolVolumes(name)
+		if err != nil {
+			klog.V(5).Error(err, "trashDeletingVolumes cannot get deleted volumes of pool %s", name)
+			continue
+		}
+		for i := range vols {
+			path := vols[i].VolPath + deletingSuffix
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			if err := vh.trashVolume(&vols[i], path); err != nil {
+				klog.V(5).Error(err, "trashDeletingVolumes cannot trash volume %s", vols[i].VolID)
+			}
+		}
+	}
+}
+
+// ListTrashedVolumes returns the trashed volumes of all pools ordered by deletion time.
+func (vh *VolumeHelper) ListTrashedVolumes() ([]TrashedVolume, error) {
+	tvs := []TrashedVolume{}
+	for _, sp := range vh.pools {
+		infos, err := filepath.Glob(filepath.Join(sp.trash_path, "*", trashInfoFile))
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			data, err := ioutil.ReadFile(info)
+			if err != nil {
+				klog.V(5).Error(err, "ListTrashedVolumes cannot read %s", info)
+				continue
+			}
+			var tv TrashedVolume
+			if err := json.Unmarshal(data, &tv); err != nil {
+				klog.V(5).Error(err, "ListTrashedVolumes cannot parse %s", info)
+				continue
+			}
+			tv.dir = filepath.Dir(info)
+			tvs = append(tvs, tv)
+		}
+	}
+	sort.Slice(tvs, func(i, j int) bool {
+		return tvs[i].DeletedAt.Before(tvs[j].DeletedAt)
+	})
+	return tvs, nil
+}
+
+// PurgeTrash trashes the leftovers of deleted volumes, then removes the trashed volumes older than
+// the retention.
+func (vh *VolumeHelper) PurgeTrash() error {
+	vh.trashDeletingVolumes()
+	tvs, err := vh.ListTrashedVolumes()
+	if err != nil {
+		klog.V(5).Error(err, "PurgeTrash cannot list trashed volumes")
+		return err
+	}
+	for _, tv := range tvs {
+		if time.Since(tv.DeletedAt) < vh.trashRetention {
+			continue
+		}
+		purged := false
+		err := vh.store.Transaction(func(store MetadataStore) error {
+			if err := store.LockVolume(tv.Volume.VolID); err != nil {
+				return err
+			}
+			if _, err := os.Stat(filepath.Join(tv.dir, trashInfoFile)); os.IsNotExist(err) {
+				// restored meanwhile
+				return nil
+			}
+			purged = true
+			return os.RemoveAll(tv.dir)
+		})
+		if err != nil {
+			klog.V(5).Error(err, "PurgeTrash cannot remove trashed volume %s", tv.Volume.VolID)
+			continue
+		}
+		if purged {
+			klog.V(5).Infof("PurgeTrash trashed volume %s of %s/%s deleted at %v is purged", tv.Volume.VolID, tv.Volume.NSName, tv.Volume.PVCName, tv.DeletedAt)
+		}
+	}
+	return nil
+}
+
+// RunTrashReaper purges the trash periodically while the controller is the leader, it never returns.
+func (vh *VolumeHelper) RunTrashReaper() {
+	for {
+		if !vh.IsLeader() {
+			time.Sleep(leaderCheckInterval)
+			continue
+		}
+		vh.PurgeTrash()
+		time.Sleep(trashReapInterval)
+	}
+}
+
+// RestoreTrashedVolume moves a trashed volume back with a new volume id and the given pv name, so a
+// static persistent volume can bind it. Symlinks are created by the rebuild job after binding.
+func (vh *VolumeHelper) RestoreTrashedVolume(volid, pvname string) (*Volume, error) {
+	tvs, err := vh.ListTrashedVolumes()
+	if err != nil {
+		return nil, err
+	}
+	var tv *TrashedVolume
+	for i := range tvs {
+		if tvs[i].Volume.VolID == volid {
+			tv = &tvs[i]
+		}
+	}
+	if tv == nil {
+		return nil, fmt.Errorf("trashed volume %s not found", volid)
+	}
+	if _, err := vh.store.GetVolumeByName(pvname); err == nil {
+		return nil, fmt.Errorf("volume with name %s already exists", pvname)
+	}
+
+	sp, err := vh.getPool(tv.Volume.Pool)
+	if err != nil {
+		return nil, err
+	}
+	newid := uuid.New().String()
+	volume_path, err := sp.volumePath(newid)
+	if err != nil {
+		klog.V(5).Error(err, "RestoreTrashedVolume cannot create vols prefix of volume %s", newid)
+		return nil, err
+	}
+
+	vol := tv.Volume
+	vol.StorageID = 0
+	vol.CreatedAt = time.Time{}
+	vol.UpdatedAt = time.Time{}
+	vol.DeletedAt.Valid = false
+	vol.VolID = newid
+	vol.VolName = pvname
+	vol.PVName = pvname
+	vol.VolPath = volume_path
+	vol.ProjectID = 0
+	vol.VolumeCondition = VolumeCondition{}
+	vol.VolumeLease = VolumeLease{}
+
+	data_path := filepath.Join(tv.dir, trashDataName)
+	moved := false
+	err = vh.store.Transaction(func(store MetadataStore) error {
+		// the trashed volume lock keeps the purge away
+		if err := store.LockVolume(volid); err != nil {
+			return err
+		}
+		if _, err := os.Stat(data_path); os.IsNotExist(err) {
+			return fmt.Errorf("trashed volume %s not found", volid)
+		}
+		if err := store.LockVolume(newid); err != nil {
+			return err
+		}
+		if err := store.CreateVolume(&vol); err != nil {
+			return err
+		}
+		if err := os.Rename(data_path, volume_path); err != nil {
+			return err
+		}
+		moved = true
+		if !vol.IsBlock {
+			return vh.enforceVolumeCapacity(store, &vol)
+		}
+		return nil
+	})
+	if err != nil {
+		klog.V(5).Error(err, "RestoreTrashedVolume cannot restore volume %s", volid)
+		if moved {
+			os.Rename(volume_path, data_path)
+		}
+		return nil, err
+	}
+
+	os.RemoveAll(tv.dir)
+	klog.V(5).Infof("RestoreTrashedVolume volume %s is restored as %s for pv %s", volid, newid, pvname)
+	return &vol, nil
+}
@@ -17,277 +17,701 @@ limitations under the License.
 package sharedhostpath
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
 	utilexec "k8s.io/utils/exec"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
-	dbname       = "definitions.db"
-	volume_base  = "vols"
-	symlink_base = "syms"
-	MiB          = 1 << 20
-	GiB          = 1 << 30
+	dbname        = "definitions.db"
+	volume_base   = "vols"
+	symlink_base  = "syms"
+	snapshot_base = "snaps"
+	trash_base    = "trash"
+	defaultPool   = "default"
+	poolMarker    = ".sharedhostpath-pool"
+	MiB           = 1 << 20
+	GiB           = 1 << 30
 )
 
+const (
+	copyMethodReflink = "reflink"
+	copyMethodSparse  = "sparse"
+)
+
+const (
+	projectIDBase = 100000
+	// projectIDLockKey is locked like a volume by every transaction which allocates a project id,
+	// so all driver instances see the ids given before.
+	projectIDLockKey = "project-id-allocation"
+)
+
+var defaultVolumeOwnership = VolumeOwnership{UID: 0, GID: 0, Mode: 0770}
+
+var errProjectQuotaNotSupported = errors.New("project quota is not supported")
+
+var errSnapshotNotReady = errors.New("snapshot is not ready")
+
+var poolNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+
 type volumeStatistics struct {
 	availableBytes, totalBytes, usedBytes    int64
 	availableInodes, totalInodes, usedInodes int64
 }
 
+type storagePool struct {
+	name       string
+	root       string
+	vols_path  string
+	syms_path  string
+	snaps_path string
+	trash_path string
+}
+
+// deletingSuffix is appended to the path of volumes and snapshots while they are deleted.
+const deletingSuffix = ".deleting"
+
+// failStep is called before each filesystem step of the volume and snapshot mutations,
+// tests replace it to inject failures.
+var failStep = func(step string) error { return nil }
+
 type VolumeHelper struct {
-	vols_path string
-	syms_path string
-	db        *gorm.DB
-	dsn       string
+	pools map[string]*storagePool
+	store MetadataStore
+	dsn   string
+
+	// deleted volumes are kept at the trash of their pool for the retention, zero removes them at once.
+	trashRetention time.Duration
+
+	// the volume monitor of the controller checks the volumes at the interval, zero disables it.
+	monitorInterval       time.Duration
+	monitorMinFreePercent float64
+	eventClient           kubernetes.Interface
+
+	// nodes which are not seen for the timeout are dead, zero disables the node reaper.
+	nodeTimeout        time.Duration
+	nodeForceUnpublish bool
+
+	// only the leader among the controllers runs the monitor and the reapers, it is set atomically.
+	leader int32
+
+	// the leases held by the node, when the helper serves a node.
+	leases heldLeases
+	// the leases of other nodes which the node waits to take over.
+	observed observedLeases
 }
 
 type Volume struct {
-	StorageID int64 `gorm:"autoIncrement"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
-	VolID     string         `gorm:"uniqueIndex; not null"`
-	VolName   string         `gorm:"index; not null"`
-	PVName    string         `gorm:"not null"`
-	PVCName   string         `gorm:"not null"`
-	NSName    string         `gorm:"index; not null"`
-	Capacity  int64
-	IsBlock   bool
-	VolPath   string `gorm:"uniqueIndex; not null"`
+	StorageID    int64          `gorm:"autoIncrement" json:"storageId"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	VolID        string         `gorm:"uniqueIndex; not null" json:"volumeId"`
+	VolName      string         `gorm:"index; not null" json:"volumeName"`
+	PVName       string         `gorm:"not null" json:"pvName"`
+	PVCName      string         `gorm:"not null" json:"pvcName"`
+	NSName       string         `gorm:"index; not null" json:"namespace"`
+	Capacity     int64          `json:"capacity"`
+	IsBlock      bool           `json:"isBlock"`
+	VolPath      string         `gorm:"uniqueIndex; not null" json:"volumePath"`
+	Pool         string         `gorm:"index; not null; default:default" json:"pool"`
+	SourceSnapID string         `gorm:"index" json:"sourceSnapshotId"`
+	ParentVolID  string         `gorm:"index" json:"parentVolumeId"`
+	ProjectID    uint32         `json:"projectId"`
+	OwnerUID     int            `json:"ownerUid"`
+	OwnerGID     int            `json:"ownerGid"`
+	Mode         uint32         `json:"mode"`
+	// VolumeCondition is the result of the last check of the volume monitor.
+	VolumeCondition VolumeCondition `gorm:"type:text" json:"volumeCondition"`
+	// VolumeLease is the exclusive ownership of a writable disk volume by a node.
+	VolumeLease VolumeLease `gorm:"type:text" json:"volumeLease"`
+}
+
+// VolumeCondition is stored as a single json column, a zero CheckedAt means the volume is not checked yet.
+type VolumeCondition struct {
+	Abnormal  bool      `json:"abnormal"`
+	Message   string    `json:"message"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+func (vc VolumeCondition) Value() (driver.Value, error) {
+	data, err := json.Marshal(vc)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (vc *VolumeCondition) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*vc = VolumeCondition{}
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), vc)
+	case []byte:
+		return json.Unmarshal(data, vc)
+	}
+	return fmt.Errorf("cannot scan volume condition from %T", value)
+}
+
+// VolumeLease is stored as a single json column, an empty NodeID means no node holds the lease.
+type VolumeLease struct {
+	NodeID    string    `json:"nodeId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (vl VolumeLease) Value() (driver.Value, error) {
+	data, err := json.Marshal(vl)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (vl *VolumeLease) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*vl = VolumeLease{}
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), vl)
+	case []byte:
+		return json.Unmarshal(data, vl)
+	}
+	return fmt.Errorf("cannot scan volume lease from %T", value)
+}
+
+type VolumeOwnership struct {
+	UID  int
+	GID  int
+	Mode uint32
+}
+
+type Snapshot struct {
+	StorageID     int64          `gorm:"autoIncrement" json:"storageId"`
+	CreatedAt     time.Time      `json:"createdAt"`
+	UpdatedAt     time.Time      `json:"updatedAt"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	SnapID        string         `gorm:"uniqueIndex; not null" json:"snapshotId"`
+	SnapName      string         `gorm:"index; not null" json:"snapshotName"`
+	SourceVolID   string         `gorm:"index; not null" json:"sourceVolumeId"`
+	Size          int64          `json:"size"`
+	AllocatedSize int64          `json:"allocatedSize"`
+	CopyMethod    string         `json:"copyMethod"`
+	IsBlock       bool           `json:"isBlock"`
+	ReadyToUse    bool           `json:"readyToUse"`
+	SnapPath      string         `gorm:"uniqueIndex; not null" json:"snapshotPath"`
+	Pool          string         `gorm:"index; not null; default:default" json:"pool"`
 }
 
 type NodeInfo struct {
-	ID       string    `gorm:"primaryKey"`
-	LastSeen time.Time `sql:"DEFAULT:current_timestamp"`
+	ID       string    `gorm:"primaryKey" json:"id"`
+	LastSeen time.Time `sql:"DEFAULT:current_timestamp" json:"lastSeen"`
+	// Dead is set by the node reaper and cleared when the node reports again.
+	Dead bool `json:"dead"`
 }
 
 type ControllerPublishVolumeInfo struct {
-	StorageID int64 `gorm:"autoIncrement"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
-	VolID     string         `gorm:"index; not null"`
-	NodeID    string         `gorm:"index; not null"`
-	ReadOnly  bool
+	StorageID int64          `gorm:"autoIncrement" json:"storageId"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	VolID     string         `gorm:"index; not null" json:"volumeId"`
+	NodeID    string         `gorm:"index; not null" json:"nodeId"`
+	ReadOnly  bool           `json:"readOnly"`
 }
 
 type NodePublishVolumeInfo struct {
-	StorageID int64 `gorm:"autoIncrement"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
-	VolID     string         `gorm:"index; not null"`
-	NodeID    string         `gorm:"index; not null"`
-	MountPath string
-	RawMount  bool
-	ReadOnly  bool
+	StorageID int64          `gorm:"autoIncrement" json:"storageId"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	VolID     string         `gorm:"index; not null" json:"volumeId"`
+	NodeID    string         `gorm:"index; not null" json:"nodeId"`
+	MountPath string         `json:"mountPath"`
+	RawMount  bool           `json:"rawMount"`
+	ReadOnly  bool           `json:"readOnly"`
 }
 
-func NewVolumeHelper(dataRoot, dsn string) (*VolumeHelper, error) {
+func ParsePools(dataRoot, pools string) (map[string]string, error) {
+	result := make(map[string]string)
+	if dataRoot != "" {
+		result[defaultPool] = dataRoot
+	}
+	if pools == "" {
+		return result, nil
+	}
+	for _, pool := range strings.Split(pools, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pool), "=", 2)
+		if len(kv) != 2 || !poolNameRegexp.MatchString(kv[0]) || kv[1] == "" {
+			return nil, fmt.Errorf("invalid pool definition: %s", pool)
+		}
+		if _, found := result[kv[0]]; found {
+			return nil, fmt.Errorf("duplicate pool definition: %s", kv[0])
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
+func newStoragePool(name, dataRoot string) (*storagePool, error) {
 	dataRoot, _ = filepath.Abs(dataRoot)
 	vols_path := filepath.Join(dataRoot, volume_base)
 	err := os.MkdirAll(vols_path, 0750)
 	if err != nil {
-		klog.V(5).Error(err, "NewVolumeHelper cannot create vols path: %s", vols_path)
+		klog.V(5).Error(err, "newStoragePool cannot create vols path: %s", vols_path)
 		return nil, err
 	}
 
 	syms_path := filepath.Join(dataRoot, symlink_base)
 	err = os.MkdirAll(syms_path, 0750)
 	if err != nil {
-		klog.V(5).Error(err, "NewVolumeHelper cannot cannot create vols path: %s", syms_path)
+		klog.V(5).Error(err, "newStoragePool cannot cannot create vols path: %s", syms_path)
 		return nil, err
 	}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	snaps_path := filepath.Join(dataRoot, snapshot_base)
+	err = os.MkdirAll(snaps_path, 0750)
 	if err != nil {
-		klog.V(5).Error(err, "NewVolumeHelper cannot can not create db file %s", dsn)
+		klog.V(5).Error(err, "newStoragePool cannot create snaps path: %s", snaps_path)
 		return nil, err
 	}
-	sqlDB, err := db.DB()
-	sqlDB.SetMaxOpenConns(5)
-	klog.V(5).Infof("NewVolumeHelper db connection established")
-
-	err = db.AutoMigrate(&Volume{}, &NodeInfo{}, &ControllerPublishVolumeInfo{}, &NodePublishVolumeInfo{})
 
+	trash_path := filepath.Join(dataRoot, trash_base)
+	err = os.MkdirAll(trash_path, 0750)
 	if err != nil {
-		klog.V(5).Error(err, "NewVolumeHelper cannot create db schema on dsn %s", dsn)
+		klog.V(5).Error(err, "newStoragePool cannot create trash path: %s", trash_path)
 		return nil, err
 	}
-	klog.V(5).Info("NewVolumeHelper database schema created")
 
-	vh := &VolumeHelper{
-		vols_path: vols_path,
-		syms_path: syms_path,
-		db:        db,
-		dsn:       dsn,
+	return &storagePool{
+		name:       name,
+		root:       dataRoot,
+		vols_path:  vols_path,
+		syms_path:  syms_path,
+		snaps_path: snaps_path,
+		trash_path: trash_path,
+	}, nil
+}
+
+// volumePath creates the prefix folders of the volume and returns its path.
+func (sp *storagePool) volumePath(volid string) (string, error) {
+	prefix := fmt.Sprintf("%s/%s/%s/%s", sp.vols_path, volid[0:2], volid[2:4], volid[4:6])
+	prefix = filepath.FromSlash(prefix)
+
+	if err := os.MkdirAll(prefix, 0750); err != nil {
+		return "", err
 	}
+	return filepath.Join(prefix, volid), nil
+}
 
-	klog.V(5).Infof("NewVolumeHelper volume helper is created")
-	return vh, nil
+func NewVolumeHelper(dataRoot, dsn string) (*VolumeHelper, error) {
+	return NewVolumeHelperWithPools(map[string]string{defaultPool: dataRoot}, dsn)
 }
 
-func (vh *VolumeHelper) CreateVolume(volid, volname, pvname, pvcname, nsname string, capacity int64, isblock bool) (*Volume, error) {
-	var err error = nil
+func NewVolumeHelperWithPools(pools map[string]string, dsn string) (*VolumeHelper, error) {
+	if len(pools) == 0 {
+		return nil, errors.New("no storage pool provided")
+	}
 
-	prefix := fmt.Sprintf("%s/%s/%s/%s", vh.vols_path, volid[0:2], volid[2:4], volid[4:6])
-	prefix = filepath.FromSlash(prefix)
+	storagePools := make(map[string]*storagePool)
+	for name, dataRoot := range pools {
+		pool, err := newStoragePool(name, dataRoot)
+		if err != nil {
+			klog.V(5).Error(err, "NewVolumeHelper cannot create storage pool %s at %s", name, dataRoot)
+			return nil, err
+		}
+		storagePools[name] = pool
+	}
 
-	err = os.MkdirAll(prefix, 0750)
+	dataRoot := pools[defaultPool]
+	if dataRoot == "" {
+		dataRoot = storagePools[firstPoolName(pools)].root
+	}
+	store, err := NewMetadataStore(dsn, dataRoot)
 	if err != nil {
-		klog.V(5).Error(err, "CreateVolume cannot create vols prefix: %s", prefix)
+		klog.V(5).Error(err, "NewVolumeHelper cannot create metadata store")
 		return nil, err
 	}
 
-	volume_path := filepath.Join(prefix, volid)
+	vh := &VolumeHelper{
+		pools: storagePools,
+		store: newMetricsStore(store),
+		dsn:   dsn,
+	}
 
-	tx := vh.db.Begin()
-	if tx == nil || vh.db.Error != nil {
-		klog.V(5).Error(err, "CreateVolume cannot start transaction")
-		return nil, vh.db.Error
+	klog.V(5).Infof("NewVolumeHelper volume helper is created")
+	return vh, nil
+}
+
+func firstPoolName(pools map[string]string) string {
+	var names []string
+	for name := range pools {
+		names = append(names, name)
 	}
-	defer func() {
-		if err := recover(); err != nil {
-			tx.Rollback()
-			klog.V(5).Error(errors.New(fmt.Sprintf("%v", err)), "CreateVolume an error accured while trans, rollback performed")
-		}
-	}()
+	sort.Strings(names)
+	return names[0]
+}
 
-	vol := Volume{VolID: volid, VolName: volname, PVName: pvname,
-		PVCName: pvcname, NSName: nsname,
-		Capacity: capacity, IsBlock: isblock,
-		VolPath: volume_path}
+func (vh *VolumeHelper) CreateVolume(volid, volname, pvname, pvcname, nsname, pool string, capacity int64, isblock bool, owner VolumeOwnership) (*Volume, error) {
+	return vh.createVolume(volid, volname, pvname, pvcname, nsname, pool, capacity, isblock, owner, "", "", "")
+}
 
-	result := tx.Create(&vol)
+func (vh *VolumeHelper) CreateVolumeFromSnapshot(volid, volname, pvname, pvcname, nsname, pool string, capacity int64, isblock bool, owner VolumeOwnership, snap *Snapshot) (*Volume, error) {
+	if snap.IsBlock != isblock {
+		err := fmt.Errorf("snapshot %s and volume %s types dismatch", snap.SnapID, volid)
+		klog.V(5).Error(err, "CreateVolumeFromSnapshot cannot restore snapshot")
+		return nil, err
+	}
+	if capacity < snap.Size {
+		err := fmt.Errorf("volume %s capacity %d is smaller than snapshot %s size %d", volid, capacity, snap.SnapID, snap.Size)
+		klog.V(5).Error(err, "CreateVolumeFromSnapshot cannot restore snapshot")
+		return nil, err
+	}
+	return vh.createVolume(volid, volname, pvname, pvcname, nsname, pool, capacity, isblock, owner, snap.SnapID, "", snap.SnapPath)
+}
+
+func (vh *VolumeHelper) CreateVolumeFromVolume(volid, volname, pvname, pvcname, nsname, pool string, capacity int64, isblock bool, owner VolumeOwnership, parent *Volume) (*Volume, error) {
+	if parent.IsBlock != isblock {
+		err := fmt.Errorf("parent volume %s and volume %s types dismatch", parent.VolID, volid)
+		klog.V(5).Error(err, "CreateVolumeFromVolume cannot clone volume")
+		return nil, err
+	}
+	if capacity < parent.Capacity {
+		err := fmt.Errorf("volume %s capacity %d is smaller than parent volume %s capacity %d", volid, capacity, parent.VolID, parent.Capacity)
+		klog.V(5).Error(err, "CreateVolumeFromVolume cannot clone volume")
+		return nil, err
+	}
+	return vh.createVolume(volid, volname, pvname, pvcname, nsname, pool, capacity, isblock, owner, "", parent.VolID, parent.VolPath)
+}
 
-	if result.Error != nil {
-		tx.Rollback()
-		klog.V(5).Error(err, "CreateVolume cannot insert volume data into db")
-		return nil, result.Error
+func (vh *VolumeHelper) createVolume(volid, volname, pvname, pvcname, nsname, pool string, capacity int64, isblock bool, owner VolumeOwnership, sourceSnapID, parentVolID, sourcePath string) (*Volume, error) {
+	sp, err := vh.getPool(pool)
+	if err != nil {
+		klog.V(5).Error(err, "CreateVolume cannot find storage pool")
+		return nil, err
 	}
 
-	_, err = vol.PopulateVolumeIfRequired()
+	volume_path, err := sp.volumePath(volid)
 	if err != nil {
-		tx.Rollback()
-		klog.V(5).Error(err, "CreateVolume cannot populate volume")
+		klog.V(5).Error(err, "CreateVolume cannot create vols prefix of volume %s", volid)
 		return nil, err
 	}
 
-	symlink_dir := filepath.Join(vh.syms_path, vol.NSName)
+	vol := Volume{VolID: volid, VolName: volname, PVName: pvname,
+		PVCName: pvcname, NSName: nsname,
+		Capacity: capacity, IsBlock: isblock,
+		VolPath:      volume_path,
+		Pool:         sp.name,
+		SourceSnapID: sourceSnapID,
+		ParentVolID:  parentVolID,
+		OwnerUID:     owner.UID,
+		OwnerGID:     owner.GID,
+		Mode:         owner.Mode}
+
+	symlink_dir := filepath.Join(sp.syms_path, vol.NSName)
 	symlink_file := filepath.Join(symlink_dir, vol.PVCName)
-	err = os.MkdirAll(symlink_dir, 0750)
-	if err == nil {
+
+	// the volume is prepared at disk inside the transaction, the record is committed only after
+	// all filesystem steps succeed, otherwise the files are removed.
+	populated := false
+	err = vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(volid); err != nil {
+			return err
+		}
+		// the source snapshot is locked until the restore ends, so it cannot be deleted while it is copied.
+		if sourceSnapID != "" {
+			if err := store.LockVolume(sourceSnapID); err != nil {
+				return err
+			}
+			snap, err := store.GetSnapshot(sourceSnapID)
+			if err != nil {
+				klog.V(5).Error(err, "CreateVolume cannot get source snapshot %s", sourceSnapID)
+				return err
+			}
+			if !snap.ReadyToUse {
+				return errSnapshotNotReady
+			}
+		}
+		// the parent is locked for the whole copy, so it cannot be deleted or expanded meanwhile. a disk
+		// which is written by a live node is not cloned, the copy would not be consistent.
+		if parentVolID != "" {
+			if err := store.LockVolume(parentVolID); err != nil {
+				return err
+			}
+			parent, err := store.GetVolume(parentVolID)
+			if err != nil {
+				klog.V(5).Error(err, "CreateVolume cannot get parent volume %s", parentVolID)
+				return err
+			}
+			if parent.IsBlock {
+				if err := checkVolumeLease(store, parent, "", time.Now()); err != nil {
+					klog.V(5).Error(err, "CreateVolume cannot clone parent volume %s", parentVolID)
+					return err
+				}
+			}
+		}
+		populated = true
+		err := failStep("CreateVolume/populate")
 		if err == nil {
-			os.Symlink(vol.VolPath, symlink_file)
+			if sourcePath != "" {
+				err = vol.PopulateVolumeFromSource(sourcePath)
+			} else {
+				_, err = vol.PopulateVolumeIfRequired()
+			}
 		}
-	}
+		if err != nil {
+			klog.V(5).Error(err, "CreateVolume cannot populate volume")
+			return err
+		}
+
+		if !vol.IsBlock {
+			err = failStep("CreateVolume/quota")
+			if err == nil {
+				err = vh.assignProjectID(store, &vol)
+			}
+			if err != nil {
+				klog.V(5).Error(err, "CreateVolume cannot enforce volume capacity")
+				return err
+			}
+		}
+
+		err = failStep("CreateVolume/symlink")
+		if err == nil {
+			err = createSymlink(vol.VolPath, symlink_dir, symlink_file)
+		}
+		if err != nil {
+			klog.V(5).Error(err, "CreateVolume cannot create symlink %s", symlink_file)
+			return err
+		}
+
+		// the record is inserted last, so the name lookup does not find a volume which is not populated yet
+		if err := store.CreateVolume(&vol); err != nil {
+			klog.V(5).Error(err, "CreateVolume cannot insert volume data into db")
+			return err
+		}
+		return nil
+	})
 
-	err = tx.Commit().Error
 	if err != nil {
-		tx.Rollback()
-		klog.V(5).Error(err, "CreateVolume cannot create volume dir: %s %v", volume_path)
-		os.RemoveAll(volume_path)
-		os.RemoveAll(symlink_file)
+		klog.V(5).Error(err, "CreateVolume cannot create volume %s", volid)
+		if populated {
+			if vol.ProjectID != 0 {
+				if qerr := updateProjectQuota(volume_path, vol.ProjectID, 0); qerr != nil {
+					klog.V(5).Error(qerr, "CreateVolume cannot clear project quota of volume %s", volid)
+				}
+			}
+			os.Remove(symlink_file)
+			os.RemoveAll(volume_path)
+		}
 		return nil, err
-	} else {
-		klog.V(5).Infof("CreateVolume volume %s created for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
 	}
+	klog.V(5).Infof("CreateVolume volume %s created for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
 	return &vol, nil
 }
 
-func (vh *VolumeHelper) GetVolume(volid string) (*Volume, error) {
-	var vol Volume
-	result := vh.db.Where("vol_id = ?", volid).First(&vol)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return nil, result.Error
+// enforceVolumeCapacity gives the next project id to the stored volume. It is called late in the
+// transaction, since the project id lock is held until the transaction ends.
+func (vh *VolumeHelper) enforceVolumeCapacity(store MetadataStore, vol *Volume) error {
+	if err := vh.assignProjectID(store, vol); err != nil {
+		return err
+	}
+	if vol.ProjectID == 0 {
+		return nil
 	}
-	return &vol, result.Error
+	return store.UpdateVolumeProjectID(vol.VolID, vol.ProjectID)
 }
 
-func (vh *VolumeHelper) UpdateVolumeCapacity(vol *Volume, capacity int64) error {
-
-	tx := vh.db.Begin()
-	err := vh.db.Error
-	if tx == nil || err != nil {
-		klog.V(5).Error(err, "UpdateVolumeCapacity cannot start transaction")
-		return vh.db.Error
+// assignProjectID sets the quota of the next project id to the volume folder and keeps the id at the
+// volume, the caller stores it with the volume record.
+func (vh *VolumeHelper) assignProjectID(store MetadataStore, vol *Volume) error {
+	if err := store.LockVolume(projectIDLockKey); err != nil {
+		klog.V(5).Error(err, "enforceVolumeCapacity cannot lock project ids")
+		return err
+	}
+	maxProjectID, err := store.GetMaxProjectID()
+	if err != nil {
+		klog.V(5).Error(err, "enforceVolumeCapacity cannot get max project id")
+		return err
+	}
+	projectID := maxProjectID + 1
+	if projectID < projectIDBase {
+		projectID = projectIDBase
 	}
 
-	oldCapacity := vol.Capacity
-	vol.Capacity = capacity
-	err = vh.db.Model(&Volume{}).Where("vol_id = ?", vol.VolID).Update("capacity", vol.Capacity).Error
+	err = setProjectQuota(vol.VolPath, projectID, vol.Capacity)
+	if errors.Is(err, errProjectQuotaNotSupported) {
+		klog.V(5).Infof("enforceVolumeCapacity capacity of volume %s is not enforced: %v", vol.VolID, err)
+		return nil
+	}
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	if vol.IsBlock {
-		volume_path := vol.VolPath
-		fi, err := os.Stat(volume_path)
+	vol.ProjectID = projectID
+	return nil
+}
 
+func (vh *VolumeHelper) getPool(pool string) (*storagePool, error) {
+	if pool == "" {
+		pool = defaultPool
+	}
+	sp, found := vh.pools[pool]
+	if !found {
+		return nil, fmt.Errorf("storage pool %s not found", pool)
+	}
+	return sp, nil
+}
+
+func (vh *VolumeHelper) HasPool(pool string) bool {
+	_, err := vh.getPool(pool)
+	return err == nil
+}
+
+func (vh *VolumeHelper) WritePoolMarkers() error {
+	for _, sp := range vh.pools {
+		marker := filepath.Join(sp.root, poolMarker)
+		err := ioutil.WriteFile(marker, []byte(sp.name), 0640)
 		if err != nil {
-			tx.Rollback()
-			errstr := fmt.Sprintf("UpdateVolumeCapacity rollback: expanding volume error: cannot stat file: %s : %v", volume_path, err)
-			err = errors.New(errstr)
-			klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
+			klog.V(5).Error(err, "WritePoolMarkers cannot write marker of pool %s", sp.name)
 			return err
 		}
+	}
+	return nil
+}
 
-		if fi.Size() != oldCapacity {
-			tx.Rollback()
-			errstr := fmt.Sprintf("UpdateVolumeCapacity rollback: expanding volume error: file size dismatch: db-> %v os-> %v", oldCapacity, fi.Size())
-			err = errors.New(errstr)
-			klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
-			return err
+func (vh *VolumeHelper) GetMountedPools() []string {
+	var pools []string
+	for _, sp := range vh.pools {
+		data, err := ioutil.ReadFile(filepath.Join(sp.root, poolMarker))
+		if err != nil {
+			klog.V(5).Infof("GetMountedPools pool %s is not mounted: %v", sp.name, err)
+			continue
+		}
+		if string(data) != sp.name {
+			klog.V(5).Infof("GetMountedPools pool %s has marker of pool %s", sp.name, string(data))
+			continue
 		}
+		pools = append(pools, sp.name)
+	}
+	sort.Strings(pools)
+	return pools
+}
+
+func (vh *VolumeHelper) GetVolume(volid string) (*Volume, error) {
+	return vh.store.GetVolume(volid)
+}
 
-		executor := utilexec.New()
-		cap_str := fmt.Sprintf("seek=%d", vol.Capacity)
-		vp_str := fmt.Sprintf("of=%s", vol.VolPath)
-		var output []byte
-		output, err = executor.Command("dd", "if=/dev/null", "bs=1", "count=0", cap_str, vp_str).CombinedOutput()
+func (vh *VolumeHelper) UpdateVolumeCapacity(vol *Volume, capacity int64) error {
+	// the volume is read again under the lock, an expansion which runs meanwhile changes it
+	var locked *Volume
+	var oldCapacity int64
+	expanded := false
+	err := vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(vol.VolID); err != nil {
+			return err
+		}
+		var err error
+		locked, err = store.GetVolume(vol.VolID)
+		if err != nil {
+			return err
+		}
+		oldCapacity = locked.Capacity
+		if oldCapacity >= capacity {
+			klog.V(5).Infof("UpdateVolumeCapacity volume %s is already expanded to %d", vol.VolID, oldCapacity)
+			return nil
+		}
+		err = store.UpdateVolumeCapacity(vol.VolID, capacity)
 		if err != nil {
-			tx.Rollback()
-			errstr := fmt.Sprintf("UpdateVolumeCapacity cannot expand volume file: %s %v %s", vol.VolPath, err.Error(), string(output))
-			err = errors.New(errstr)
-			klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
 			return err
 		}
 
-	}
+		if locked.IsBlock {
+			volume_path := locked.VolPath
+			fi, err := os.Stat(volume_path)
+
+			if err != nil {
+				errstr := fmt.Sprintf("UpdateVolumeCapacity rollback: expanding volume error: cannot stat file: %s : %v", volume_path, err)
+				err = errors.New(errstr)
+				klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
+				return err
+			}
+
+			if fi.Size() != oldCapacity {
+				errstr := fmt.Sprintf("UpdateVolumeCapacity rollback: expanding volume error: file size dismatch: db-> %v os-> %v", oldCapacity, fi.Size())
+				err = errors.New(errstr)
+				klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
+				return err
+			}
+
+			if err = failStep("UpdateVolumeCapacity/expand"); err != nil {
+				klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
+				return err
+			}
+
+			executor := utilexec.New()
+			cap_str := fmt.Sprintf("seek=%d", capacity)
+			vp_str := fmt.Sprintf("of=%s", locked.VolPath)
+			var output []byte
+			expanded = true
+			output, err = executor.Command("dd", "if=/dev/null", "bs=1", "count=0", cap_str, vp_str).CombinedOutput()
+			if err != nil {
+				errstr := fmt.Sprintf("UpdateVolumeCapacity cannot expand volume file: %s %v %s", locked.VolPath, err.Error(), string(output))
+				err = errors.New(errstr)
+				klog.V(5).Error(err, "UpdateVolumeCapacity error occured")
+				return err
+			}
+
+		} else if locked.ProjectID != 0 {
+			err = failStep("UpdateVolumeCapacity/quota")
+			if err == nil {
+				expanded = true
+				err = updateProjectQuota(locked.VolPath, locked.ProjectID, capacity)
+			}
+			if err != nil {
+				klog.V(5).Error(err, "UpdateVolumeCapacity cannot update project quota of volume %s", vol.VolID)
+				return err
+			}
+		}
+		return nil
+	})
 
 	if err != nil {
-		klog.V(5).Error(err, "UpdateVolumeCapacity there is an error while expanding volume, tran will be rollbacked")
-		tx.Rollback()
 		klog.V(5).Error(err, "UpdateVolumeCapacity volume %s cannot be expanded for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
-	} else {
-		err = tx.Commit().Error
+		if expanded {
+			if rerr := revertVolumeCapacity(locked, oldCapacity); rerr != nil {
+				klog.V(5).Error(rerr, "UpdateVolumeCapacity cannot revert capacity of volume %s", vol.VolID)
+			}
+		}
+		return err
 	}
-	if err == nil {
-		klog.V(5).Infof("UpdateVolumeCapacity volume %s expanded for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
+	vol.Capacity = capacity
+	if oldCapacity > capacity {
+		vol.Capacity = oldCapacity
 	}
-
-	return err
+	klog.V(5).Infof("UpdateVolumeCapacity volume %s expanded for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
+	return nil
 }
 
 func (vh *VolumeHelper) GetVolumeWithDetail(volid string) (map[string]interface{}, error) {
-	var vol Volume
-	var err error
-
 	klog.V(5).Infof("GetVolumeWithDetail volume details will be obtained for %s", volid)
 
-	result := vh.db.Where("vol_id = ?", volid).First(&vol)
-	err = result.Error
+	vol, err := vh.store.GetVolume(volid)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		if errors.Is(err, ErrRecordNotFound) {
 			return nil, nil
 		} else {
 			klog.V(5).Error(err, "GetVolumeWithDetail cannot get volume list from db")
@@ -295,19 +719,26 @@ func (vh *VolumeHelper) GetVolumeWithDetail(volid string) (map[string]interface{
 		}
 	}
 
+	vol_detail, err := vh.volumeDetail(vol)
+	if err != nil {
+		klog.V(5).Error(err, "GetVolumeWithDetail cannot get volume published node list from db")
+		return nil, err
+	}
+
+	klog.V(5).Infof("GetVolumeWithDetail volume detail obtained for %s", volid)
+	return vol_detail, nil
+}
+
+func (vh *VolumeHelper) volumeDetail(vol *Volume) (map[string]interface{}, error) {
 	vol_detail := make(map[string]interface{})
 
 	var node_ids []string
-	var cpvis []ControllerPublishVolumeInfo
-	result = vh.db.Where("vol_id = ?", vol.VolID).Find(&cpvis)
-	err = result.Error
+	cpvis, err := vh.store.GetControllerPublishVolumeInfos(vol.VolID)
 	if err != nil {
-		klog.V(5).Error(err, "GetVolumeWithDetail cannot get volume published node list from db")
 		return nil, err
-	} else {
-		for _, cpvi := range cpvis {
-			node_ids = append(node_ids, cpvi.NodeID)
-		}
+	}
+	for _, cpvi := range cpvis {
+		node_ids = append(node_ids, cpvi.NodeID)
 	}
 
 	vol_detail["published_node_ids"] = node_ids
@@ -322,93 +753,46 @@ func (vh *VolumeHelper) GetVolumeWithDetail(volid string) (map[string]interface{
 	vol_detail["parameters"] = params
 	vol_detail["capacity"] = vol.Capacity
 
-	vol_detail["condition_abnormal"] = true
-	var fi os.FileInfo
-	fi, err = os.Stat(vol.VolPath)
-	if err != nil {
-		vol_detail["condition_msg"] = err.Error()
-	} else {
-		if vol.IsBlock && fi.Size() != vol.Capacity {
-			vol_detail["condition_msg"] = "file size dismatch"
-		} else {
-			vol_detail["condition_msg"] = "ok"
-			vol_detail["condition_abnormal"] = false
-		}
+	// the condition stored by the volume monitor is served when it exists
+	condition := vol.VolumeCondition
+	if condition.CheckedAt.IsZero() {
+		condition = checkVolumeCondition(vol)
 	}
+	vol_detail["condition_abnormal"] = condition.Abnormal
+	vol_detail["condition_msg"] = condition.Message
 	vol_detail["volumeId"] = vol.VolID
+	vol_detail["source_snapshot_id"] = vol.SourceSnapID
+	vol_detail["parent_volume_id"] = vol.ParentVolID
+	vol_detail["pool"] = vol.Pool
 
-	klog.V(5).Infof("GetVolumeWithDetail volume detail obtained for %s", volid)
 	return vol_detail, nil
 }
 
 func (vh *VolumeHelper) GetVolumeCount() (int, error) {
-	var vols []Volume
-	vh.db.Select("vol_id").Find(&vols)
-	err := vh.db.Error
+	vc, err := vh.store.GetVolumeCount()
 	if err != nil {
 		klog.V(5).Error(err, "GetVolumeCount cannot get volume count from db")
 		return 0, err
 	}
-	vc := len(vols)
 	klog.V(5).Infof("GetVolumeCount volume count: %d", vc)
 	return vc, nil
 }
 
 func (vh *VolumeHelper) GetVolumesWithDetail(offset, limit int) ([]map[string]interface{}, error) {
-	var vols []Volume
-	var err error
 	klog.V(5).Infof("GetVolumesWithDetail volume details will be obtained from %v to %v", offset, limit)
-	vh.db.Offset(offset).Limit(limit).Find(&vols)
-	err = vh.db.Error
+	vols, err := vh.store.GetVolumes(offset, limit)
 	if err != nil {
 		klog.V(5).Error(err, "GetVolumesWithDetail cannot get volume list from db")
 		return nil, err
 	}
 	var vol_list []map[string]interface{}
 
-	for _, vol := range vols {
-		vol_detail := make(map[string]interface{})
-
-		var node_ids []string
-		var cpvis []ControllerPublishVolumeInfo
-		vh.db.Where("vol_id = ?", vol.VolID).Find(&cpvis)
-		err = vh.db.Error
+	for i := range vols {
+		vol_detail, err := vh.volumeDetail(&vols[i])
 		if err != nil {
 			klog.V(5).Error(err, "cannot get volume published node list from db")
 			return nil, err
-		} else {
-			for _, cpvi := range cpvis {
-				node_ids = append(node_ids, cpvi.NodeID)
-			}
-		}
-
-		vol_detail["published_node_ids"] = node_ids
-		params := make(map[string]string)
-		params[pvNameKey] = vol.PVName
-		params[pvcNameKey] = vol.PVCName
-		params[pvcNamespaceKey] = vol.NSName
-		params[typeParameter] = "folder"
-		if vol.IsBlock {
-			params[typeParameter] = "disk"
-		}
-		vol_detail["parameters"] = params
-		vol_detail["capacity"] = vol.Capacity
-
-		vol_detail["condition_abnormal"] = true
-		var fi os.FileInfo
-		fi, err := os.Stat(vol.VolPath)
-		if err != nil {
-			vol_detail["condition_msg"] = err.Error()
-		} else {
-			if vol.IsBlock && fi.Size() != vol.Capacity {
-				vol_detail["condition_msg"] = "file size dismatch"
-			} else {
-				vol_detail["condition_msg"] = "ok"
-				vol_detail["condition_abnormal"] = false
-			}
 		}
-		vol_detail["volumeId"] = vol.VolID
-
 		vol_list = append(vol_list, vol_detail)
 	}
 
@@ -425,74 +809,120 @@ func (vh *VolumeHelper) DeleteVolume(volid string) error {
 	}
 
 	volume_path := vol.VolPath
-
-	tx := vh.db.Begin()
-	if tx == nil || vh.db.Error != nil {
-		klog.V(5).Error(err, "DeleteVolume cannot start transaction")
-		return vh.db.Error
+	trash_path := volume_path + deletingSuffix
+	symlink_dir, symlink_file := "", ""
+	if sp, err := vh.getPool(vol.Pool); err == nil {
+		symlink_dir = filepath.Join(sp.syms_path, vol.NSName)
+		symlink_file = filepath.Join(symlink_dir, vol.PVCName)
 	}
-	defer func() {
-		if err := recover(); err != nil {
-			tx.Rollback()
-			klog.V(5).Error(errors.New(fmt.Sprintf("%v", err)), "DeleteVolume an error accured while trans, rollback performed")
-		}
-	}()
 
-	vh.db.Where("vol_id = ?", vol.VolID).Delete(&Volume{})
+	// the volume is moved aside inside the transaction and moved back when the record cannot be
+	// deleted. the data is removed after commit, leftovers are removed by the dangling volume cleanup.
+	moved := false
+	err = vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(vol.VolID); err != nil {
+			return err
+		}
+		if err := store.DeleteVolume(vol.VolID); err != nil {
+			return err
+		}
 
-	symlink_dir := filepath.Join(vh.syms_path, vol.NSName)
-	symlink_file := filepath.Join(symlink_dir, vol.PVCName)
+		if err := failStep("DeleteVolume/move"); err != nil {
+			return err
+		}
+		if err := os.Rename(volume_path, trash_path); err != nil && !os.IsNotExist(err) {
+			klog.V(5).Error(err, "DeleteVolume cannot move volume %s aside", vol.VolID)
+			return err
+		}
+		moved = true
 
-	os.Remove(symlink_file)
-	err = os.RemoveAll(volume_path)
+		if symlink_file != "" {
+			os.Remove(symlink_file)
+		}
+		return nil
+	})
 
 	if err != nil {
-		tx.Rollback()
 		klog.V(5).Error(err, "DeleteVolume  volume %s cannot be deleted for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
-	} else {
-		err = tx.Commit().Error
+		if moved {
+			if rerr := os.Rename(trash_path, volume_path); rerr != nil && !os.IsNotExist(rerr) {
+				klog.V(5).Error(rerr, "DeleteVolume cannot move volume %s back", vol.VolID)
+			}
+			if symlink_file != "" {
+				createSymlink(volume_path, symlink_dir, symlink_file)
+			}
+		}
+		return err
+	}
+
+	if vol.ProjectID != 0 {
+		if err := updateProjectQuota(trash_path, vol.ProjectID, 0); err != nil {
+			klog.V(5).Error(err, "DeleteVolume cannot clear project quota of volume %s", vol.VolID)
+		}
 	}
+	err = failStep("DeleteVolume/remove")
 	if err == nil {
-		klog.V(5).Infof("DeleteVolume volume %s deleted for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
+		if vh.trashRetention > 0 {
+			err = vh.trashVolume(vol, trash_path)
+		} else {
+			err = os.RemoveAll(trash_path)
+		}
 	}
-
-	return err
+	if err != nil && vh.trashRetention > 0 {
+		klog.V(5).Error(err, "DeleteVolume cannot trash data of volume %s, it will be trashed by the trash reaper", vol.VolID)
+	} else if err != nil {
+		klog.V(5).Error(err, "DeleteVolume cannot remove data of volume %s, it will be removed at cleanup", vol.VolID)
+	}
+	klog.V(5).Infof("DeleteVolume volume %s deleted for %s/%s", vol.VolID, vol.NSName, vol.PVCName)
+	return nil
 }
 
 func (vh *VolumeHelper) GetVolumeIdByName(volname string) (string, error) {
-	var vol Volume
-	result := vh.db.Where("vol_name = ?", volname).First(&vol)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return "", result.Error
+	vol, err := vh.store.GetVolumeByName(volname)
+	if err != nil {
+		return "", err
 	}
-	return vol.VolID, result.Error
+	return vol.VolID, nil
 }
 
 func (vh *VolumeHelper) ReBuildSymLinks() error {
-	var vols []Volume
 	klog.V(5).Infof("ReBuildSymLinks started")
 
-	err := os.RemoveAll(vh.syms_path)
+	var err error
+	for _, sp := range vh.pools {
+		if perr := vh.reBuildPoolSymLinks(sp); perr != nil {
+			err = perr
+		}
+	}
+	if err == nil {
+		klog.V(5).Infof("ReBuildSymLinks all symlinks rebuilded")
+	}
+
+	klog.V(5).Infof("ReBuildSymLinks ended")
+	return err
+}
+
+func (vh *VolumeHelper) reBuildPoolSymLinks(sp *storagePool) error {
+	err := os.RemoveAll(sp.syms_path)
 	if err != nil {
-		klog.V(5).Error(err, "ReBuildSymLinkscannot remove syms folder")
+		klog.V(5).Error(err, "ReBuildSymLinks cannot remove syms folder of pool %s", sp.name)
 		return err
 	}
-	err = os.MkdirAll(vh.syms_path, 0750)
+	err = os.MkdirAll(sp.syms_path, 0750)
 	if err != nil {
-		klog.V(5).Error(err, "ReBuildSymLinkscannot recreate syms folder")
+		klog.V(5).Error(err, "ReBuildSymLinks cannot recreate syms folder of pool %s", sp.name)
 		return err
 	}
 
-	result := vh.db.Find(&vols)
-
-	if result.Error != nil {
-		klog.V(5).Error(err, "ReBuildSymLinkscannot get volumes from db")
+	vols, err := vh.store.GetPoolVolumes(sp.name)
+	if err != nil {
+		klog.V(5).Error(err, "ReBuildSymLinks cannot get volumes of pool %s from db", sp.name)
 		return err
 	}
 
 	for _, vol := range vols {
 		volume_path := vol.VolPath
-		symlink_dir := filepath.Join(vh.syms_path, vol.NSName)
+		symlink_dir := filepath.Join(sp.syms_path, vol.NSName)
 		symlink_file := filepath.Join(symlink_dir, vol.PVCName)
 
 		err = os.MkdirAll(symlink_dir, 0750)
@@ -500,126 +930,314 @@ func (vh *VolumeHelper) ReBuildSymLinks() error {
 			err = os.Symlink(volume_path, symlink_file)
 		}
 	}
-	if err == nil {
-		klog.V(5).Infof("ReBuildSymLinks all symlinks rebuilded")
-	}
 
-	klog.V(5).Infof("ReBuildSymLinks started")
 	return err
 }
 
-func (vh *VolumeHelper) CleanUpDanglingVolumes() error {
-	var vols []Volume
-	klog.Infof("CleanUpDanglingVolumes started")
-	vh.db.Unscoped().Where("deleted_at is not null").Find(&vols)
-	err := vh.db.Error
-	if err != nil {
-		klog.V(5).Error(err, "CleanUpDanglingVolumes cannot get deleted volumes from db")
-		return err
-	}
-
-	// Phase1 delete vols from disk if deleted from db
-	for _, vol := range vols {
-		volume_path := filepath.Join(vh.vols_path, vol.VolID)
-		if _, err := os.Stat(volume_path); err == nil {
-			err = os.RemoveAll(volume_path)
-			if err != nil {
-				klog.V(5).Error(err, "CleanUpDanglingVolumes cannot deleted volumes from disk")
-			}
-		}
-	}
-
-	// Phase2 delete vols from disk if not exists on db
-	pattern := fmt.Sprintf("%s/*/*/*/*", vh.vols_path)
-	fs, err := filepath.Glob(pattern)
+func (vh *VolumeHelper) GetStatistics(pool string) (volumeStatistics, error) {
+	sp, err := vh.getPool(pool)
 	if err != nil {
-		klog.V(5).Error(err, "CleanUpDanglingVolumes cannot read volumes (volid) from disk")
-		return err
-	}
-	for _, f := range fs {
-		var vols []Volume
-		result := vh.db.Where("vol_path = ?", f).Find(&vols)
-		if result.RowsAffected == 0 {
-			err = os.RemoveAll(f)
-			if err != nil {
-				klog.V(5).Error(err, "CleanUpDanglingVolumes cannot deleted volumes from disk")
-			}
-		}
-	}
-
-	if err == nil {
-		klog.V(5).Infof("CleanUpDanglingVolumes all dangling volumes are deleted")
+		return volumeStatistics{}, err
 	}
-	// Phase3 rebuild links
-	return vh.ReBuildSymLinks()
+	return getStatistics(sp.vols_path)
 }
 
 func (vh *VolumeHelper) Close() error {
-	sqlDB, err := vh.db.DB()
-	if err != nil {
-		klog.V(5).Error(err, "Close error occured")
-		return err
-	}
-	sqlDB.Close()
-	return nil
+	return vh.store.Close()
 }
 
 func (vh *VolumeHelper) UpdateNodeInfoLastSeen(nodeId string, lastSeen time.Time) error {
-	err := vh.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"last_seen"}),
-	}).Create(&NodeInfo{ID: nodeId, LastSeen: lastSeen}).Error
-	return err
+	return vh.store.UpdateNodeInfoLastSeen(nodeId, lastSeen)
 }
 
 func (vh *VolumeHelper) GetNodeInfo(nodeId string, age int64) (*NodeInfo, error) {
-	var ni NodeInfo
 	min_ls := time.Now().Add(time.Millisecond * time.Duration(age) * -1)
-	result := vh.db.Where("id = ? and last_seen >= ?", nodeId, min_ls).First(&ni)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	ni, err := vh.store.GetNodeInfo(nodeId, min_ls)
+	if errors.Is(err, ErrRecordNotFound) {
 		return nil, nil
 	}
-	return &ni, result.Error
+	return ni, err
 }
 
 func (vh *VolumeHelper) CreateControllerPublishVolumeInfo(volId, nodeId string, readonly bool) error {
 	cpvi := ControllerPublishVolumeInfo{VolID: volId, NodeID: nodeId, ReadOnly: readonly}
-	err := vh.db.Create(&cpvi).Error
-	return err
+	return vh.store.CreateControllerPublishVolumeInfo(&cpvi)
 }
 
 func (vh *VolumeHelper) GetControllerPublishVolumeInfo(volId, nodeId string) (*ControllerPublishVolumeInfo, error) {
-	var cpvi ControllerPublishVolumeInfo
-	result := vh.db.Where("vol_id = ? and node_id = ?", volId, nodeId).First(&cpvi)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return nil, result.Error
-	}
-	return &cpvi, result.Error
+	return vh.store.GetControllerPublishVolumeInfo(volId, nodeId)
+}
+
+func (vh *VolumeHelper) GetControllerPublishVolumeInfos(volId string) ([]ControllerPublishVolumeInfo, error) {
+	return vh.store.GetControllerPublishVolumeInfos(volId)
 }
 
 func (vh *VolumeHelper) DeleteControllerPublishVolumeInfo(volId, nodeId string) error {
-	result := vh.db.Where("vol_id = ? and node_id = ?", volId, nodeId).Delete(&ControllerPublishVolumeInfo{})
-	return result.Error
+	return vh.store.DeleteControllerPublishVolumeInfo(volId, nodeId)
 }
 
 func (vh *VolumeHelper) CreateNodePublishVolumeInfo(volId, nodeId, mountPath string, rawMount, readonly bool) error {
 	npvi := NodePublishVolumeInfo{VolID: volId, NodeID: nodeId, MountPath: mountPath, RawMount: rawMount, ReadOnly: readonly}
-	err := vh.db.Create(&npvi).Error
-	return err
+	return vh.store.CreateNodePublishVolumeInfo(&npvi)
 }
 
 func (vh *VolumeHelper) DeleteNodePublishVolumeInfo(volId, nodeId, mountPath string) error {
-	result := vh.db.Where("vol_id = ? and node_id = ? and mount_path = ?", volId, nodeId, mountPath).Delete(&NodePublishVolumeInfo{})
-	return result.Error
+	return vh.store.DeleteNodePublishVolumeInfo(volId, nodeId, mountPath)
+}
+
+func (vh *VolumeHelper) GetNodePublishVolumeInfos(volId, nodeId string) ([]NodePublishVolumeInfo, error) {
+	return vh.store.GetNodePublishVolumeInfos(volId, nodeId)
 }
 
 func (vh *VolumeHelper) GetNodePublishVolumeInfo(volId, nodeId, mountPath string) (*NodePublishVolumeInfo, error) {
-	var nvpi NodePublishVolumeInfo
-	result := vh.db.Where("vol_id = ? and node_id = ? and mount_path = ?", volId, nodeId, mountPath).First(&nvpi)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return nil, result.Error
+	return vh.store.GetNodePublishVolumeInfo(volId, nodeId, mountPath)
+}
+
+func (vh *VolumeHelper) CreateSnapshot(snapid, snapname string, vol *Volume) (*Snapshot, error) {
+	sp, err := vh.getPool(vol.Pool)
+	if err != nil {
+		klog.V(5).Error(err, "CreateSnapshot cannot find storage pool of volume %s", vol.VolID)
+		return nil, err
 	}
-	return &nvpi, result.Error
+
+	prefix := fmt.Sprintf("%s/%s/%s/%s", sp.snaps_path, snapid[0:2], snapid[2:4], snapid[4:6])
+	prefix = filepath.FromSlash(prefix)
+
+	err = os.MkdirAll(prefix, 0750)
+	if err != nil {
+		klog.V(5).Error(err, "CreateSnapshot cannot create snaps prefix: %s", prefix)
+		return nil, err
+	}
+
+	snapshot_path := filepath.Join(prefix, snapid)
+
+	snap := Snapshot{SnapID: snapid, SnapName: snapname, SourceVolID: vol.VolID,
+		Size: vol.Capacity, IsBlock: vol.IsBlock, ReadyToUse: false,
+		SnapPath: snapshot_path, Pool: sp.name}
+
+	// the pending snapshot is stored under the volume lock, the data is copied outside of it, so the
+	// lock does not block other users of the volume, e.g. lease renewals, for the whole copy.
+	err = vh.store.Transaction(func(store MetadataStore) error {
+		if err := store.LockVolume(vol.VolID); err != nil {
+			return err
+		}
+		if _, err := store.GetVolume(vol.VolID); err != nil {
+			klog.V(5).Error(err, "CreateSnapshot cannot get source volume %s", vol.VolID)
+			return err
+		}
+		if err := store.CreateSnapshot(&snap); err != nil {
+			klog.V(5).Error(err, "CreateSnapshot cannot insert snapshot data into db")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		klog.V(5).Error(err, "CreateSnapshot cannot create snapshot %s", snapid)
+		return nil, err
+	}
+
+	err = failStep("CreateSnapshot/copy")
+	if err == nil {
+		if vol.IsBlock {
+			snap.CopyMethod, err = cloneFile(vol.VolPath, snapshot_path)
+		} else {
+			snap.CopyMethod, err = copyDirectory(vol.VolPath, snapshot_path)
+		}
+	}
+	if err == nil {
+		snap.AllocatedSize, err = getAllocatedSize(snapshot_path)
+	}
+	if err != nil {
+		klog.V(5).Error(err, "CreateSnapshot cannot copy volume %s into snapshot %s", vol.VolID, snapid)
+	} else {
+		err = vh.store.Transaction(func(store MetadataStore) error {
+			if err := store.LockVolume(vol.VolID); err != nil {
+				return err
+			}
+			// the source volume may be deleted while it is copied
+			if _, err := store.GetVolume(vol.VolID); err != nil {
+				klog.V(5).Error(err, "CreateSnapshot source volume %s is gone", vol.VolID)
+				return err
+			}
+			snap.ReadyToUse = true
+			return store.UpdateSnapshot(&snap)
+		})
+		if err != nil {
+			klog.V(5).Error(err, "CreateSnapshot cannot mark snapshot %s ready", snapid)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(snapshot_path)
+		// the dangling volume cleanup checks the snapshot under its lock
+		derr := vh.store.Transaction(func(store MetadataStore) error {
+			if err := store.LockVolume(snap.SnapID); err != nil {
+				return err
+			}
+			return store.DeleteSnapshot(snap.SnapID)
+		})
+		if derr != nil {
+			klog.V(5).Error(derr, "CreateSnapshot cannot delete pending snapshot %s", snapid)
+		}
+		klog.V(5).Error(err, "CreateSnapshot cannot create snapshot %s", snapid)
+		return nil, err
+	}
+	klog.V(5).Infof("CreateSnapshot snapshot %s created from volume %s with %s copy, allocated %d bytes", snap.SnapID, vol.VolID, snap.CopyMethod, snap.AllocatedSize)
+	return &snap, nil
+}
+
+func (vh *VolumeHelper) GetSnapshot(snapid string) (*Snapshot, error) {
+	return vh.store.GetSnapshot(snapid)
+}
+
+func (vh *VolumeHelper) GetSnapshotIdByName(snapname string) (string, error) {
+	snap, err := vh.store.GetSnapshotByName(snapname)
+	if err != nil {
+		return "", err
+	}
+	return snap.SnapID, nil
+}
+
+func (vh *VolumeHelper) GetSnapshots(snapid, srcvolid string, offset, limit int) ([]Snapshot, error) {
+	klog.V(5).Infof("GetSnapshots snapshots will be obtained from %v to %v", offset, limit)
+	snaps, err := vh.store.GetSnapshots(snapid, srcvolid, offset, limit)
+	if err != nil {
+		klog.V(5).Error(err, "GetSnapshots cannot get snapshot list from db")
+		return nil, err
+	}
+	return snaps, nil
+}
+
+func (vh *VolumeHelper) GetSnapshotCount(snapid, srcvolid string) (int, error) {
+	sc, err := vh.store.GetSnapshotCount(snapid, srcvolid)
+	if err != nil {
+		klog.V(5).Error(err, "GetSnapshotCount cannot get snapshot count from db")
+		return 0, err
+	}
+	klog.V(5).Infof("GetSnapshotCount snapshot count: %d", sc)
+	return sc, nil
+}
+
+func (vh *VolumeHelper) DeleteSnapshot(snapid string) error {
+	klog.V(5).Infof("DeleteSnapshot try to delete snapshot %s", snapid)
+	snap, err := vh.GetSnapshot(snapid)
+	if err != nil {
+		klog.V(5).Error(err, "DeleteSnapshot cannot get snapshot %s", snapid)
+		return err
+	}
+
+	trash_path := snap.SnapPath + deletingSuffix
+	moved := false
+	err = vh.store.Transaction(func(store MetadataStore) error {
+		// the dangling volume cleanup checks the snapshot under the same lock
+		if err := store.LockVolume(snap.SnapID); err != nil {
+			return err
+		}
+		if err := store.DeleteSnapshot(snap.SnapID); err != nil {
+			return err
+		}
+		if err := failStep("DeleteSnapshot/move"); err != nil {
+			return err
+		}
+		if err := os.Rename(snap.SnapPath, trash_path); err != nil && !os.IsNotExist(err) {
+			klog.V(5).Error(err, "DeleteSnapshot cannot move snapshot %s aside", snap.SnapID)
+			return err
+		}
+		moved = true
+		return nil
+	})
+
+	if err != nil {
+		klog.V(5).Error(err, "DeleteSnapshot snapshot %s cannot be deleted", snap.SnapID)
+		if moved {
+			if rerr := os.Rename(trash_path, snap.SnapPath); rerr != nil && !os.IsNotExist(rerr) {
+				klog.V(5).Error(rerr, "DeleteSnapshot cannot move snapshot %s back", snap.SnapID)
+			}
+		}
+		return err
+	}
+
+	err = failStep("DeleteSnapshot/remove")
+	if err == nil {
+		err = os.RemoveAll(trash_path)
+	}
+	if err != nil {
+		klog.V(5).Error(err, "DeleteSnapshot cannot remove data of snapshot %s", snap.SnapID)
+	}
+	klog.V(5).Infof("DeleteSnapshot snapshot %s deleted", snap.SnapID)
+	return nil
+}
+
+// createSymlink replaces the symlink of a volume at its namespace folder.
+func createSymlink(volume_path, symlink_dir, symlink_file string) error {
+	if err := os.MkdirAll(symlink_dir, 0750); err != nil {
+		return err
+	}
+	if err := os.Remove(symlink_file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(volume_path, symlink_file)
+}
+
+// revertVolumeCapacity restores the disk size or the project quota of a volume whose expansion
+// cannot be committed. the disk file is only grown by expansion, so truncating drops no data.
+func revertVolumeCapacity(vol *Volume, capacity int64) error {
+	if vol.IsBlock {
+		return os.Truncate(vol.VolPath, capacity)
+	}
+	if vol.ProjectID != 0 {
+		return updateProjectQuota(vol.VolPath, vol.ProjectID, capacity)
+	}
+	return nil
+}
+
+func (vol *Volume) HasContentSource() bool {
+	return vol.SourceSnapID != "" || vol.ParentVolID != ""
+}
+
+func (vol *Volume) ApplyOwnership(path string) error {
+	if vol.Mode == 0 {
+		// volumes created before ownership parameters keep their permissions
+		return nil
+	}
+	if err := os.Chown(path, vol.OwnerUID, vol.OwnerGID); err != nil {
+		klog.V(5).Error(err, "ApplyOwnership cannot change owner of volume %s at %s", vol.VolID, path)
+		return err
+	}
+	if err := os.Chmod(path, os.FileMode(vol.Mode)); err != nil {
+		klog.V(5).Error(err, "ApplyOwnership cannot change mode of volume %s at %s", vol.VolID, path)
+		return err
+	}
+	return nil
+}
+
+func (vol *Volume) PopulateVolumeFromSource(sourcePath string) error {
+	var err error
+	var method string
+	klog.Infof("PopulateVolumeFromSource started")
+	if vol.IsBlock {
+		method, err = cloneFile(sourcePath, vol.VolPath)
+		if err == nil {
+			executor := utilexec.New()
+			cap_str := fmt.Sprintf("seek=%d", vol.Capacity)
+			vp_str := fmt.Sprintf("of=%s", vol.VolPath)
+			var output []byte
+			output, err = executor.Command("dd", "if=/dev/null", "bs=1", "count=0", cap_str, vp_str).CombinedOutput()
+			if err != nil {
+				klog.V(5).Error(err, "PopulateVolumeFromSource error occured %v", string(output))
+			}
+		}
+	} else {
+		method, err = copyDirectory(sourcePath, vol.VolPath)
+		if err == nil {
+			err = vol.ApplyOwnership(vol.VolPath)
+		}
+	}
+	if err != nil {
+		klog.V(5).Error(err, "PopulateVolumeFromSource cannot populate volume %s from %s", vol.VolID, sourcePath)
+		return err
+	}
+	klog.V(5).Infof("PopulateVolumeFromSource volume %s populated from %s with %s copy", vol.VolID, sourcePath, method)
+	return nil
 }
 
 func (vol *Volume) PopulateVolumeIfRequired() (bool, error) {
@@ -639,6 +1257,9 @@ func (vol *Volume) PopulateVolumeIfRequired() (bool, error) {
 			}
 		} else {
 			err := os.MkdirAll(vol.VolPath, 0750)
+			if err == nil {
+				err = vol.ApplyOwnership(vol.VolPath)
+			}
 			if err != nil {
 				klog.V(5).Error(err, "PopulateVolumeIfRequired error occured")
 				return false, err
@@ -654,7 +1275,6 @@ func (vol *Volume) PopulateVolumeIfRequired() (bool, error) {
 		klog.V(5).Error(err, "PopulateVolumeIfRequired error occured")
 		return false, err
 	}
-	return false, nil
 }
 
 func fixCapacity(capacity int64) int64 {
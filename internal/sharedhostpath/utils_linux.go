@@ -19,13 +19,26 @@ limitations under the License.
 package sharedhostpath
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
 	klog "k8s.io/klog/v2"
 	utilexec "k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	lockFilePollInterval = 10 * time.Millisecond
 )
 
 func getStatistics(volumePath string) (volumeStatistics, error) {
@@ -65,3 +78,318 @@ func getBlockDeviceSize(blockDevice string) (int64, error) {
 
 	return gotSizeBytes, nil
 }
+
+func copyDirectory(src, dst string) (string, error) {
+	klog.V(5).Infof("copyDirectory try to copy %s to %s", src, dst)
+	method := copyMethodReflink
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			err = os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode().IsRegular():
+			var fileMethod string
+			fileMethod, err = cloneFile(path, target)
+			if fileMethod == copyMethodSparse {
+				method = copyMethodSparse
+			}
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			var link string
+			link, err = os.Readlink(path)
+			if err == nil {
+				err = os.Symlink(link, target)
+			}
+		default:
+			klog.V(5).Infof("copyDirectory skipping special file %s", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return copyMetadata(target, fi)
+	})
+	if err != nil {
+		klog.V(5).Error(err, "copyDirectory cannot copy %s to %s", src, dst)
+		return "", err
+	}
+
+	// directory times are changed while filling them, so fix them at the end
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(filepath.Join(dst, rel), fi.ModTime(), fi.ModTime())
+	})
+	if err != nil {
+		klog.V(5).Error(err, "copyDirectory cannot fix directory times of %s", dst)
+		return "", err
+	}
+	klog.V(5).Infof("copyDirectory %s copied to %s with method %s", src, dst, method)
+	return method, nil
+}
+
+// cloneFile copies src to dst with a reflink when the filesystem supports it,
+// otherwise it copies only the data regions so holes stay holes.
+func cloneFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+
+	method := copyMethodReflink
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if err != nil {
+		klog.V(5).Infof("cloneFile reflink is not possible for %s: %v, fallback to sparse copy", src, err)
+		method = copyMethodSparse
+		err = sparseCopy(in, out, fi.Size())
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		klog.V(5).Error(err, "cloneFile cannot copy %s to %s", src, dst)
+		return "", err
+	}
+
+	if err = out.Close(); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	klog.V(5).Infof("cloneFile %s copied to %s with method %s", src, dst, method)
+	return method, nil
+}
+
+func sparseCopy(in, out *os.File, size int64) error {
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+
+	buf := make([]byte, MiB)
+	zero := make([]byte, MiB)
+	var offset int64 = 0
+	for offset < size {
+		start, err := unix.Seek(int(in.Fd()), offset, unix.SEEK_DATA)
+		if err != nil {
+			if err == unix.ENXIO {
+				// no data after offset, the rest is a hole
+				return nil
+			}
+			return err
+		}
+		end, err := unix.Seek(int(in.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+
+		for pos := start; pos < end; {
+			chunk := int64(len(buf))
+			if end-pos < chunk {
+				chunk = end - pos
+			}
+			n, err := in.ReadAt(buf[:chunk], pos)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			// filesystems without hole tracking report everything as data
+			if !bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := out.WriteAt(buf[:n], pos); err != nil {
+					return err
+				}
+			}
+			pos += int64(n)
+		}
+		offset = end
+	}
+	return nil
+}
+
+func copyMetadata(target string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return nil
+	}
+	if err := os.Chmod(target, fi.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+func getAllocatedSize(path string) (int64, error) {
+	var allocated int64 = 0
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			allocated += st.Blocks * 512
+		}
+		return nil
+	})
+	if err != nil {
+		klog.V(5).Error(err, "getAllocatedSize cannot get allocated size of %s", path)
+		return 0, err
+	}
+	return allocated, nil
+}
+
+func applyVolumeMountGroup(path string, gid int) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return err
+	}
+	// the ownership is changed only when the root does not match, like kubelet OnRootMismatch policy
+	if int(st.Gid) == gid && st.Mode&syscall.S_ISGID != 0 {
+		return nil
+	}
+
+	return filepath.Walk(path, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if err := os.Lchown(name, -1, gid); err != nil {
+			return err
+		}
+		mode := fi.Mode() | 0060
+		if fi.IsDir() {
+			mode |= 0010 | os.ModeSetgid
+		}
+		return os.Chmod(name, mode)
+	})
+}
+
+// lockFile polls a non blocking flock until the timeout, so a holder which hangs at the shared
+// storage cannot block the caller forever.
+func lockFile(path string, exclusive bool, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) && !errors.Is(err, unix.EINTR) {
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("cannot lock %s in %v: %w", path, timeout, err)
+		}
+		time.Sleep(lockFilePollInterval)
+	}
+}
+
+func unlockFile(f *os.File) error {
+	defer f.Close()
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// isStaleError reports errors of shared storage which lost its handles or its connection, such as
+// an NFS ESTALE or a disconnected fuse filesystem.
+func isStaleError(err error) bool {
+	return errors.Is(err, unix.ESTALE) || errors.Is(err, unix.ENOTCONN)
+}
+
+func isReadOnlyFilesystem(path string) (bool, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return false, err
+	}
+	return statfs.Flags&unix.ST_RDONLY != 0, nil
+}
+
+func loopDeviceSysPath(device, name string) string {
+	return filepath.Join("/sys/block", filepath.Base(device), name)
+}
+
+func getLoopBackingFile(device string) (string, error) {
+	data, err := ioutil.ReadFile(loopDeviceSysPath(device, "loop/backing_file"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fencedLoopOffset is past the end of any backing file, a loop device starting there has no size.
+const fencedLoopOffset = 1<<63 - 4096
+
+// fenceLoopDevice makes all I/O of the loop device fail, even through the files which are already
+// open for writing. Its offset is moved past the end of the backing file, so the device has no size
+// and the block layer fails the requests before they reach the image. The loop device stays so until
+// it is detached.
+func fenceLoopDevice(device string) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var info unix.LoopInfo64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.LOOP_GET_STATUS64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+		klog.V(5).Error(errno, "fenceLoopDevice cannot get status of loop device %s", device)
+		return fmt.Errorf("cannot get status of loop device %s: %v", device, errno)
+	}
+	if info.Offset != fencedLoopOffset {
+		info.Offset = fencedLoopOffset
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+			klog.V(5).Error(errno, "fenceLoopDevice cannot set offset of loop device %s", device)
+			return fmt.Errorf("cannot set offset of loop device %s: %v", device, errno)
+		}
+	}
+	size, err := getBlockDeviceSize(device)
+	if err != nil {
+		return err
+	}
+	if size != 0 {
+		return fmt.Errorf("loop device %s has size %d after it is fenced", device, size)
+	}
+	return nil
+}
+
+// hasFilesystem reports whether the device is formatted with a filesystem or partitions.
+func hasFilesystem(device string) (bool, error) {
+	formatter := mount.SafeFormatAndMount{Interface: mount.New(""), Exec: utilexec.New()}
+	format, err := formatter.GetDiskFormat(device)
+	if err != nil {
+		return false, err
+	}
+	return format != "", nil
+}
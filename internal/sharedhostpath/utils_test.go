@@ -17,15 +17,104 @@ limitations under the License.
 package sharedhostpath
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kazimsarikaya/csi-sharedhostpath/internal/volumehelpers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/mount-utils"
 	utilexec "k8s.io/utils/exec"
 	"os"
+	"path/filepath"
 	"time"
 )
 
+var errInjected = errors.New("injected failure")
+
+// failingCommitStore fails every transaction after its changes are made, as a failed commit.
+type failingCommitStore struct {
+	MetadataStore
+}
+
+func (fcs *failingCommitStore) Transaction(fn func(store MetadataStore) error) error {
+	return fcs.MetadataStore.Transaction(func(store MetadataStore) error {
+		if err := fn(store); err != nil {
+			return err
+		}
+		return errInjected
+	})
+}
+
+// lockRecordingStore records the keys locked inside its transactions.
+type lockRecordingStore struct {
+	MetadataStore
+	locked *[]string
+}
+
+func (lrs *lockRecordingStore) Transaction(fn func(store MetadataStore) error) error {
+	return lrs.MetadataStore.Transaction(func(store MetadataStore) error {
+		return fn(&lockRecordingStore{MetadataStore: store, locked: lrs.locked})
+	})
+}
+
+func (lrs *lockRecordingStore) LockVolume(volid string) error {
+	*lrs.locked = append(*lrs.locked, volid)
+	return lrs.MetadataStore.LockVolume(volid)
+}
+
+// slowNodeReadStore delays the reads of the node infos.
+type slowNodeReadStore struct {
+	MetadataStore
+	delay time.Duration
+}
+
+func (snrs *slowNodeReadStore) GetNodeInfos() ([]NodeInfo, error) {
+	time.Sleep(snrs.delay)
+	return snrs.MetadataStore.GetNodeInfos()
+}
+
+// failingSnapshotReadStore fails the reads of the snapshots.
+type failingSnapshotReadStore struct {
+	MetadataStore
+}
+
+func (fsrs *failingSnapshotReadStore) GetSnapshot(snapid string) (*Snapshot, error) {
+	return nil, errInjected
+}
+
+// injectFailure makes failStep fail at the given step, an empty step fails the commit.
+func injectFailure(vh *VolumeHelper, step string) {
+	if step == "" {
+		vh.store = &failingCommitStore{vh.store}
+		return
+	}
+	failStep = func(s string) error {
+		if s == step {
+			return errInjected
+		}
+		return nil
+	}
+}
+
+func clearFailures(vh *VolumeHelper) {
+	failStep = func(step string) error { return nil }
+	if fcs, ok := vh.store.(*failingCommitStore); ok {
+		vh.store = fcs.MetadataStore
+	}
+}
+
 var _ = Describe("Utils Methods Tests", func() {
 
 	Context("Driver Test", func() {
@@ -49,7 +138,7 @@ var _ = Describe("Utils Methods Tests", func() {
 
 		Describe("Test create filesystem volume", func() {
 			It("volume should be created", func() {
-				vol, err := vh.CreateVolume("d86b0dbb-198f-4642-a4f1-de348da19c99", "test-name-1", "test-pv-1", "test-pvc-1", "test-ns-1", 1<<30, false)
+				vol, err := vh.CreateVolume("d86b0dbb-198f-4642-a4f1-de348da19c99", "test-name-1", "test-pv-1", "test-pvc-1", "test-ns-1", defaultPool, 1<<30, false, defaultVolumeOwnership)
 				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
 				Expect(*dataRoot+"/vols/d8/6b/0d/d86b0dbb-198f-4642-a4f1-de348da19c99").Should(BeADirectory(), "volume folder should be exists")
 				Expect(*dataRoot+"/syms/test-ns-1/test-pvc-1").Should(BeAnExistingFile(), "volume symlink should be exits")
@@ -58,7 +147,7 @@ var _ = Describe("Utils Methods Tests", func() {
 
 		Describe("Test create block volume", func() {
 			It("volume should be created", func() {
-				vol, err := vh.CreateVolume("549f7cb1-7da1-4b46-97c0-03cbd5a2186", "test-name-2", "test-pv-2", "test-pvc-2", "test-ns-2", 1<<30, true)
+				vol, err := vh.CreateVolume("549f7cb1-7da1-4b46-97c0-03cbd5a2186", "test-name-2", "test-pv-2", "test-pvc-2", "test-ns-2", defaultPool, 1<<30, true, defaultVolumeOwnership)
 				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
 				Expect(*dataRoot+"/vols/54/9f/7c/549f7cb1-7da1-4b46-97c0-03cbd5a2186").Should(BeAnExistingFile(), "volume file should be exists")
 				Expect(*dataRoot+"/syms/test-ns-2/test-pvc-2").Should(BeAnExistingFile(), "volume symlink should be exits")
@@ -109,13 +198,249 @@ var _ = Describe("Utils Methods Tests", func() {
 				os.MkdirAll(*dataRoot+"/vols/54/9f/7c/549f7cb1-7da1-4b46-97c0-03cbd5a2186", 0750)
 
 				By("cleanup dangling volumes")
-				err := vh.CleanUpDanglingVolumes()
+				_, err := vh.CleanUpDanglingVolumes(CleanupOptions{})
 				Expect(err).To(BeNil(), "error occured")
 				Expect(*dataRoot + "/vols/54/9f/7c/549f7cb1-7da1-4b46-97c0-03cbd5a2186").ShouldNot(BeADirectory())
 
 				By("cleanup")
 				vh.DeleteVolume("d86b0dbb-198f-4642-a4f1-de348da19c99")
 			})
+
+			It("dry run and thresholds should keep the volumes", func() {
+				unknown := []string{
+					*dataRoot + "/vols/0a/1b/2c/0a1b2c3d-1111-4e5f-8a9b-0c1d2e3f4a51",
+					*dataRoot + "/vols/0a/1b/2c/0a1b2c3d-2222-4e5f-8a9b-0c1d2e3f4a52",
+				}
+				for _, path := range unknown {
+					Expect(os.MkdirAll(path, 0750)).To(BeNil(), "cannot create dummy folder")
+					Expect(os.WriteFile(path+"/data.txt", []byte("dangling"), 0640)).To(BeNil(), "cannot write dummy data")
+				}
+				paths := func(report *CleanupReport) []string {
+					var ps []string
+					for _, dv := range report.Volumes {
+						Expect(dv.Size).To(BeNumerically(">=", 0), "size of dangling volume should be reported")
+						ps = append(ps, dv.Path)
+					}
+					return ps
+				}
+
+				By("dry run should only report")
+				reportPath := *dataRoot + "-cleanup-report.json"
+				defer os.Remove(reportPath)
+				report, err := vh.CleanUpDanglingVolumes(CleanupOptions{DryRun: true, ReportPath: reportPath})
+				Expect(report, err).ToNot(BeNil(), "cannot run dry cleanup")
+				Expect(paths(report)).To(ContainElements(unknown))
+				Expect(report.Unknown).To(BeNumerically(">=", 2))
+				for _, path := range unknown {
+					Expect(path).Should(BeADirectory(), "dry run should not delete")
+				}
+				data, err := os.ReadFile(reportPath)
+				Expect(err).To(BeNil(), "report should be written")
+				var written CleanupReport
+				Expect(json.Unmarshal(data, &written)).To(BeNil(), "report should be json")
+				Expect(written.DryRun).To(BeTrue())
+				Expect(paths(&written)).To(ContainElements(unknown))
+
+				By("thresholds should refuse cleanup")
+				report, err = vh.CleanUpDanglingVolumes(CleanupOptions{MaxVolumes: 1})
+				Expect(errors.Is(err, errCleanupThreshold)).To(BeTrue(), "volume count threshold should refuse")
+				Expect(report.Refused).To(BeTrue())
+				_, err = vh.CleanUpDanglingVolumes(CleanupOptions{MaxPercent: 1})
+				Expect(errors.Is(err, errCleanupThreshold)).To(BeTrue(), "percent threshold should refuse")
+				for _, path := range unknown {
+					Expect(path).Should(BeADirectory(), "refused cleanup should not delete")
+				}
+
+				By("forced cleanup should quarantine")
+				report, err = vh.CleanUpDanglingVolumes(CleanupOptions{MaxVolumes: 1, Force: true, QuarantineDir: "quarantine"})
+				Expect(report, err).ToNot(BeNil(), "forced cleanup should work")
+				for _, path := range unknown {
+					Expect(path).ShouldNot(BeADirectory(), "volume should be moved")
+				}
+				quarantined, err := filepath.Glob(*dataRoot + "/quarantine/*/vols/0a/1b/2c/*/data.txt")
+				Expect(err).To(BeNil())
+				Expect(quarantined).To(HaveLen(2), "volumes should be kept at quarantine")
+				os.RemoveAll(*dataRoot + "/quarantine")
+			})
+
+			It("candidates should be checked again under their locks", func() {
+				volname := "5b7e2d19-8c4a-4f63-a1d0-3e9f6b2c8a47"
+				vol, err := vh.CreateVolume(volname, "test-name-cl", "test-pv-cl", "test-pvc-cl", "test-ns-cl", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				deleting := vol.VolPath + deletingSuffix
+				Expect(os.MkdirAll(deleting, 0750)).To(BeNil(), "cannot create deleting folder")
+
+				By("deleting folder of a live volume should be kept")
+				dv := DanglingVolume{Pool: defaultPool, Path: deleting, Reason: danglingReasonDeleting}
+				Expect(vh.removeDanglingVolume(dv, "", "")).To(BeNil(), "cannot check candidate")
+				Expect(deleting).Should(BeADirectory(), "volume is live, deleting folder should be kept")
+
+				By("candidates should be locked by volume id")
+				store := vh.store
+				defer func() { vh.store = store }()
+				var locked []string
+				vh.store = &lockRecordingStore{MetadataStore: store, locked: &locked}
+				Expect(vh.removeDanglingVolume(dv, "", "")).To(BeNil(), "cannot check candidate")
+				vh.store = store
+				Expect(locked).To(Equal([]string{volname}), "deleting suffix should be stripped from the lock key")
+
+				By("deleting folder of a deleted volume should be removed")
+				Expect(os.Remove(deleting)).To(BeNil(), "cannot remove deleting folder")
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "cannot delete volume")
+				Expect(os.MkdirAll(deleting, 0750)).To(BeNil(), "cannot create deleting folder")
+				Expect(vh.removeDanglingVolume(dv, "", "")).To(BeNil(), "cannot remove candidate")
+				Expect(deleting).ShouldNot(BeADirectory(), "deleting folder should be removed")
+			})
+		})
+
+		Describe("Trash", func() {
+			It("deleted volumes should be trashed, restored and purged", func() {
+				volname := "9e4c2a7b-5d13-4f86-b0a2-e7c1d3f5a968"
+				vh.SetTrashRetention(time.Hour)
+				defer vh.SetTrashRetention(0)
+
+				By("delete volume with retention")
+				vol, err := vh.CreateVolume(volname, "test-name-30", "test-pv-30", "test-pvc-30", "test-ns-30", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				Expect(os.WriteFile(vol.VolPath+"/data.txt", []byte("trashed"), 0640)).To(BeNil(), "cannot write volume data")
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "cannot delete volume")
+				Expect(vol.VolPath).ShouldNot(BeADirectory(), "volume folder should be moved")
+				Expect(*dataRoot+"/trash/"+volname+"/data/data.txt").Should(BeAnExistingFile(), "volume data should be trashed")
+
+				tvs, err := vh.ListTrashedVolumes()
+				Expect(err).To(BeNil(), "cannot list trash")
+				Expect(tvs).To(HaveLen(1))
+				Expect(tvs[0].Volume.VolID).To(Equal(volname))
+				Expect(tvs[0].Volume.PVCName).To(Equal("test-pvc-30"), "pvc identity should be kept")
+
+				By("purge should keep volumes inside retention")
+				Expect(vh.PurgeTrash()).To(BeNil(), "cannot purge trash")
+				Expect(*dataRoot+"/trash/"+volname).Should(BeADirectory(), "volume inside retention should be kept")
+
+				By("restore volume under new pv")
+				restored, err := vh.RestoreTrashedVolume(volname, "test-pv-31")
+				Expect(restored, err).ToNot(BeNil(), "cannot restore volume")
+				Expect(restored.VolID).ToNot(Equal(volname), "restored volume should have a new id")
+				data, err := os.ReadFile(restored.VolPath + "/data.txt")
+				Expect(string(data), err).To(Equal("trashed"), "restored data dismatch")
+				stored, err := vh.GetVolume(restored.VolID)
+				Expect(stored, err).ToNot(BeNil(), "restored volume should be stored")
+				Expect(stored.PVName).To(Equal("test-pv-31"))
+				Expect(*dataRoot+"/trash/"+volname).ShouldNot(BeADirectory(), "restored volume should leave trash")
+				_, err = vh.RestoreTrashedVolume(volname, "test-pv-32")
+				Expect(err).NotTo(BeNil(), "restored volume should not be restored again")
+
+				By("purge should remove expired volumes")
+				Expect(vh.DeleteVolume(restored.VolID)).To(BeNil(), "cannot delete restored volume")
+				Expect(*dataRoot+"/trash/"+restored.VolID).Should(BeADirectory(), "restored volume should be trashed")
+				vh.SetTrashRetention(time.Nanosecond)
+				Expect(vh.PurgeTrash()).To(BeNil(), "cannot purge trash")
+				Expect(*dataRoot+"/trash/"+restored.VolID).ShouldNot(BeADirectory(), "expired volume should be purged")
+			})
+
+			It("volumes which cannot be trashed at deletion should be kept and trashed later", func() {
+				volname := "1c6a9e3f-4b72-4d08-9f5e-a3b7d2c8e614"
+				vh.SetTrashRetention(time.Hour)
+				defer vh.SetTrashRetention(0)
+
+				vol, err := vh.CreateVolume(volname, "test-name-33", "test-pv-33", "test-pvc-33", "test-ns-33", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				Expect(os.WriteFile(vol.VolPath+"/data.txt", []byte("trashed later"), 0640)).To(BeNil(), "cannot write volume data")
+
+				By("delete volume while trash fails")
+				injectFailure(vh, "DeleteVolume/remove")
+				err = vh.DeleteVolume(volname)
+				clearFailures(vh)
+				Expect(err).To(BeNil(), "cannot delete volume")
+				Expect(vol.VolPath+deletingSuffix).Should(BeADirectory(), "volume data should be kept aside")
+
+				By("cleanup should keep the data while trash is enabled")
+				report, err := vh.CleanUpDanglingVolumes(CleanupOptions{Force: true})
+				Expect(report, err).ToNot(BeNil(), "cannot cleanup dangling volumes")
+				Expect(vol.VolPath+deletingSuffix).Should(BeADirectory(), "cleanup should not remove data to be trashed")
+
+				By("trash reaper should trash the data")
+				Expect(vh.PurgeTrash()).To(BeNil(), "cannot purge trash")
+				Expect(vol.VolPath+deletingSuffix).ShouldNot(BeADirectory(), "volume data should be moved")
+				data, err := os.ReadFile(*dataRoot + "/trash/" + volname + "/data/data.txt")
+				Expect(string(data), err).To(Equal("trashed later"), "trashed data dismatch")
+
+				tvs, err := vh.ListTrashedVolumes()
+				Expect(err).To(BeNil(), "cannot list trash")
+				Expect(tvs).To(HaveLen(1))
+				vh.SetTrashRetention(time.Nanosecond)
+				Expect(vh.PurgeTrash()).To(BeNil(), "cannot purge trash")
+				Expect(*dataRoot+"/trash/"+volname).ShouldNot(BeADirectory(), "expired volume should be purged")
+			})
+		})
+
+		Describe("Fsck", func() {
+			It("issues should be reported and safe ones repaired", func() {
+				folderID := "4d8e2b6a-0c3f-4a97-b1e5-f2a6c8d0e431"
+				diskID := "6f0a4c8e-2b5d-4c19-93f7-a4b8d2e6f053"
+				brokenID := "8b2c6e0a-4f7d-4e3b-a5c9-d6f0b4a8c275"
+				folder, err := vh.CreateVolume(folderID, "test-name-40", "test-pv-40", "test-pvc-40", "test-ns-40", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(folder, err).ToNot(BeNil(), "cannot create folder volume")
+				disk, err := vh.CreateVolume(diskID, "test-name-41", "test-pv-41", "test-pvc-41", "test-ns-41", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(disk, err).ToNot(BeNil(), "cannot create disk volume")
+				broken, err := vh.CreateVolume(brokenID, "test-name-42", "test-pv-42", "test-pvc-42", "test-ns-42", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(broken, err).ToNot(BeNil(), "cannot create folder volume")
+
+				By("break volumes")
+				Expect(os.Remove(*dataRoot + "/syms/test-ns-40/test-pvc-40")).To(BeNil())
+				Expect(os.Truncate(disk.VolPath, 1<<20)).To(BeNil())
+				Expect(os.RemoveAll(broken.VolPath)).To(BeNil())
+				Expect(os.WriteFile(broken.VolPath, []byte("not a folder"), 0640)).To(BeNil())
+				stray := *dataRoot + "/vols/ff/ee/dd/ffeedd00-0000-4000-8000-000000000000"
+				Expect(os.MkdirAll(stray, 0750)).To(BeNil())
+				Expect(vh.CreateControllerPublishVolumeInfo(folderID, "fsck-node", false)).To(BeNil())
+				Expect(vh.CreateNodePublishVolumeInfo(folderID, "fsck-node", "/mnt/fsck", false, false)).To(BeNil())
+
+				find := func(report *FsckReport, kind, volid, path string) *FsckIssue {
+					for i, issue := range report.Issues {
+						if issue.Kind == kind && issue.VolID == volid && (path == "" || issue.Path == path) {
+							return &report.Issues[i]
+						}
+					}
+					return nil
+				}
+
+				By("audit should not change anything")
+				report, err := vh.Fsck(FsckOptions{NodeMaxAge: time.Minute})
+				Expect(report, err).ToNot(BeNil(), "cannot run fsck")
+				Expect(find(report, fsckMissingSymlink, folderID, "")).ToNot(BeNil(), "missing symlink should be reported")
+				Expect(find(report, fsckSizeMismatch, diskID, "")).ToNot(BeNil(), "size mismatch should be reported")
+				Expect(find(report, fsckTypeMismatch, brokenID, "")).ToNot(BeNil(), "type mismatch should be reported")
+				Expect(find(report, fsckStrayFile, "", stray)).ToNot(BeNil(), "stray folder should be reported")
+				Expect(find(report, fsckStaleControllerPublish, folderID, "")).ToNot(BeNil(), "stale controller publish should be reported")
+				Expect(find(report, fsckStaleNodePublish, folderID, "/mnt/fsck")).ToNot(BeNil(), "stale node publish should be reported")
+				Expect(*dataRoot+"/syms/test-ns-40/test-pvc-40").ShouldNot(BeAnExistingFile(), "audit should not repair")
+
+				By("repair should fix safe issues under the volume locks")
+				store := vh.store
+				defer func() { vh.store = store }()
+				var locked []string
+				vh.store = &lockRecordingStore{MetadataStore: store, locked: &locked}
+				report, err = vh.Fsck(FsckOptions{NodeMaxAge: time.Minute, Repair: true})
+				vh.store = store
+				Expect(report, err).ToNot(BeNil(), "cannot run fsck")
+				Expect(locked).To(ContainElements(folderID, diskID), "repairs should lock the volumes")
+				Expect(find(report, fsckMissingSymlink, folderID, "").Repaired).To(BeTrue())
+				Expect(find(report, fsckSizeMismatch, diskID, "").Repaired).To(BeTrue())
+				Expect(find(report, fsckTypeMismatch, brokenID, "").Repaired).To(BeFalse(), "type mismatch is not safe to repair")
+				Expect(*dataRoot+"/syms/test-ns-40/test-pvc-40").Should(BeAnExistingFile(), "symlink should be created")
+				fi, err := os.Stat(disk.VolPath)
+				Expect(fi, err).ToNot(BeNil())
+				Expect(fi.Size()).To(Equal(int64(1<<30)), "disk image should be extended")
+
+				By("cleanup")
+				vh.DeleteControllerPublishVolumeInfo(folderID, "fsck-node")
+				vh.DeleteNodePublishVolumeInfo(folderID, "fsck-node", "/mnt/fsck")
+				os.RemoveAll(*dataRoot + "/vols/ff")
+				for _, volid := range []string{folderID, diskID, brokenID} {
+					Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+				}
+			})
 		})
 
 		Describe("Create/Update/Get node info", func() {
@@ -144,6 +469,387 @@ var _ = Describe("Utils Methods Tests", func() {
 			})
 		})
 
+		Describe("Node reaper", func() {
+			It("dead nodes should be marked and their volumes reported or unpublished", func() {
+				volid := "0d4b8f2a-6e1c-4a73-b5d9-e7a1c3f5b806"
+				nodeID := "reaper-node"
+				vol, err := vh.CreateVolume(volid, "test-name-80", "test-pv-80", "test-pvc-80", "test-ns-80", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				Expect(vh.UpdateNodeInfoLastSeen(nodeID, time.Now().Add(-10*time.Minute))).To(BeNil())
+				Expect(vh.CreateControllerPublishVolumeInfo(volid, nodeID, false)).To(BeNil())
+				Expect(vh.CreateNodePublishVolumeInfo(volid, nodeID, "/mnt/reaper", false, false)).To(BeNil())
+				defer vh.SetNodeReaper(0, false)
+
+				isDead := func() bool {
+					nis, err := vh.store.GetNodeInfos()
+					Expect(err).To(BeNil(), "cannot get node infos")
+					for _, ni := range nis {
+						if ni.ID == nodeID {
+							return ni.Dead
+						}
+					}
+					return false
+				}
+
+				By("pass should be skipped when the reads of the reaper are delayed")
+				store := vh.store
+				defer func() { vh.store = store }()
+				vh.store = &slowNodeReadStore{MetadataStore: store, delay: 200 * time.Millisecond}
+				vh.SetNodeReaper(100*time.Millisecond, false)
+				Expect(vh.ReapDeadNodes()).To(BeNil(), "cannot reap dead nodes")
+				vh.store = store
+				Expect(isDead()).To(BeFalse(), "delayed pass should not mark nodes dead")
+
+				By("volumes of dead nodes should be abnormal")
+				vh.SetNodeReaper(time.Minute, false)
+				Expect(vh.ReapDeadNodes()).To(BeNil(), "cannot reap dead nodes")
+				Expect(isDead()).To(BeTrue(), "node should be dead")
+				stored, err := vh.GetVolume(volid)
+				Expect(stored, err).ToNot(BeNil())
+				Expect(stored.VolumeCondition.Abnormal).To(BeTrue(), "volume should be abnormal")
+				Expect(stored.VolumeCondition.Message).To(ContainSubstring("dead node " + nodeID))
+				cpvi, err := vh.GetControllerPublishVolumeInfo(volid, nodeID)
+				Expect(cpvi, err).ToNot(BeNil(), "volume should stay published")
+
+				By("reporting node should not be dead")
+				Expect(vh.UpdateNodeInfoLastSeen(nodeID, time.Now())).To(BeNil())
+				Expect(isDead()).To(BeFalse(), "node should be alive")
+
+				By("volumes of dead nodes should be unpublished when forced")
+				Expect(vh.UpdateNodeInfoLastSeen(nodeID, time.Now().Add(-10*time.Minute))).To(BeNil())
+				vh.SetNodeReaper(time.Minute, true)
+				Expect(vh.ReapDeadNodes()).To(BeNil(), "cannot reap dead nodes")
+				_, err = vh.GetControllerPublishVolumeInfo(volid, nodeID)
+				Expect(errors.Is(err, ErrRecordNotFound)).To(BeTrue(), "controller publish info should be deleted")
+				npvis, err := vh.GetNodePublishVolumeInfos(volid, nodeID)
+				Expect(err).To(BeNil())
+				Expect(npvis).To(BeEmpty(), "node publish infos should be deleted")
+
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
+		})
+
+		Describe("Volume lease", func() {
+			It("only one live node should own the volume", func() {
+				volid := "5c2e9a71-3f8d-4b06-a4e2-9d17b6c8f013"
+				owner, other := "lease-owner-node", "lease-other-node"
+				vol, err := vh.CreateVolume(volid, "test-name-81", "test-pv-81", "test-pvc-81", "test-ns-81", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				Expect(vh.UpdateNodeInfoLastSeen(owner, time.Now())).To(BeNil())
+				Expect(vh.UpdateNodeInfoLastSeen(other, time.Now())).To(BeNil())
+
+				leaseOf := func() VolumeLease {
+					stored, err := vh.GetVolume(volid)
+					Expect(stored, err).ToNot(BeNil())
+					return stored.VolumeLease
+				}
+
+				By("owner should acquire the lease")
+				Expect(vh.AcquireVolumeLease(volid, owner)).To(BeNil(), "cannot acquire lease")
+				lease := leaseOf()
+				Expect(lease.NodeID).To(Equal(owner))
+				Expect(lease.ExpiresAt).To(BeTemporally(">", time.Now()))
+
+				By("other node should be refused while the owner is alive")
+				err = vh.AcquireVolumeLease(volid, other)
+				Expect(errors.Is(err, ErrVolumeLeaseHeld)).To(BeTrue(), "lease should be held")
+
+				By("owner should renew the leases of the published volumes")
+				Expect(vh.CreateControllerPublishVolumeInfo(volid, owner, false)).To(BeNil())
+				Expect(vh.RenewVolumeLeases(owner)).To(BeNil(), "cannot renew leases")
+				Expect(leaseOf().ExpiresAt).To(BeTemporally(">=", lease.ExpiresAt))
+				Expect(vh.RenewVolumeLeases(other)).To(BeNil(), "cannot renew leases")
+				Expect(leaseOf().NodeID).To(Equal(owner))
+
+				By("renewal should not wait for the volume lock")
+				locked, release := make(chan struct{}), make(chan struct{})
+				holder := make(chan error)
+				go func() {
+					holder <- vh.store.Transaction(func(store MetadataStore) error {
+						if err := store.LockVolume(volid); err != nil {
+							return err
+						}
+						close(locked)
+						<-release
+						return nil
+					})
+				}()
+				Eventually(locked).Should(BeClosed())
+				renewed := make(chan error)
+				go func() {
+					renewed <- vh.RenewVolumeLeases(owner)
+				}()
+				Eventually(renewed, "5s").Should(Receive(BeNil()), "renewal should not be blocked by the volume lock")
+				close(release)
+				Eventually(holder).Should(Receive(BeNil()))
+
+				// the wait is measured by the taking node, it is passed by moving back when the lease was seen first
+				passTakeoverWait := func() {
+					vh.observed.Lock()
+					defer vh.observed.Unlock()
+					seen := vh.observed.leases[volid]
+					seen.since = seen.since.Add(-volumeLeaseTakeoverWait)
+					vh.observed.leases[volid] = seen
+				}
+
+				By("expired lease should be taken over only after it is not renewed for the takeover wait")
+				Expect(vh.store.UpdateVolumeLease(volid, VolumeLease{NodeID: owner, ExpiresAt: time.Now().Add(-time.Second)})).To(BeNil())
+				err = vh.AcquireVolumeLease(volid, other)
+				Expect(errors.Is(err, ErrVolumeLeaseHeld)).To(BeTrue(), "expired lease should not be taken over before the wait")
+				passTakeoverWait()
+				Expect(vh.AcquireVolumeLease(volid, other)).To(BeNil(), "cannot take over lease which is not renewed")
+				Expect(leaseOf().NodeID).To(Equal(other))
+
+				By("renewal should start the takeover wait again")
+				err = vh.AcquireVolumeLease(volid, owner)
+				Expect(errors.Is(err, ErrVolumeLeaseHeld)).To(BeTrue(), "lease should be held")
+				passTakeoverWait()
+				Expect(vh.store.RenewVolumeLease(volid, other, time.Now().Add(volumeLeaseDuration))).To(BeNil())
+				err = vh.AcquireVolumeLease(volid, owner)
+				Expect(errors.Is(err, ErrVolumeLeaseHeld)).To(BeTrue(), "renewed lease should not be taken over")
+				Expect(leaseOf().NodeID).To(Equal(other))
+
+				By("lease of a dead node should be taken over only after the takeover wait")
+				Expect(vh.store.MarkNodeDead(other, time.Now())).To(BeNil())
+				err = vh.AcquireVolumeLease(volid, owner)
+				Expect(errors.Is(err, ErrVolumeLeaseHeld)).To(BeTrue(), "lease of dead node should not be taken over before the wait")
+				passTakeoverWait()
+				Expect(vh.AcquireVolumeLease(volid, owner)).To(BeNil(), "cannot take over lease of dead node")
+				Expect(leaseOf().NodeID).To(Equal(owner))
+
+				By("only the owner should release the lease")
+				Expect(vh.ReleaseVolumeLease(volid, other)).To(BeNil())
+				Expect(leaseOf().NodeID).To(Equal(owner))
+				Expect(vh.ReleaseVolumeLease(volid, owner)).To(BeNil(), "cannot release lease")
+				Expect(leaseOf().NodeID).To(BeEmpty())
+
+				Expect(vh.DeleteControllerPublishVolumeInfo(volid, owner)).To(BeNil())
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
+
+			It("only the leases held by the node should be renewed", func() {
+				writable, readable := "3b8e6f2a-9c1d-4e57-b4a0-d6f2c8e1a590", "e1c4a7d9-5f2b-4386-9a0e-7b3d5c9f2e61"
+				node := "renewing-node"
+				Expect(vh.UpdateNodeInfoLastSeen(node, time.Now())).To(BeNil())
+				expiresAt := time.Now().Add(volumeLeaseDuration / 2).Round(time.Second)
+				for i, volid := range []string{writable, readable} {
+					vol, err := vh.CreateVolume(volid, fmt.Sprintf("test-name-9%d", i), fmt.Sprintf("test-pv-9%d", i), fmt.Sprintf("test-pvc-9%d", i), "test-ns-90", defaultPool, 1<<30, true, defaultVolumeOwnership)
+					Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+					Expect(vh.CreateControllerPublishVolumeInfo(volid, node, volid == readable)).To(BeNil())
+					Expect(vh.store.UpdateVolumeLease(volid, VolumeLease{NodeID: node, ExpiresAt: expiresAt})).To(BeNil())
+				}
+				leaseExpiry := func(volid string) time.Time {
+					stored, err := vh.GetVolume(volid)
+					Expect(stored, err).ToNot(BeNil())
+					return stored.VolumeLease.ExpiresAt
+				}
+
+				By("leases not tracked by the node should not be renewed")
+				Expect(vh.RenewVolumeLeases(node)).To(BeNil(), "cannot renew leases")
+				Expect(leaseExpiry(writable)).To(BeTemporally("==", expiresAt))
+				Expect(leaseExpiry(readable)).To(BeTemporally("==", expiresAt))
+
+				By("adopted leases of writable volumes should be renewed")
+				Expect(vh.AdoptVolumeLeases(node)).To(BeNil(), "cannot adopt leases")
+				Expect(vh.RenewVolumeLeases(node)).To(BeNil(), "cannot renew leases")
+				Expect(leaseExpiry(writable)).To(BeTemporally(">", expiresAt))
+				Expect(leaseExpiry(readable)).To(BeTemporally("==", expiresAt), "lease of read only publication should not be renewed")
+
+				for _, volid := range []string{writable, readable} {
+					Expect(vh.ReleaseVolumeLease(volid, node)).To(BeNil())
+					Expect(vh.DeleteControllerPublishVolumeInfo(volid, node)).To(BeNil())
+					Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+				}
+			})
+
+			It("volumes whose leases are not renewed should be fenced", func() {
+				volid := "a7d2c5e8-1b3f-4a96-8e04-f2b9c6d1e835"
+				owner, other := "fenced-owner-node", "fenced-other-node"
+				vol, err := vh.CreateVolume(volid, "test-name-83", "test-pv-83", "test-pvc-83", "test-ns-83", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				Expect(vh.UpdateNodeInfoLastSeen(owner, time.Now())).To(BeNil())
+				Expect(vh.UpdateNodeInfoLastSeen(other, time.Now())).To(BeNil())
+				Expect(vh.CreateControllerPublishVolumeInfo(volid, owner, false)).To(BeNil())
+				ns := &nodeServer{nodeID: owner, vh: vh}
+
+				By("renewed lease should not be fenced")
+				Expect(ns.acquireVolumeLease(volid)).To(BeNil(), "cannot acquire lease")
+				fenced, expiresAt := vh.VolumeLeaseFenced(volid, time.Now())
+				Expect(fenced).To(BeFalse(), "acquired lease should not be fenced")
+				Expect(vh.FenceVolumeLeases(time.Now())).To(BeEmpty())
+
+				By("lease should be fenced before its expiry when it is not renewed")
+				beforeExpiry := expiresAt.Add(-volumeLeaseFenceMargin / 2)
+				fenced, _ = vh.VolumeLeaseFenced(volid, beforeExpiry)
+				Expect(fenced).To(BeTrue(), "lease should be fenced before expiry")
+				Expect(vh.FenceVolumeLeases(beforeExpiry)).To(ConsistOf(FencedLease{VolID: volid, VolPath: vol.VolPath}))
+
+				By("fenced volume should stay fenced and be refused")
+				Expect(vh.RenewVolumeLeases(owner)).To(BeNil(), "cannot renew leases")
+				fenced, _ = vh.VolumeLeaseFenced(volid, time.Now())
+				Expect(fenced).To(BeTrue(), "fenced lease should stay fenced after renewal")
+				Expect(status.Code(ns.acquireVolumeLease(volid))).To(Equal(codes.FailedPrecondition), "fenced volume should be refused")
+
+				By("released lease should not be fenced")
+				Expect(vh.ReleaseVolumeLease(volid, owner)).To(BeNil(), "cannot release lease")
+				fenced, _ = vh.VolumeLeaseFenced(volid, time.Now())
+				Expect(fenced).To(BeFalse(), "released lease should not be fenced")
+
+				By("lease taken over by another node should be fenced at once")
+				Expect(ns.acquireVolumeLease(volid)).To(BeNil(), "cannot acquire lease")
+				Expect(vh.store.UpdateVolumeLease(volid, VolumeLease{NodeID: other, ExpiresAt: time.Now().Add(volumeLeaseDuration)})).To(BeNil())
+				Expect(vh.RenewVolumeLeases(owner)).To(BeNil(), "cannot renew leases")
+				fenced, _ = vh.VolumeLeaseFenced(volid, time.Now())
+				Expect(fenced).To(BeTrue(), "lost lease should be fenced")
+
+				Expect(vh.ReleaseVolumeLease(volid, owner)).To(BeNil())
+				Expect(vh.DeleteControllerPublishVolumeInfo(volid, owner)).To(BeNil())
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
+		})
+
+		Describe("Volume fencing", func() {
+			It("writes to a fenced volume should fail", func() {
+				volid := "c5e8a1f3-7d2b-4c94-b6e0-3a9f2d7c1b48"
+				vol, err := vh.CreateVolume(volid, "test-name-92", "test-pv-92", "test-pvc-92", "test-ns-92", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				Expect(fenceVolume(vol.VolPath)).To(BeNil(), "volume without loop device should be fenced")
+
+				volumePathHandler := volumehelpers.NewBlockVolumePathHandler()
+				loopDevice, err := volumePathHandler.AttachFileDevice(vol.VolPath)
+				Expect(err).To(BeNil(), "cannot attach loop device")
+				device, err := os.OpenFile(loopDevice, os.O_RDWR, 0)
+				Expect(err).To(BeNil(), "cannot open loop device")
+				_, err = device.WriteAt([]byte("before fence"), 0)
+				Expect(err).To(BeNil(), "cannot write to loop device")
+				Expect(device.Sync()).To(BeNil(), "cannot sync loop device")
+
+				By("writes through the open loop device should fail after fencing")
+				Expect(fenceVolume(vol.VolPath)).To(BeNil(), "cannot fence volume")
+				_, err = device.WriteAt([]byte("after fence"), 0)
+				Expect(err).ToNot(BeNil(), "write to fenced loop device should fail")
+				Expect(fenceVolume(vol.VolPath)).To(BeNil(), "fenced volume should be fenced again")
+				Expect(device.Close()).To(BeNil())
+
+				By("image should keep the writes before fencing")
+				image, err := os.Open(vol.VolPath)
+				Expect(err).To(BeNil(), "cannot open image")
+				data := make([]byte, len("before fence"))
+				_, err = image.ReadAt(data, 0)
+				Expect(err).To(BeNil(), "cannot read image")
+				Expect(image.Close()).To(BeNil())
+				Expect(string(data)).To(Equal("before fence"))
+
+				Expect(volumePathHandler.DetachFileDevice(vol.VolPath)).To(BeNil(), "cannot detach loop device")
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
+		})
+
+		Describe("Disk reader access", func() {
+			It("disk volumes should have many readers or a single writer", func() {
+				volid := "8e3f1b6d-2a4c-4d97-9b05-c6e8a2f4d127"
+				vol, err := vh.CreateVolume(volid, "test-name-82", "test-pv-82", "test-pvc-82", "test-ns-82", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				reader, writer := "reader-node", "writer-node"
+				Expect(vh.UpdateNodeInfoLastSeen(reader, time.Now())).To(BeNil())
+				Expect(vh.UpdateNodeInfoLastSeen(writer, time.Now())).To(BeNil())
+				cs := &controllerServer{vh: vh}
+
+				capability := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+					return &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+					}
+				}
+				readerCap := capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+				writerCap := capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+				By("multi node readers should be validated")
+				_, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volid, VolumeCapabilities: []*csi.VolumeCapability{readerCap}})
+				Expect(err).To(BeNil(), "multi node reader should be supported")
+				_, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volid, VolumeCapabilities: []*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}})
+				Expect(status.Code(err)).To(Equal(codes.InvalidArgument), "multi node writer should not be supported")
+
+				By("readers should be attached readonly")
+				_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volid, NodeId: reader, VolumeCapability: readerCap})
+				Expect(err).To(BeNil(), "cannot publish to reader")
+				cpvi, err := vh.GetControllerPublishVolumeInfo(volid, reader)
+				Expect(cpvi, err).ToNot(BeNil())
+				Expect(cpvi.ReadOnly).To(BeTrue(), "reader should be attached readonly")
+				_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volid, NodeId: reader, VolumeCapability: readerCap})
+				Expect(err).To(BeNil(), "reader publish should be idempotent")
+
+				By("writers should be refused while readers exist")
+				_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volid, NodeId: writer, VolumeCapability: writerCap})
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition), "writer should be refused")
+				_, err = cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volid, NodeId: reader})
+				Expect(err).To(BeNil(), "cannot unpublish from reader")
+				_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volid, NodeId: writer, VolumeCapability: writerCap})
+				Expect(err).To(BeNil(), "writer should be published without readers")
+
+				By("readers should be refused while a writer exists or holds the lease")
+				_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volid, NodeId: reader, VolumeCapability: readerCap})
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition), "reader should be refused while writer is published")
+				Expect(vh.AcquireVolumeLease(volid, writer)).To(BeNil(), "cannot acquire lease")
+				_, err = cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volid, NodeId: writer})
+				Expect(err).To(BeNil(), "cannot unpublish from writer")
+				_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volid, NodeId: reader, VolumeCapability: readerCap})
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition), "reader should be refused while writer holds the lease")
+				ns := &nodeServer{nodeID: reader, vh: vh}
+				_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: volid, StagingTargetPath: *dataRoot + "/reader-staging", VolumeCapability: readerCap})
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition), "reader stage should be refused while writer holds the lease")
+				Expect(vh.ReleaseVolumeLease(volid, writer)).To(BeNil(), "cannot release lease")
+
+				By("readers should get readonly loop devices")
+				volumePathHandler := volumehelpers.NewBlockVolumePathHandler()
+				loopDevice, err := volumePathHandler.AttachFileDeviceReadOnly(vol.VolPath)
+				Expect(err).To(BeNil(), "cannot attach readonly loop device")
+				readOnly, err := volumehelpers.IsLoopDeviceReadOnly(loopDevice)
+				Expect(readOnly, err).To(BeTrue(), "loop device should be readonly")
+				_, err = volumePathHandler.AttachFileDevice(vol.VolPath)
+				Expect(err).ToNot(BeNil(), "readonly loop device should not be reused by writers")
+				Expect(volumePathHandler.AttachFileDeviceReadOnly(vol.VolPath)).To(Equal(loopDevice), "readonly loop device should be reused by readers")
+				Expect(volumePathHandler.DetachFileDevice(vol.VolPath)).To(BeNil(), "cannot detach loop device")
+
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
+		})
+
+		Describe("Node stage failures", func() {
+			It("loop devices attached by a failed stage should be detached", func() {
+				volid := "4f7a2c9e-0b3d-4e16-a8c5-d2e9f1b6a043"
+				vol, err := vh.CreateVolume(volid, "test-name-83", "test-pv-83", "test-pvc-83", "test-ns-83", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				Expect(vh.UpdateNodeInfoLastSeen("stage-node", time.Now())).To(BeNil())
+				ns := &nodeServer{nodeID: "stage-node", vh: vh}
+				volumePathHandler := volumehelpers.NewBlockVolumePathHandler()
+
+				// the fs type is missing, so staging fails after the loop device is attached
+				req := &csi.NodeStageVolumeRequest{
+					VolumeId:          volid,
+					StagingTargetPath: filepath.Join(os.TempDir(), "shp-stage-failure"),
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					},
+				}
+				_, err = ns.NodeStageVolume(context.Background(), req)
+				Expect(status.Code(err)).To(Equal(codes.InvalidArgument), "stage without fs type should fail")
+				_, err = volumePathHandler.GetLoopDevice(vol.VolPath)
+				Expect(err).To(MatchError(volumehelpers.ErrDeviceNotFound), "loop device should be detached")
+
+				By("loop devices attached before should be kept")
+				loopDevice, err := volumePathHandler.AttachFileDevice(vol.VolPath)
+				Expect(err).To(BeNil(), "cannot attach loop device")
+				_, err = ns.NodeStageVolume(context.Background(), req)
+				Expect(status.Code(err)).To(Equal(codes.InvalidArgument), "stage without fs type should fail")
+				Expect(volumePathHandler.GetLoopDevice(vol.VolPath)).To(Equal(loopDevice), "loop device should be kept")
+				Expect(volumePathHandler.DetachFileDevice(vol.VolPath)).To(BeNil(), "cannot detach loop device")
+
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
+		})
+
 		Describe("Test ControllerPublishVolumeInfo operations", func() {
 			It("should work", func() {
 				By("create dummy cpvi")
@@ -204,10 +910,19 @@ var _ = Describe("Utils Methods Tests", func() {
 				Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
 				Expect(npvi).To(BeNil(), "npvi is nil")
 
+				By("get all node publish volume infos of volume")
+				npvis, err := vh.GetNodePublishVolumeInfos("test-volume", "test-node")
+				Expect(err).To(BeNil(), "cannot get npvis")
+				Expect(npvis).To(HaveLen(1), "volume should be published once")
+
 				By("delete node publish volume info")
 				err = vh.DeleteNodePublishVolumeInfo("test-volume", "test-node", "/dummy/mount/point")
 				Expect(err).To(BeNil(), "cannot delete npvi")
 
+				npvis, err = vh.GetNodePublishVolumeInfos("test-volume", "test-node")
+				Expect(err).To(BeNil(), "cannot get npvis")
+				Expect(npvis).To(BeEmpty(), "volume should not be published")
+
 				By("get node publish volume info with deleted")
 				npvi, err = vh.GetNodePublishVolumeInfo("test-volume", "test-node", "/dummy/mount/point")
 				Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
@@ -222,7 +937,7 @@ var _ = Describe("Utils Methods Tests", func() {
 				var err error
 
 				By("create dummy volume")
-				vol, err = vh.CreateVolume(volname, "test-name-3", "test-pv-3", "test-pvc-3", "test-ns-3", 1<<30, false)
+				vol, err = vh.CreateVolume(volname, "test-name-3", "test-pv-3", "test-pvc-3", "test-ns-3", defaultPool, 1<<30, false, defaultVolumeOwnership)
 				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
 
 				By("expand volume")
@@ -244,7 +959,7 @@ var _ = Describe("Utils Methods Tests", func() {
 				var err error
 
 				By("create dummy volume")
-				vol, err = vh.CreateVolume(volname, "test-name-4", "test-pv-4", "test-pvc-4", "test-ns-4", 1<<30, true)
+				vol, err = vh.CreateVolume(volname, "test-name-4", "test-pv-4", "test-pvc-4", "test-ns-4", defaultPool, 1<<30, true, defaultVolumeOwnership)
 				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
 
 				By("expand volume")
@@ -263,6 +978,749 @@ var _ = Describe("Utils Methods Tests", func() {
 				By("clean up volume")
 				vh.DeleteVolume(volname)
 			})
+
+			It("disk volume expansion with a stale record should use the stored capacity", func() {
+				volname := "6d1f3b8e-27a4-4c95-b0e2-8f7a5c3d9e41"
+				vol, err := vh.CreateVolume(volname, "test-name-4s", "test-pv-4s", "test-pvc-4s", "test-ns-4s", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create disk volume")
+				stale := *vol
+
+				By("expand volume with the current record")
+				Expect(vh.UpdateVolumeCapacity(vol, 2<<30)).To(BeNil(), "cannot expand volume")
+
+				By("expand volume with the stale record")
+				Expect(vh.UpdateVolumeCapacity(&stale, 3<<30)).To(BeNil(), "stale record should not fail size check")
+				fi, err := os.Stat(vol.VolPath)
+				Expect(fi, err).ToNot(BeNil(), "cannot stat volume file")
+				Expect(fi.Size()).To(Equal(int64(3<<30)), "file size did not expand")
+
+				By("expansion to a smaller size should keep the stored capacity")
+				stale.Capacity = 1 << 30
+				Expect(vh.UpdateVolumeCapacity(&stale, 2<<30)).To(BeNil(), "already expanded volume should succeed")
+				Expect(stale.Capacity).To(Equal(int64(3<<30)), "record should have the stored capacity")
+				vol, err = vh.GetVolume(volname)
+				Expect(vol, err).ToNot(BeNil(), "cannot get volume")
+				Expect(vol.Capacity).To(Equal(int64(3<<30)), "stored capacity should not shrink")
+
+				vh.DeleteVolume(volname)
+			})
+		})
+
+		Describe("Snapshot operations", func() {
+			It("folder volume snapshot should work", func() {
+				volname := "8a3e1c52-5f7d-4b0e-9c61-2d4f0b7a9e13"
+				snapname := "c0f4d8a2-6b1e-4f3a-8d27-91e5b3c6a704"
+				By("create dummy volume")
+				vol, err := vh.CreateVolume(volname, "test-name-7", "test-pv-7", "test-pvc-7", "test-ns-7", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				err = os.WriteFile(vol.VolPath+"/data.txt", []byte("snapshot data"), 0640)
+				Expect(err).To(BeNil(), "cannot write volume data")
+
+				By("create snapshot")
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-7", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+				Expect(snap.ReadyToUse).To(BeTrue(), "snapshot should be ready")
+				Expect(snap.Size).To(Equal(vol.Capacity), "snapshot size should be volume capacity")
+				Expect(*dataRoot+"/snaps/c0/f4/d8/c0f4d8a2-6b1e-4f3a-8d27-91e5b3c6a704").Should(BeADirectory(), "snapshot folder should be exists")
+				data, err := os.ReadFile(snap.SnapPath + "/data.txt")
+				Expect(err).To(BeNil(), "cannot read snapshot data")
+				Expect(string(data)).To(Equal("snapshot data"), "snapshot data dismatch")
+
+				By("get snapshot by name")
+				snapid, err := vh.GetSnapshotIdByName("test-snap-7")
+				Expect(err).To(BeNil(), "error occured")
+				Expect(snapid).To(Equal(snapname), "snapid is not expected")
+
+				By("list snapshots with filters")
+				snaps, err := vh.GetSnapshots("", volname, 0, 10)
+				Expect(err).To(BeNil(), "cannot list snapshots")
+				Expect(snaps).To(HaveLen(1), "snapshot should be listed by source volume")
+				snaps, err = vh.GetSnapshots(snapname, "", 0, 10)
+				Expect(err).To(BeNil(), "cannot list snapshots")
+				Expect(snaps).To(HaveLen(1), "snapshot should be listed by id")
+				sc, err := vh.GetSnapshotCount("", "any-volume")
+				Expect(err).To(BeNil(), "cannot count snapshots")
+				Expect(sc).To(Equal(0), "no snapshot should be listed for unknown volume")
+
+				By("delete snapshot")
+				err = vh.DeleteSnapshot(snapname)
+				Expect(err).To(BeNil(), "cannot delete snapshot")
+				snap, err = vh.GetSnapshot(snapname)
+				Expect(snap).To(BeNil(), "snapshot should not be returned")
+				Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
+				Expect(*dataRoot+"/snaps/c0/f4/d8/c0f4d8a2-6b1e-4f3a-8d27-91e5b3c6a704").ShouldNot(BeADirectory(), "snapshot folder should not be exists")
+
+				By("cleanup volume")
+				vh.DeleteVolume(volname)
+			})
+
+			It("disk volume snapshot should keep sparseness", func() {
+				volname := "5b7d2e90-3c4a-4e8f-a1d6-7f2c9b0e8a35"
+				snapname := "e3a9c1f7-0d2b-4c6e-b8f4-1a5d7e9c3b20"
+				By("create dummy volume")
+				vol, err := vh.CreateVolume(volname, "test-name-8", "test-pv-8", "test-pvc-8", "test-ns-8", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create disk volume")
+				f, err := os.OpenFile(vol.VolPath, os.O_WRONLY, 0)
+				Expect(err).To(BeNil(), "cannot open volume file")
+				_, err = f.WriteAt([]byte("disk snapshot data"), 512<<20)
+				f.Close()
+				Expect(err).To(BeNil(), "cannot write volume data")
+
+				By("create snapshot")
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-8", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+				Expect(snap.CopyMethod).To(BeElementOf(copyMethodReflink, copyMethodSparse), "copy method should be recorded")
+				Expect(snap.AllocatedSize).To(BeNumerically("<", vol.Capacity), "snapshot should be sparse")
+				fi, err := os.Stat(snap.SnapPath)
+				Expect(err).To(BeNil(), "cannot stat snapshot file")
+				Expect(fi.Size()).To(Equal(vol.Capacity), "snapshot file size dismatch")
+				data := make([]byte, 18)
+				f, err = os.Open(snap.SnapPath)
+				Expect(err).To(BeNil(), "cannot open snapshot file")
+				_, err = f.ReadAt(data, 512<<20)
+				f.Close()
+				Expect(err).To(BeNil(), "cannot read snapshot data")
+				Expect(string(data)).To(Equal("disk snapshot data"), "snapshot data dismatch")
+
+				By("cleanup")
+				vh.DeleteSnapshot(snapname)
+				vh.DeleteVolume(volname)
+			})
+
+			It("snapshot deletion should fail when the snapshot cannot be read", func() {
+				cs := &controllerServer{vh: vh}
+				_, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "missing-snapshot"})
+				Expect(err).To(BeNil(), "missing snapshot should be deleted")
+
+				store := vh.store
+				defer func() { vh.store = store }()
+				vh.store = &failingSnapshotReadStore{store}
+				_, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "unreadable-snapshot"})
+				Expect(status.Code(err)).To(Equal(codes.Internal), "store errors should not be reported as deleted")
+			})
+		})
+
+		Describe("Restore volume from snapshot", func() {
+			It("folder snapshot restore should work", func() {
+				volname := "7c2e4a91-0b3d-4f6e-8a15-c9d2e7f0b348"
+				restorename := "1f8b6d3a-9e2c-4a7d-b5f0-3c6e8a1d7b92"
+				snapname := "a4d7f2c9-8b1e-4e3a-9c60-5f2b7d8e1a03"
+				By("create dummy volume and snapshot")
+				vol, err := vh.CreateVolume(volname, "test-name-9", "test-pv-9", "test-pvc-9", "test-ns-9", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				err = os.WriteFile(vol.VolPath+"/data.txt", []byte("restore data"), 0640)
+				Expect(err).To(BeNil(), "cannot write volume data")
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-9", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+
+				By("restore into disk volume should fail")
+				_, err = vh.CreateVolumeFromSnapshot(restorename, "test-name-10", "test-pv-10", "test-pvc-10", "test-ns-10", defaultPool, 1<<30, true, defaultVolumeOwnership, snap)
+				Expect(err).NotTo(BeNil(), "type dismatch should fail")
+
+				By("restore into smaller volume should fail")
+				_, err = vh.CreateVolumeFromSnapshot(restorename, "test-name-10", "test-pv-10", "test-pvc-10", "test-ns-10", defaultPool, 1<<29, false, defaultVolumeOwnership, snap)
+				Expect(err).NotTo(BeNil(), "smaller capacity should fail")
+
+				By("restore volume")
+				restored, err := vh.CreateVolumeFromSnapshot(restorename, "test-name-10", "test-pv-10", "test-pvc-10", "test-ns-10", defaultPool, 2<<30, false, defaultVolumeOwnership, snap)
+				Expect(restored, err).ToNot(BeNil(), "cannot restore volume")
+				Expect(restored.SourceSnapID).To(Equal(snapname), "source snapshot should be recorded")
+				data, err := os.ReadFile(restored.VolPath + "/data.txt")
+				Expect(err).To(BeNil(), "cannot read restored data")
+				Expect(string(data)).To(Equal("restore data"), "restored data dismatch")
+
+				By("volume detail should have content source")
+				vd, err := vh.GetVolumeWithDetail(restorename)
+				Expect(err).To(BeNil(), "error at getting volume detail")
+				Expect(vd["source_snapshot_id"]).To(Equal(snapname))
+
+				By("cleanup")
+				vh.DeleteVolume(restorename)
+				vh.DeleteSnapshot(snapname)
+				vh.DeleteVolume(volname)
+			})
+
+			It("disk snapshot restore should work", func() {
+				volname := "3e9a7c15-2d8f-4b6a-a0e4-8c1f5b9d2e76"
+				restorename := "9b5c1e8d-7a3f-4d2b-8e69-0f4a6c2d8b15"
+				snapname := "6d0f3b8a-4c7e-4a19-b2d5-e8a1c9f7b340"
+				By("create dummy volume and snapshot")
+				vol, err := vh.CreateVolume(volname, "test-name-11", "test-pv-11", "test-pvc-11", "test-ns-11", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create disk volume")
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-11", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+
+				By("restore volume with bigger capacity")
+				restored, err := vh.CreateVolumeFromSnapshot(restorename, "test-name-12", "test-pv-12", "test-pvc-12", "test-ns-12", defaultPool, 2<<30, true, defaultVolumeOwnership, snap)
+				Expect(restored, err).ToNot(BeNil(), "cannot restore volume")
+				fi, err := os.Stat(restored.VolPath)
+				Expect(err).To(BeNil(), "cannot stat restored volume")
+				Expect(fi.Size()).To(Equal(int64(2<<30)), "restored volume should have requested capacity")
+
+				By("cleanup")
+				vh.DeleteVolume(restorename)
+				vh.DeleteSnapshot(snapname)
+				vh.DeleteVolume(volname)
+			})
+
+			It("snapshot deletion should wait until the restore ends", func() {
+				volname := "c5a1e7d3-2b9f-4e60-8d14-7f3b9a0c6e28"
+				restorename := "8e2d6b0f-4a7c-4c95-b1e3-0d9f5a2c7b61"
+				snapname := "2f7b9d4e-6c1a-4b83-9e05-a3d8c1f6e970"
+				vol, err := vh.CreateVolume(volname, "test-name-84", "test-pv-84", "test-pvc-84", "test-ns-84", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				err = os.WriteFile(vol.VolPath+"/data.txt", []byte("restore race data"), 0640)
+				Expect(err).To(BeNil(), "cannot write volume data")
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-84", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+
+				deleted := make(chan error, 1)
+				deletedDuringRestore := false
+				failStep = func(step string) error {
+					if step == "CreateVolume/populate" {
+						go func() {
+							deleted <- vh.DeleteSnapshot(snapname)
+						}()
+						select {
+						case err := <-deleted:
+							deleted <- err
+							deletedDuringRestore = true
+						case <-time.After(2 * time.Second):
+						}
+					}
+					return nil
+				}
+				defer clearFailures(vh)
+
+				restored, err := vh.CreateVolumeFromSnapshot(restorename, "test-name-85", "test-pv-85", "test-pvc-85", "test-ns-85", defaultPool, 1<<30, false, defaultVolumeOwnership, snap)
+				Expect(restored, err).ToNot(BeNil(), "cannot restore volume")
+				Expect(deletedDuringRestore).To(BeFalse(), "snapshot should not be deleted during the restore")
+				data, err := os.ReadFile(restored.VolPath + "/data.txt")
+				Expect(err).To(BeNil(), "cannot read restored data")
+				Expect(string(data)).To(Equal("restore race data"), "restored data dismatch")
+				Eventually(deleted, 10*time.Second).Should(Receive(BeNil()), "snapshot should be deleted after the restore")
+
+				By("restore from the deleted snapshot should fail")
+				_, err = vh.CreateVolumeFromSnapshot("d1f4a8c2-9e3b-4d70-a6c5-3b8e2f9d0a14", "test-name-86", "test-pv-86", "test-pvc-86", "test-ns-86", defaultPool, 1<<30, false, defaultVolumeOwnership, snap)
+				Expect(errors.Is(err, ErrRecordNotFound)).To(BeTrue(), "deleted snapshot should not be restored")
+
+				By("cleanup")
+				vh.DeleteVolume(restorename)
+				vh.DeleteVolume(volname)
+			})
+		})
+
+		Describe("Clone volume", func() {
+			It("folder volume clone should work", func() {
+				volname := "0d6a2f8c-5e1b-4c9a-b7e3-4a8f1c2d6e59"
+				clonename := "b8e1d4a7-3f9c-4b2e-a6d0-7c5f9e2a1b84"
+				By("create dummy volume")
+				vol, err := vh.CreateVolume(volname, "test-name-13", "test-pv-13", "test-pvc-13", "test-ns-13", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				err = os.MkdirAll(vol.VolPath+"/sub", 0750)
+				Expect(err).To(BeNil(), "cannot create volume sub folder")
+				err = os.WriteFile(vol.VolPath+"/sub/data.txt", []byte("clone data"), 0640)
+				Expect(err).To(BeNil(), "cannot write volume data")
+
+				By("clone into disk volume should fail")
+				_, err = vh.CreateVolumeFromVolume(clonename, "test-name-14", "test-pv-14", "test-pvc-14", "test-ns-14", defaultPool, 1<<30, true, defaultVolumeOwnership, vol)
+				Expect(err).NotTo(BeNil(), "type dismatch should fail")
+
+				By("clone volume")
+				clone, err := vh.CreateVolumeFromVolume(clonename, "test-name-14", "test-pv-14", "test-pvc-14", "test-ns-14", defaultPool, 1<<30, false, defaultVolumeOwnership, vol)
+				Expect(clone, err).ToNot(BeNil(), "cannot clone volume")
+				Expect(clone.ParentVolID).To(Equal(volname), "parent volume should be recorded")
+				data, err := os.ReadFile(clone.VolPath + "/sub/data.txt")
+				Expect(err).To(BeNil(), "cannot read cloned data")
+				Expect(string(data)).To(Equal("clone data"), "cloned data dismatch")
+
+				By("volume detail should have parent")
+				vd, err := vh.GetVolumeWithDetail(clonename)
+				Expect(err).To(BeNil(), "error at getting volume detail")
+				Expect(vd["parent_volume_id"]).To(Equal(volname))
+
+				By("cleanup")
+				vh.DeleteVolume(clonename)
+				vh.DeleteVolume(volname)
+			})
+
+			It("parent volume should be locked through the clone", func() {
+				volname := "4b8f2d6a-1e9c-4a37-85d0-c6e3a9f1b725"
+				clonename := "e7c3a9f1-5d2b-4e80-b4a6-2f8d0c6e1a93"
+				writer := "clone-writer-node"
+				vol, err := vh.CreateVolume(volname, "test-name-87", "test-pv-87", "test-pvc-87", "test-ns-87", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create disk volume")
+
+				By("disk written by a live node should not be cloned")
+				Expect(vh.UpdateNodeInfoLastSeen(writer, time.Now())).To(BeNil())
+				Expect(vh.AcquireVolumeLease(volname, writer)).To(BeNil(), "cannot acquire lease")
+				_, err = vh.CreateVolumeFromVolume(clonename, "test-name-88", "test-pv-88", "test-pvc-88", "test-ns-88", defaultPool, 1<<30, true, defaultVolumeOwnership, vol)
+				Expect(errors.Is(err, ErrVolumeLeaseHeld)).To(BeTrue(), "disk with a live writer should not be cloned")
+				Expect(vh.ReleaseVolumeLease(volname, writer)).To(BeNil(), "cannot release lease")
+
+				By("parent deletion should wait until the clone ends")
+				deleted := make(chan error, 1)
+				deletedDuringClone := false
+				failStep = func(step string) error {
+					if step == "CreateVolume/populate" {
+						go func() {
+							deleted <- vh.DeleteVolume(volname)
+						}()
+						select {
+						case err := <-deleted:
+							deleted <- err
+							deletedDuringClone = true
+						case <-time.After(2 * time.Second):
+						}
+					}
+					return nil
+				}
+				defer clearFailures(vh)
+
+				clone, err := vh.CreateVolumeFromVolume(clonename, "test-name-88", "test-pv-88", "test-pvc-88", "test-ns-88", defaultPool, 1<<30, true, defaultVolumeOwnership, vol)
+				Expect(clone, err).ToNot(BeNil(), "cannot clone volume")
+				Expect(deletedDuringClone).To(BeFalse(), "parent should not be deleted during the clone")
+				fi, err := os.Stat(clone.VolPath)
+				Expect(err).To(BeNil(), "cannot stat cloned volume")
+				Expect(fi.Size()).To(Equal(int64(1<<30)), "cloned volume should have parent capacity")
+				Eventually(deleted, 10*time.Second).Should(Receive(BeNil()), "parent should be deleted after the clone")
+
+				By("cleanup")
+				vh.DeleteVolume(clonename)
+			})
+		})
+
+		Describe("Get statistics", func() {
+			It("statistics of shared storage should be returned", func() {
+				stats, err := vh.GetStatistics(defaultPool)
+				Expect(err).To(BeNil(), "cannot get statistics")
+				Expect(stats.totalBytes).To(BeNumerically(">", 0), "total bytes should be positive")
+				Expect(stats.availableBytes).To(BeNumerically("<=", stats.totalBytes), "available bytes should not exceed total bytes")
+			})
+
+			It("capacity should be multiplied by the overcommit ratio", func() {
+				cs := &controllerServer{vh: vh}
+				resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+				Expect(resp, err).ToNot(BeNil(), "cannot get capacity")
+				Expect(resp.GetMaximumVolumeSize().GetValue()).To(Equal(resp.GetAvailableCapacity()), "maximum volume size should be the available capacity")
+
+				overcommitted, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{overcommitRatioParameter: "2.5"}})
+				Expect(overcommitted, err).ToNot(BeNil(), "cannot get overcommitted capacity")
+				Expect(overcommitted.GetAvailableCapacity()).To(BeNumerically("~", float64(resp.GetAvailableCapacity())*2.5, 64*MiB))
+				Expect(overcommitted.GetMaximumVolumeSize().GetValue()).To(Equal(overcommitted.GetAvailableCapacity()), "maximum volume size should be the overcommitted capacity")
+
+				unbounded, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{overcommitRatioParameter: "1000000"}})
+				Expect(unbounded, err).ToNot(BeNil(), "cannot get unbounded capacity")
+				Expect(unbounded.GetMaximumVolumeSize().GetValue()).To(Equal(int64(maxStorageCapacity-MiB)), "maximum volume size should be limited by the maximum capacity")
+
+				_, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{overcommitRatioParameter: "0"}})
+				Expect(status.Code(err)).To(Equal(codes.InvalidArgument), "zero overcommit ratio should be rejected")
+			})
+		})
+
+		Describe("Metrics", func() {
+			It("grpc requests should be counted by code", func() {
+				info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+				failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return nil, status.Error(codes.NotFound, "not found")
+				}
+				before := testutil.ToFloat64(grpcRequests.WithLabelValues(info.FullMethod, "NotFound"))
+				_, err := metricsGRPC(context.Background(), nil, info, failing)
+				Expect(status.Code(err)).To(Equal(codes.NotFound), "error should be returned as is")
+				Expect(testutil.ToFloat64(grpcRequests.WithLabelValues(info.FullMethod, "NotFound"))).To(Equal(before + 1))
+			})
+
+			It("volumes should be collected by type and namespace", func() {
+				volid := "2a6e0c4b-8d1f-4b53-97e2-c0a4e8b6d217"
+				vol, err := vh.CreateVolume(volid, "test-name-50", "test-pv-50", "test-pvc-50", "test-ns-metrics", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				snapid := "6d0b3f8e-1a5c-4e27-b9d4-f2c7a0e3b518"
+				snap, err := vh.CreateSnapshot(snapid, "test-snap-50", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+				Expect(testutil.CollectAndCount(metadataQueryDuration)).To(BeNumerically(">", 0), "metadata queries should be observed")
+
+				registry := prometheus.NewRegistry()
+				Expect(registry.Register(&volumeCollector{vh: vh})).To(BeNil())
+				families, err := registry.Gather()
+				Expect(err).To(BeNil(), "cannot gather metrics")
+				values := make(map[string]float64)
+				for _, family := range families {
+					for _, metric := range family.GetMetric() {
+						labels := family.GetName()
+						for _, label := range metric.GetLabel() {
+							labels += "," + label.GetName() + "=" + label.GetValue()
+						}
+						values[labels] = metric.GetGauge().GetValue()
+					}
+				}
+				Expect(values).To(HaveKeyWithValue("sharedhostpath_volumes,namespace=test-ns-metrics,pool=default,type=folder", float64(1)))
+				Expect(values).To(HaveKeyWithValue("sharedhostpath_provisioned_bytes,namespace=test-ns-metrics,pool=default,type=folder", float64(1<<30)))
+				Expect(values).To(HaveKey("sharedhostpath_pool_bytes,pool=default,state=total"))
+				Expect(values).To(HaveKeyWithValue("sharedhostpath_snapshot_allocated_bytes,copy_method="+snap.CopyMethod+",pool=default,snapshot="+snapid+",source_volume="+volid, float64(snap.AllocatedSize)))
+				Expect(snap.CopyMethod).To(BeElementOf(copyMethodReflink, copyMethodSparse))
+
+				Expect(vh.DeleteSnapshot(snapid)).To(BeNil(), "cannot delete snapshot")
+				err = vh.DeleteVolume(volid)
+				Expect(err).To(BeNil(), "cannot delete volume")
+			})
+		})
+
+		Describe("Storage pools", func() {
+			It("pools should be parsed", func() {
+				pools, err := ParsePools("/data", "fast=/fast, slow=/slow")
+				Expect(err).To(BeNil(), "cannot parse pools")
+				Expect(pools).To(Equal(map[string]string{defaultPool: "/data", "fast": "/fast", "slow": "/slow"}))
+
+				_, err = ParsePools("/data", "fast")
+				Expect(err).NotTo(BeNil(), "invalid pool should not be parsed")
+				_, err = ParsePools("/data", "default=/other")
+				Expect(err).NotTo(BeNil(), "duplicate pool should not be parsed")
+			})
+
+			It("volumes should be created inside selected pool", func() {
+				secondRoot := *dataRoot + "-second"
+				defer os.RemoveAll(secondRoot)
+				pvh, err := NewVolumeHelperWithPools(map[string]string{defaultPool: *dataRoot, "second": secondRoot}, *dsn)
+				Expect(pvh, err).ToNot(BeNil(), "cannot create volume helper with pools")
+				defer pvh.Close()
+
+				Expect(pvh.HasPool("second")).To(BeTrue(), "second pool should exist")
+				Expect(pvh.HasPool("unknown")).To(BeFalse(), "unknown pool should not exist")
+
+				_, err = pvh.CreateVolume("0b0c1f4e-2d57-4a53-8a4e-6a1d3f0c9b11", "test-name-pool", "test-pv-pool", "test-pvc-pool", "test-ns-pool", "unknown", 1<<30, false, defaultVolumeOwnership)
+				Expect(err).NotTo(BeNil(), "volume should not be created in unknown pool")
+
+				volname := "7e4a2b9c-81d3-4c4f-9f2e-2b5d6c7a8e10"
+				vol, err := pvh.CreateVolume(volname, "test-name-pool", "test-pv-pool", "test-pvc-pool", "test-ns-pool", "second", 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume in second pool")
+				Expect(vol.Pool).To(Equal("second"))
+				Expect(vol.VolPath).To(HavePrefix(secondRoot), "volume should be inside second pool")
+
+				_, err = os.Lstat(secondRoot + "/syms/test-ns-pool/test-pvc-pool")
+				Expect(err).To(BeNil(), "symlink should be inside second pool")
+
+				_, err = pvh.GetStatistics("second")
+				Expect(err).To(BeNil(), "cannot get statistics of second pool")
+
+				err = pvh.ReBuildSymLinks()
+				Expect(err).To(BeNil(), "cannot rebuild symlinks")
+				_, err = os.Lstat(secondRoot + "/syms/test-ns-pool/test-pvc-pool")
+				Expect(err).To(BeNil(), "symlink should be rebuilt inside second pool")
+
+				err = pvh.DeleteVolume(volname)
+				Expect(err).To(BeNil(), "cannot delete volume in second pool")
+			})
+
+			It("mounted pools should be detected by markers", func() {
+				secondRoot := *dataRoot + "-second"
+				defer os.RemoveAll(secondRoot)
+				pvh, err := NewVolumeHelperWithPools(map[string]string{defaultPool: *dataRoot, "second": secondRoot}, *dsn)
+				Expect(pvh, err).ToNot(BeNil(), "cannot create volume helper with pools")
+				defer pvh.Close()
+
+				os.Remove(secondRoot + "/" + poolMarker)
+				Expect(pvh.WritePoolMarkers()).To(BeNil(), "cannot write pool markers")
+				Expect(pvh.GetMountedPools()).To(Equal([]string{defaultPool, "second"}))
+
+				os.Remove(secondRoot + "/" + poolMarker)
+				Expect(pvh.GetMountedPools()).To(Equal([]string{defaultPool}))
+
+				By("node info should follow the markers")
+				ns := &nodeServer{nodeID: "pool-node", vh: pvh}
+				info, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+				Expect(info, err).ToNot(BeNil(), "cannot get node info")
+				Expect(info.GetAccessibleTopology().GetSegments()).To(Equal(map[string]string{poolTopologyKey(defaultPool): "true"}))
+				os.Remove(*dataRoot + "/" + poolMarker)
+				_, err = ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+				Expect(status.Code(err)).To(Equal(codes.Unavailable), "node without pools should not register")
+				Expect(pvh.WritePoolMarkers()).To(BeNil(), "cannot write pool markers")
+				info, err = ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+				Expect(info, err).ToNot(BeNil(), "cannot get node info")
+				Expect(info.GetAccessibleTopology().GetSegments()).To(HaveLen(2), "markers written later should be seen")
+				os.Remove(secondRoot + "/" + poolMarker)
+
+				By("select pool by topology")
+				cs := &controllerServer{vh: pvh}
+				second := &csi.Topology{Segments: map[string]string{poolTopologyKey("second"): "true"}}
+				both := &csi.Topology{Segments: map[string]string{poolTopologyKey(defaultPool): "true", poolTopologyKey("second"): "true"}}
+
+				pool, err := cs.selectPool("", nil)
+				Expect(pool, err).To(Equal(defaultPool))
+				pool, err = cs.selectPool("", &csi.TopologyRequirement{Requisite: []*csi.Topology{both}, Preferred: []*csi.Topology{second}})
+				Expect(pool, err).To(Equal("second"))
+				pool, err = cs.selectPool(defaultPool, &csi.TopologyRequirement{Requisite: []*csi.Topology{both}})
+				Expect(pool, err).To(Equal(defaultPool))
+				_, err = cs.selectPool(defaultPool, &csi.TopologyRequirement{Requisite: []*csi.Topology{second}})
+				Expect(status.Code(err)).To(Equal(codes.ResourceExhausted), "pool outside of requisite topologies should not be selected")
+			})
+		})
+
+		Describe("Volume locks", func() {
+			It("locked keys should not be acquired again", func() {
+				var locks volumeLocks
+				Expect(locks.TryAcquire("vol-1")).To(BeTrue(), "free key should be acquired")
+				Expect(locks.TryAcquire("vol-1")).To(BeFalse(), "locked key should not be acquired")
+				Expect(locks.TryAcquire("snap-1", "vol-1")).To(BeFalse(), "keys should not be acquired when one is locked")
+				Expect(locks.TryAcquire("snap-1")).To(BeTrue(), "partially acquired keys should not be kept")
+				locks.Release("vol-1", "snap-1")
+				Expect(locks.TryAcquire("vol-1", "snap-1")).To(BeTrue(), "released keys should be acquired")
+			})
+
+			It("operations on a locked volume should be aborted", func() {
+				cs := &controllerServer{vh: vh}
+				Expect(cs.locks.TryAcquire("locked-vol")).To(BeTrue())
+
+				_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "locked-vol"})
+				Expect(status.Code(err)).To(Equal(codes.Aborted), "delete should be aborted")
+				_, err = cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{VolumeId: "locked-vol", CapacityRange: &csi.CapacityRange{RequiredBytes: GiB}})
+				Expect(status.Code(err)).To(Equal(codes.Aborted), "expand should be aborted")
+				_, err = cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-of-locked-vol", SourceVolumeId: "locked-vol"})
+				Expect(status.Code(err)).To(Equal(codes.Aborted), "snapshot should be aborted")
+
+				_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "other-vol"})
+				Expect(err).To(BeNil(), "other volumes should not be blocked")
+
+				cs.locks.Release("locked-vol")
+				_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "locked-vol"})
+				Expect(err).To(BeNil(), "released volume should be processed")
+			})
+		})
+
+		Describe("Mount flags", func() {
+			It("safe mount flags should be accepted", func() {
+				options, err := validateMountFlags([]string{"noatime", "discard,nodev", "context=system_u:object_r:container_file_t:s0"})
+				Expect(err).To(BeNil(), "safe mount flags should be accepted")
+				Expect(options).To(Equal([]string{"noatime", "discard", "nodev", "context=system_u:object_r:container_file_t:s0"}))
+			})
+
+			It("unsafe mount flags should be rejected", func() {
+				_, err := validateMountFlags([]string{"noatime", "suid"})
+				Expect(err).NotTo(BeNil(), "suid should be rejected")
+				_, err = validateMountFlags([]string{"remount,rw"})
+				Expect(err).NotTo(BeNil(), "remount should be rejected")
+			})
+		})
+
+		Describe("Volume condition", func() {
+			It("problems of published folder volumes should be reported", func() {
+				volid := "9c1e5a3f-7b2d-4f68-8e0a-b3d7f1c5a962"
+				vol, err := vh.CreateVolume(volid, "test-name-60", "test-pv-60", "test-pvc-60", "test-ns-60", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+				target, err := os.MkdirTemp("", "shp-condition")
+				Expect(err).To(BeNil())
+				npvi := &NodePublishVolumeInfo{VolID: volid, NodeID: "test-node", MountPath: target}
+
+				condition := volumeCondition(vol, npvi, target, false, time.Time{})
+				Expect(condition.Abnormal).To(BeTrue(), "unmounted target should be abnormal")
+				Expect(condition.Message).To(ContainSubstring("is not a mount point"))
+
+				mounter := mount.New("")
+				Expect(mounter.Mount(vol.VolPath, target, "", []string{"bind"})).To(BeNil(), "cannot bind mount volume")
+				condition = volumeCondition(vol, npvi, target, false, time.Time{})
+				Expect(condition.Abnormal).To(BeFalse(), condition.Message)
+
+				out, err := utilexec.New().Command("mount", "-o", "remount,bind,ro", target).CombinedOutput()
+				Expect(err).To(BeNil(), "cannot remount volume: %s", out)
+				condition = volumeCondition(vol, npvi, target, false, time.Time{})
+				Expect(condition.Abnormal).To(BeTrue(), "read only filesystem of a writable volume should be abnormal")
+				Expect(condition.Message).To(ContainSubstring("is read only"))
+				npvi.ReadOnly = true
+				condition = volumeCondition(vol, npvi, target, false, time.Time{})
+				Expect(condition.Abnormal).To(BeFalse(), condition.Message)
+				condition = volumeCondition(vol, npvi, target, true, time.Now())
+				Expect(condition.Abnormal).To(BeTrue(), "fenced volume should be abnormal")
+				Expect(condition.Message).To(ContainSubstring("writes are stopped"))
+
+				Expect(mounter.Unmount(target)).To(BeNil())
+				os.Remove(target)
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+				condition = volumeCondition(vol, npvi, target, false, time.Time{})
+				Expect(condition.Message).To(ContainSubstring("cannot access volume"))
+			})
+		})
+
+		Describe("Volume ownership", func() {
+			It("storage class parameters should be parsed", func() {
+				owner, err := volumeOwnershipOf(map[string]string{uidParameter: "1000", gidParameter: "2000", modeParameter: "0750"})
+				Expect(err).To(BeNil(), "valid parameters should be parsed")
+				Expect(owner).To(Equal(VolumeOwnership{UID: 1000, GID: 2000, Mode: 0750}))
+				owner, err = volumeOwnershipOf(map[string]string{})
+				Expect(err).To(BeNil(), "empty parameters should be parsed")
+				Expect(owner).To(Equal(defaultVolumeOwnership), "default ownership should be used")
+				_, err = volumeOwnershipOf(map[string]string{modeParameter: "0778"})
+				Expect(err).NotTo(BeNil(), "invalid mode should be rejected")
+				_, err = volumeOwnershipOf(map[string]string{uidParameter: "-1"})
+				Expect(err).NotTo(BeNil(), "negative uid should be rejected")
+			})
+
+			It("folder volume should be created with the ownership", func() {
+				volname := "4c2e8a71-9d3b-4f6e-a015-7b8d2c9e6f43"
+				vol, err := vh.CreateVolume(volname, "test-name-owner", "test-pv-owner", "test-pvc-owner", "test-ns-owner", defaultPool, 1<<30, false, VolumeOwnership{UID: os.Getuid(), GID: os.Getgid(), Mode: 0750})
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				fi, err := os.Stat(vol.VolPath)
+				Expect(err).To(BeNil(), "cannot stat volume")
+				Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0750)), "volume mode should be applied")
+
+				err = vh.DeleteVolume(volname)
+				Expect(err).To(BeNil(), "cannot delete folder volume")
+			})
+
+			It("disk volume ownership should be applied only when it is formatted", func() {
+				volid := "e2b6c4a8-5d1f-4a39-9c07-b8f3e6d2a154"
+				vol, err := vh.CreateVolume(volid, "test-name-owner-disk", "test-pv-owner-disk", "test-pvc-owner-disk", "test-ns-owner", defaultPool, 64*MiB, true, VolumeOwnership{UID: os.Getuid(), GID: os.Getgid(), Mode: 0750})
+				Expect(vol, err).ToNot(BeNil(), "cannot create disk volume")
+				stagingPath, err := os.MkdirTemp("", "shp-owner-staging")
+				Expect(err).To(BeNil())
+				defer os.RemoveAll(stagingPath)
+				ns := &nodeServer{nodeID: "owner-node", vh: vh}
+				stageReq := &csi.NodeStageVolumeRequest{
+					VolumeId:          volid,
+					StagingTargetPath: stagingPath,
+					VolumeContext:     map[string]string{fstypeParameter: "ext4"},
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					},
+				}
+				unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: volid, StagingTargetPath: stagingPath}
+
+				By("first stage should format and apply the ownership")
+				_, err = ns.NodeStageVolume(context.Background(), stageReq)
+				Expect(err).To(BeNil(), "cannot stage disk volume")
+				fi, err := os.Stat(stagingPath)
+				Expect(err).To(BeNil(), "cannot stat staging path")
+				Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0750)), "volume mode should be applied")
+				Expect(os.Chmod(stagingPath, 0700)).To(BeNil())
+				_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+				Expect(err).To(BeNil(), "cannot unstage disk volume")
+
+				By("later stages should keep the changed mode")
+				_, err = ns.NodeStageVolume(context.Background(), stageReq)
+				Expect(err).To(BeNil(), "cannot stage disk volume again")
+				fi, err = os.Stat(stagingPath)
+				Expect(err).To(BeNil(), "cannot stat staging path")
+				Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0700)), "volume mode should not be applied again")
+				_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+				Expect(err).To(BeNil(), "cannot unstage disk volume")
+
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete disk volume")
+			})
+		})
+
+		Describe("Folder volume capacity enforcement", func() {
+			It("project quota should be set or condition should report it", func() {
+				volname := "3f1c52a2-6b0e-4e43-9d4b-0a6f5a1c7e21"
+				vol, err := vh.CreateVolume(volname, "test-name-quota", "test-pv-quota", "test-pvc-quota", "test-ns-quota", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+
+				vd, err := vh.GetVolumeWithDetail(volname)
+				Expect(err).To(BeNil(), "error at getting volume detail")
+				Expect(vd["condition_abnormal"]).NotTo(BeTrue(), "condition should be ok")
+				if vol.ProjectID == 0 {
+					Expect(vd["condition_msg"]).To(ContainSubstring("not enforced"), "condition should report capacity is not enforced")
+				} else {
+					Expect(vol.ProjectID).To(BeNumerically(">=", projectIDBase), "project id should be allocated")
+					By("expand volume")
+					err = vh.UpdateVolumeCapacity(vol, 2<<30)
+					Expect(err).To(BeNil(), "cannot expand folder volume")
+				}
+
+				err = vh.DeleteVolume(volname)
+				Expect(err).To(BeNil(), "cannot delete folder volume")
+			})
+
+			It("project ids should be allocated under the store wide lock", func() {
+				volname := "b7d2e4f1-9a3c-4c58-8e06-1f4a7c2d9b35"
+				store := vh.store
+				defer func() { vh.store = store }()
+				var locked []string
+				vh.store = &lockRecordingStore{MetadataStore: store, locked: &locked}
+				vol, err := vh.CreateVolume(volname, "test-name-quota-lock", "test-pv-quota-lock", "test-pvc-quota-lock", "test-ns-quota", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				vh.store = store
+				Expect(locked).To(Equal([]string{volname, projectIDLockKey}), "project id should be allocated after the volume lock")
+
+				err = vh.DeleteVolume(volname)
+				Expect(err).To(BeNil(), "cannot delete folder volume")
+			})
+		})
+
+		Describe("Leader election", func() {
+			It("only one controller should be the leader", func() {
+				other, err := NewVolumeHelper(*dataRoot, *dsn)
+				Expect(other, err).ToNot(BeNil(), "cannot create second volume helper")
+				defer other.Close()
+
+				stop := make(chan struct{})
+				done := make(chan error)
+				go func() { done <- vh.lead(stop) }()
+				Eventually(vh.IsLeader, "5s").Should(BeTrue(), "first controller should lead")
+
+				otherStop := make(chan struct{})
+				otherDone := make(chan error)
+				go func() { otherDone <- other.lead(otherStop) }()
+				Consistently(other.IsLeader, "500ms").Should(BeFalse(), "second controller should wait")
+
+				close(stop)
+				Eventually(done).Should(Receive(BeNil()))
+				Expect(vh.IsLeader()).To(BeFalse(), "stopped controller should not lead")
+				Eventually(other.IsLeader, "5s").Should(BeTrue(), "second controller should take over")
+				close(otherStop)
+				Eventually(otherDone).Should(Receive(BeNil()))
+			})
+		})
+
+		Describe("Volume monitor", func() {
+			It("conditions should be stored and changes should be reported on pvcs", func() {
+				volid := "5e3a1c7f-9b0d-4e26-a8f4-d1b5f9e3c784"
+				client := fake.NewSimpleClientset(&corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: "test-pvc-70", Namespace: "test-ns-70", UID: "pvc-uid-70"},
+				})
+				vh.SetVolumeMonitor(time.Minute, 0, client)
+				defer vh.SetVolumeMonitor(0, 0, nil)
+				vol, err := vh.CreateVolume(volid, "test-name-70", "test-pv-70", "test-pvc-70", "test-ns-70", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create volume")
+
+				events := func() []corev1.Event {
+					list, err := client.CoreV1().Events("test-ns-70").List(context.Background(), metav1.ListOptions{})
+					Expect(err).To(BeNil())
+					return list.Items
+				}
+
+				By("healthy volumes should not be reported")
+				Expect(vh.CheckVolumes()).To(BeNil(), "cannot check volumes")
+				stored, err := vh.GetVolume(volid)
+				Expect(stored, err).ToNot(BeNil())
+				Expect(stored.VolumeCondition.Abnormal).To(BeFalse(), stored.VolumeCondition.Message)
+				Expect(stored.VolumeCondition.CheckedAt.IsZero()).To(BeFalse(), "check time should be stored")
+				Expect(events()).To(BeEmpty(), "no event should be created")
+
+				By("missing path should be stored and reported once")
+				Expect(os.RemoveAll(vol.VolPath)).To(BeNil())
+				Expect(vh.CheckVolumes()).To(BeNil(), "cannot check volumes")
+				Expect(vh.CheckVolumes()).To(BeNil(), "cannot check volumes")
+				vd, err := vh.GetVolumeWithDetail(volid)
+				Expect(vd, err).ToNot(BeNil())
+				Expect(vd["condition_abnormal"]).To(BeTrue(), "stored condition should be served")
+				Expect(events()).To(HaveLen(1), "abnormal volume should be reported once")
+				Expect(events()[0].Type).To(Equal(corev1.EventTypeWarning))
+				Expect(events()[0].InvolvedObject.UID).To(BeEquivalentTo("pvc-uid-70"))
+
+				By("recovered volume should be reported")
+				Expect(os.MkdirAll(vol.VolPath, 0750)).To(BeNil())
+				Expect(vh.CheckVolumes()).To(BeNil(), "cannot check volumes")
+				Expect(events()).To(HaveLen(2), "recovery should be reported")
+
+				By("low free space should mark volumes abnormal")
+				vh.SetVolumeMonitor(time.Minute, 100, client)
+				Expect(vh.CheckVolumes()).To(BeNil(), "cannot check volumes")
+				stored, err = vh.GetVolume(volid)
+				Expect(stored, err).ToNot(BeNil())
+				Expect(stored.VolumeCondition.Abnormal).To(BeTrue(), "volume should be abnormal")
+				Expect(stored.VolumeCondition.Message).To(ContainSubstring("free space of storage pool"))
+
+				Expect(vh.DeleteVolume(volid)).To(BeNil(), "cannot delete volume")
+			})
 		})
 
 		Describe("get volume details", func() {
@@ -275,7 +1733,7 @@ var _ = Describe("Utils Methods Tests", func() {
 			It("get volume details for folder type should work", func() {
 				volname := "26a136a1-7dcf-4dd7-b306-83d64afdc7e9"
 				By("create dummy volume")
-				vol, err := vh.CreateVolume(volname, "test-name-5", "test-pv-5", "test-pvc-5", "test-ns-5", 1<<30, false)
+				vol, err := vh.CreateVolume(volname, "test-name-5", "test-pv-5", "test-pvc-5", "test-ns-5", defaultPool, 1<<30, false, defaultVolumeOwnership)
 				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
 
 				By("get volume detail")
@@ -300,7 +1758,7 @@ var _ = Describe("Utils Methods Tests", func() {
 			It("get volume details for disk type should work", func() {
 				volname := "f715058b-3ae9-4f59-877d-3800354d51d5"
 				By("create dummy volume")
-				vol, err := vh.CreateVolume(volname, "test-name-6", "test-pv-6", "test-pvc-6", "test-ns-6", 1<<30, true)
+				vol, err := vh.CreateVolume(volname, "test-name-6", "test-pv-6", "test-pvc-6", "test-ns-6", defaultPool, 1<<30, true, defaultVolumeOwnership)
 				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
 
 				By("get volume detail")
@@ -333,5 +1791,181 @@ var _ = Describe("Utils Methods Tests", func() {
 				vh.DeleteVolume(volname)
 			})
 		})
+
+		Describe("Failed mutations", func() {
+			AfterEach(func() {
+				clearFailures(vh)
+			})
+
+			It("failed volume creation should leave nothing", func() {
+				volname := "7c1e9a4d-2b6f-4d83-9e05-a3f8c2d1b746"
+				for _, step := range []string{"CreateVolume/populate", "CreateVolume/quota", "CreateVolume/symlink", ""} {
+					By(fmt.Sprintf("failing at step %q", step))
+					injectFailure(vh, step)
+					vol, err := vh.CreateVolume(volname, "test-name-20", "test-pv-20", "test-pvc-20", "test-ns-20", defaultPool, 1<<30, false, defaultVolumeOwnership)
+					Expect(vol).To(BeNil(), "volume should not be returned")
+					Expect(err).Should(MatchError(errInjected))
+					clearFailures(vh)
+
+					_, err = vh.GetVolume(volname)
+					Expect(err).Should(MatchError(gorm.ErrRecordNotFound), "volume should not be stored")
+					Expect(*dataRoot+"/vols/7c/1e/9a/"+volname).ShouldNot(BeADirectory(), "volume folder should not be exists")
+					Expect(*dataRoot+"/syms/test-ns-20/test-pvc-20").ShouldNot(BeAnExistingFile(), "volume symlink should not be exists")
+				}
+			})
+
+			It("volume record should not be found before the volume is populated", func() {
+				volname := "a9d3f7b1-6e2c-4f48-8b05-d1c7e4a2f963"
+				var lookupErr error
+				failStep = func(step string) error {
+					if step == "CreateVolume/symlink" {
+						_, lookupErr = vh.GetVolumeIdByName("test-name-89")
+					}
+					return nil
+				}
+				vol, err := vh.CreateVolume(volname, "test-name-89", "test-pv-89", "test-pvc-89", "test-ns-89", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				Expect(lookupErr).Should(MatchError(gorm.ErrRecordNotFound), "volume should not be found while it is populated")
+
+				volid, err := vh.GetVolumeIdByName("test-name-89")
+				Expect(err).To(BeNil(), "volume should be found after it is created")
+				Expect(volid).To(Equal(volname))
+				stored, err := vh.GetVolume(volname)
+				Expect(stored, err).ToNot(BeNil(), "cannot get volume")
+				Expect(stored.ProjectID).To(Equal(vol.ProjectID), "project id should be stored with the volume")
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "cannot delete volume")
+			})
+
+			It("failed disk expansion should keep the old size", func() {
+				volname := "e4b2f8c6-9d1a-4a57-b3e0-6c8d2f1a9b54"
+				vol, err := vh.CreateVolume(volname, "test-name-21", "test-pv-21", "test-pvc-21", "test-ns-21", defaultPool, 1<<30, true, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create disk volume")
+
+				for _, step := range []string{"UpdateVolumeCapacity/expand", ""} {
+					By(fmt.Sprintf("failing at step %q", step))
+					injectFailure(vh, step)
+					err = vh.UpdateVolumeCapacity(vol, 2<<30)
+					Expect(err).Should(MatchError(errInjected))
+					clearFailures(vh)
+
+					Expect(vol.Capacity).To(Equal(int64(1<<30)), "volume capacity should not be changed")
+					stored, err := vh.GetVolume(volname)
+					Expect(stored, err).ToNot(BeNil(), "cannot get volume")
+					Expect(stored.Capacity).To(Equal(int64(1<<30)), "stored capacity should not be changed")
+					fi, err := os.Stat(vol.VolPath)
+					Expect(fi, err).ToNot(BeNil(), "cannot stat volume file")
+					Expect(fi.Size()).To(Equal(int64(1<<30)), "file size should be reverted")
+				}
+
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "cannot delete volume")
+			})
+
+			It("failed volume deletion should keep the volume", func() {
+				volname := "3a9f6d2e-8c4b-4e71-a0d5-b7e2c9f1d368"
+				vol, err := vh.CreateVolume(volname, "test-name-22", "test-pv-22", "test-pvc-22", "test-ns-22", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				Expect(os.WriteFile(vol.VolPath+"/data.txt", []byte("keep"), 0640)).To(BeNil(), "cannot write volume data")
+
+				for _, step := range []string{"DeleteVolume/move", ""} {
+					By(fmt.Sprintf("failing at step %q", step))
+					injectFailure(vh, step)
+					err = vh.DeleteVolume(volname)
+					Expect(err).Should(MatchError(errInjected))
+					clearFailures(vh)
+
+					stored, err := vh.GetVolume(volname)
+					Expect(stored, err).ToNot(BeNil(), "volume should be kept")
+					data, err := os.ReadFile(vol.VolPath + "/data.txt")
+					Expect(string(data), err).To(Equal("keep"), "volume data should be kept")
+					Expect(*dataRoot+"/syms/test-ns-22/test-pvc-22").Should(BeAnExistingFile(), "volume symlink should be kept")
+				}
+
+				By("failing while removing data after commit")
+				injectFailure(vh, "DeleteVolume/remove")
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "volume should be deleted")
+				clearFailures(vh)
+				_, err = vh.GetVolume(volname)
+				Expect(err).Should(MatchError(gorm.ErrRecordNotFound), "volume should not be returned")
+				Expect(vol.VolPath).ShouldNot(BeADirectory(), "volume folder should not be exists")
+				Expect(vol.VolPath+deletingSuffix).Should(BeADirectory(), "volume data should wait for cleanup")
+
+				By("cleanup should remove the left data")
+				_, err = vh.CleanUpDanglingVolumes(CleanupOptions{})
+				Expect(err).To(BeNil(), "cannot cleanup dangling volumes")
+				Expect(vol.VolPath+deletingSuffix).ShouldNot(BeADirectory(), "volume data should be removed")
+			})
+
+			It("failed snapshot operations should keep the store and disk consistent", func() {
+				volname := "b6d3a1f9-4e2c-4b80-9f17-c5a8e3d2f091"
+				snapname := "f1c7e5a3-2d9b-4f64-8a0e-d3b6f9c2e517"
+				vol, err := vh.CreateVolume(volname, "test-name-23", "test-pv-23", "test-pvc-23", "test-ns-23", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+				snapPath := *dataRoot + "/snaps/f1/c7/e5/" + snapname
+
+				for _, step := range []string{"CreateSnapshot/copy", ""} {
+					By(fmt.Sprintf("failing creation at step %q", step))
+					injectFailure(vh, step)
+					snap, err := vh.CreateSnapshot(snapname, "test-snap-23", vol)
+					Expect(snap).To(BeNil(), "snapshot should not be returned")
+					Expect(err).Should(MatchError(errInjected))
+					clearFailures(vh)
+
+					_, err = vh.GetSnapshot(snapname)
+					Expect(err).Should(MatchError(gorm.ErrRecordNotFound), "snapshot should not be stored")
+					Expect(snapPath).ShouldNot(BeADirectory(), "snapshot folder should not be exists")
+				}
+
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-23", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+
+				for _, step := range []string{"DeleteSnapshot/move", ""} {
+					By(fmt.Sprintf("failing deletion at step %q", step))
+					injectFailure(vh, step)
+					Expect(vh.DeleteSnapshot(snapname)).Should(MatchError(errInjected))
+					clearFailures(vh)
+
+					stored, err := vh.GetSnapshot(snapname)
+					Expect(stored, err).ToNot(BeNil(), "snapshot should be kept")
+					Expect(snapPath).Should(BeADirectory(), "snapshot folder should be kept")
+				}
+
+				Expect(vh.DeleteSnapshot(snapname)).To(BeNil(), "cannot delete snapshot")
+				Expect(snapPath).ShouldNot(BeADirectory(), "snapshot folder should not be exists")
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "cannot delete volume")
+			})
+
+			It("snapshot copy should not hold the source volume lock", func() {
+				volname := "0d4e8b2a-7c13-4f5e-9a6b-e2f1c8d3b704"
+				snapname := "5a9c3e1f-b2d4-4e68-8f07-a1c6d9e2f354"
+				vol, err := vh.CreateVolume(volname, "test-name-24", "test-pv-24", "test-pvc-24", "test-ns-24", defaultPool, 1<<30, false, defaultVolumeOwnership)
+				Expect(vol, err).ToNot(BeNil(), "cannot create folder volume")
+
+				lockedDuringCopy := make(chan error, 1)
+				failStep = func(step string) error {
+					if step == "CreateSnapshot/copy" {
+						go func() {
+							lockedDuringCopy <- vh.store.Transaction(func(store MetadataStore) error {
+								return store.LockVolume(volname)
+							})
+						}()
+						select {
+						case err := <-lockedDuringCopy:
+							lockedDuringCopy <- err
+						case <-time.After(5 * time.Second):
+						}
+					}
+					return nil
+				}
+				defer clearFailures(vh)
+
+				snap, err := vh.CreateSnapshot(snapname, "test-snap-24", vol)
+				Expect(snap, err).ToNot(BeNil(), "cannot create snapshot")
+				Expect(snap.ReadyToUse).To(BeTrue(), "snapshot should be ready")
+				Expect(lockedDuringCopy).Should(Receive(BeNil()), "volume should be lockable during the copy")
+
+				Expect(vh.DeleteSnapshot(snapname)).To(BeNil(), "cannot delete snapshot")
+				Expect(vh.DeleteVolume(volname)).To(BeNil(), "cannot delete volume")
+			})
+		})
 	})
 })
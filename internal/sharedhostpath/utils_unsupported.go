@@ -21,6 +21,8 @@ package sharedhostpath
 import (
 	"fmt"
 	klog "k8s.io/klog/v2"
+	"os"
+	"time"
 )
 
 func getStatistics(volumePath string) (volumeStatistics, error) {
@@ -32,3 +34,57 @@ func getBlockDeviceSize(blockDevice string) (int64, error) {
 	klog.V(6).Info("getBlockDeviceSize not supported for this build.")
 	return -1, fmt.Errorf("getBlockDeviceSize not supported for this build.")
 }
+
+func copyDirectory(src, dst string) (string, error) {
+	klog.V(6).Info("copyDirectory not supported for this build.")
+	return "", fmt.Errorf("copyDirectory not supported for this build.")
+}
+
+func cloneFile(src, dst string) (string, error) {
+	klog.V(6).Info("cloneFile not supported for this build.")
+	return "", fmt.Errorf("cloneFile not supported for this build.")
+}
+
+func getAllocatedSize(path string) (int64, error) {
+	klog.V(6).Info("getAllocatedSize not supported for this build.")
+	return 0, fmt.Errorf("getAllocatedSize not supported for this build.")
+}
+
+func applyVolumeMountGroup(path string, gid int) error {
+	klog.V(6).Info("applyVolumeMountGroup not supported for this build.")
+	return fmt.Errorf("applyVolumeMountGroup not supported for this build.")
+}
+
+func lockFile(path string, exclusive bool, timeout time.Duration) (*os.File, error) {
+	klog.V(6).Info("lockFile not supported for this build.")
+	return nil, fmt.Errorf("lockFile not supported for this build.")
+}
+
+func unlockFile(f *os.File) error {
+	klog.V(6).Info("unlockFile not supported for this build.")
+	return fmt.Errorf("unlockFile not supported for this build.")
+}
+
+func isStaleError(err error) bool {
+	return false
+}
+
+func isReadOnlyFilesystem(path string) (bool, error) {
+	klog.V(6).Info("isReadOnlyFilesystem not supported for this build.")
+	return false, fmt.Errorf("isReadOnlyFilesystem not supported for this build.")
+}
+
+func getLoopBackingFile(device string) (string, error) {
+	klog.V(6).Info("getLoopBackingFile not supported for this build.")
+	return "", fmt.Errorf("getLoopBackingFile not supported for this build.")
+}
+
+func fenceLoopDevice(device string) error {
+	klog.V(6).Info("fenceLoopDevice not supported for this build.")
+	return fmt.Errorf("fenceLoopDevice not supported for this build.")
+}
+
+func hasFilesystem(device string) (bool, error) {
+	klog.V(6).Info("hasFilesystem not supported for this build.")
+	return false, fmt.Errorf("hasFilesystem not supported for this build.")
+}
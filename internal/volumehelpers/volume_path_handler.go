@@ -56,6 +56,9 @@ type BlockVolumePathHandler interface {
 	// AttachFileDevice takes a path to a regular file and makes it available as an
 	// attached block device.
 	AttachFileDevice(path string) (string, error)
+	// AttachFileDeviceReadOnly takes a path to a regular file and makes it available as an
+	// attached read only block device.
+	AttachFileDeviceReadOnly(path string) (string, error)
 	// DetachFileDevice takes a path to the attached block device and
 	// detach it from block device.
 	DetachFileDevice(path string) error
@@ -22,6 +22,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -36,6 +37,16 @@ import (
 // AttachFileDevice takes a path to a regular file and makes it available as an
 // attached block device.
 func (v VolumePathHandler) AttachFileDevice(path string) (string, error) {
+	return v.attachFileDevice(path, false)
+}
+
+// AttachFileDeviceReadOnly takes a path to a regular file and makes it available as an
+// attached read only block device.
+func (v VolumePathHandler) AttachFileDeviceReadOnly(path string) (string, error) {
+	return v.attachFileDevice(path, true)
+}
+
+func (v VolumePathHandler) attachFileDevice(path string, readOnly bool) (string, error) {
 	blockDevicePath, err := v.GetLoopDevice(path)
 	if err != nil && err.Error() != ErrDeviceNotFound {
 		return "", fmt.Errorf("GetLoopDevice failed for path %s: %v", path, err)
@@ -44,14 +55,33 @@ func (v VolumePathHandler) AttachFileDevice(path string) (string, error) {
 	// If no existing loop device for the path, create one
 	if blockDevicePath == "" {
 		klog.V(4).Infof("Creating device for path: %s", path)
-		blockDevicePath, err = makeLoopDevice(path)
+		blockDevicePath, err = makeLoopDevice(path, readOnly)
 		if err != nil {
 			return "", fmt.Errorf("makeLoopDevice failed for path %s: %v", path, err)
 		}
+		return blockDevicePath, nil
+	}
+
+	// An existing loop device is reused only when it has the requested access
+	deviceReadOnly, err := IsLoopDeviceReadOnly(blockDevicePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot check read only flag of loop device %s for path %s: %v", blockDevicePath, path, err)
+	}
+	if deviceReadOnly != readOnly {
+		return "", fmt.Errorf("loop device %s for path %s is attached with read only %v, but read only %v is requested", blockDevicePath, path, deviceReadOnly, readOnly)
 	}
 	return blockDevicePath, nil
 }
 
+// IsLoopDeviceReadOnly reads the read only flag of the loop device from sysfs
+func IsLoopDeviceReadOnly(device string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "ro"))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
 // DetachFileDevice takes a path to the attached block device and
 // detach it from block device.
 func (v VolumePathHandler) DetachFileDevice(path string) error {
@@ -111,13 +141,16 @@ func (v VolumePathHandler) ReReadFileSize(path string) error {
 	return nil
 }
 
-func makeLoopDevice(path string) (string, error) {
+func makeLoopDevice(path string, readOnly bool) (string, error) {
 	args := []string{"-f", "--show", path}
+	if readOnly {
+		args = append([]string{"-r"}, args...)
+	}
 	cmd := exec.Command(losetupPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		klog.V(2).Infof("Failed device create command for path: %s %v %s ", path, err, out)
-		return "", fmt.Errorf("losetup -f --show %s failed: %v", path, err)
+		return "", fmt.Errorf("losetup %s failed: %v", strings.Join(args, " "), err)
 	}
 
 	// losetup -f --show {path} returns device in the format:
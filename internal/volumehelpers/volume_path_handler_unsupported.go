@@ -30,6 +30,17 @@ func (v VolumePathHandler) AttachFileDevice(path string) (string, error) {
 	return "", fmt.Errorf("AttachFileDevice not supported for this build.")
 }
 
+// AttachFileDeviceReadOnly takes a path to a regular file and makes it available as an
+// attached read only block device.
+func (v VolumePathHandler) AttachFileDeviceReadOnly(path string) (string, error) {
+	return "", fmt.Errorf("AttachFileDeviceReadOnly not supported for this build.")
+}
+
+// IsLoopDeviceReadOnly reads the read only flag of the loop device from sysfs
+func IsLoopDeviceReadOnly(device string) (bool, error) {
+	return false, fmt.Errorf("IsLoopDeviceReadOnly not supported for this build.")
+}
+
 // DetachFileDevice takes a path to the attached block device and
 // detach it from block device.
 func (v VolumePathHandler) DetachFileDevice(path string) error {